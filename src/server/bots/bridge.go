@@ -0,0 +1,398 @@
+package bots
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"irc-final-project/chatroom"
+	"irc-final-project/logging"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// how long to wait on the IRC server
+const (
+	ircDialTimeout  = 10 * time.Second
+	ircWriteTimeout = 10 * time.Second
+	// IRC servers ping every few minutes, nothing at all for this long means the connection is gone
+	ircReadTimeout = 5 * time.Minute
+	// the longest wait between reconnects
+	maxReconnectWait = time.Minute
+)
+
+// IRC lines are at most 512 bytes with the CRLF, and the server puts our nick!user@host in front when relaying
+// so the text of a PRIVMSG is kept well below that
+const ircTextSize = 400
+
+// the most of that the nickname a line is from can take, longer ones are cut
+const ircNickSize = ircTextSize / 8
+
+// the log lines of the bridges
+var bridgeLog = logging.New("bridge")
+
+// a bot that relays a room to a channel on an IRC network, both ways
+// it connects to the IRC server as a client, and reconnects when the connection is lost
+// to avoid loops, it never relays its own messages, notices stay notices on both sides, and
+// IRC lines are posted to the room with the IRC nickname in front, so they can't run commands
+type IRCBridge struct {
+	Server   string // host:port of the IRC server
+	TLS      bool   // whether to connect with TLS
+	Password string // the server password, empty for none
+	Nick     string // the nickname to ask for on IRC, `_` is added while it's taken
+	Channel  string // the channel to relay, like `#team`
+	// how long to wait before the first reconnect, doubled after each failed one up to a minute
+	// 0 waits a second
+	ReconnectWait time.Duration
+
+	client *chatroom.Client // stands in for the bridge in the room
+	stop   chan struct{}    // closed by Close
+
+	lock   sync.Mutex
+	conn   net.Conn // nil while disconnected
+	joined bool     // whether the bridge is in the channel, so it can relay to it
+	closed bool
+}
+
+// puts a bridge in a room under its nickname and starts connecting to IRC
+func StartIRCBridge(room *chatroom.Room, b *IRCBridge) {
+	b.stop = make(chan struct{})
+	b.client = chatroom.AddBot(room, b.Nick, b)
+	go b.run()
+}
+
+// disconnects from IRC for good
+// the bridge stays in the room, but relays nothing anymore
+func (b *IRCBridge) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	close(b.stop)
+	if b.conn != nil {
+		b.writeLine(b.conn, "QUIT :bridge closed")
+		b.conn.Close()
+	}
+}
+
+func (b *IRCBridge) OnJoin(c *chatroom.Client, room *chatroom.Room) {
+	room.Logf("%s relays %s to %s on %s\n", c.Nickname, room.RoomName, b.Channel, b.Server)
+}
+
+// relays what people say in the room to the channel
+func (b *IRCBridge) OnMessage(c *chatroom.Client, room *chatroom.Room, message chatroom.Message) {
+	// its own messages are the ones that came from IRC, and whispers and server messages stay here
+	if message.FromNick == c.Nickname || message.IsDirectMessage {
+		return
+	}
+	switch message.Kind {
+	case chatroom.KindChat, chatroom.KindFile:
+		b.relay("PRIVMSG", fmt.Sprintf("<%s> ", shortNick(message.FromNick)), message.Content)
+	case chatroom.KindAction:
+		b.relay("PRIVMSG", fmt.Sprintf("* %s ", shortNick(message.FromNick)), message.Content)
+	case chatroom.KindNotice:
+		b.relay("NOTICE", fmt.Sprintf("<%s> ", shortNick(message.FromNick)), message.Content)
+	}
+}
+
+// sends text to the channel, a line at a time, with a prefix in front of each line
+// it is dropped while the bridge isn't in the channel
+func (b *IRCBridge) relay(command string, prefix string, text string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.joined {
+		bridgeLog.Debug("relay-dropped", logging.Fields{"channel": b.Channel, "reason": "not in the channel"})
+		return
+	}
+	for _, line := range ircTextLines(prefix, text) {
+		if err := b.writeLine(b.conn, fmt.Sprintf("%s %s :%s", command, b.Channel, line)); err != nil {
+			return
+		}
+	}
+}
+
+// the texts of the IRC lines text is sent as, each with the prefix in front
+// they are at most ircTextSize bytes, unless the prefix alone is about that long
+func ircTextLines(prefix string, text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		// a CR or NUL would end the IRC line early
+		line = strings.NewReplacer("\r", "", "\x00", "").Replace(line)
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		for _, part := range splitText(line, ircTextSize-len(prefix)) {
+			lines = append(lines, prefix+part)
+		}
+	}
+	return lines
+}
+
+// writes a line to the IRC server, the caller holds the lock
+func (b *IRCBridge) writeLine(conn net.Conn, line string) error {
+	conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+	_, err := conn.Write([]byte(line + "\r\n"))
+	if err != nil {
+		bridgeLog.Warn("write", logging.Fields{"server": b.Server, "error": err})
+	}
+	return err
+}
+
+// same as writeLine, taking the lock
+func (b *IRCBridge) send(conn net.Conn, format string, a ...any) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.writeLine(conn, fmt.Sprintf(format, a...))
+}
+
+// connects to IRC until the bridge is closed, waiting longer after each failed try
+func (b *IRCBridge) run() {
+	wait := b.firstWait()
+	for {
+		joined, err := b.session()
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+		if joined {
+			// it worked for a while, so try again soon
+			wait = b.firstWait()
+		}
+		bridgeLog.Warn("disconnected", logging.Fields{"server": b.Server, "channel": b.Channel, "error": err, "retry": wait.String()})
+		select {
+		case <-b.stop:
+			return
+		case <-time.After(wait):
+		}
+		wait = nextWait(wait)
+	}
+}
+
+// how long to wait before the first reconnect or rejoin
+func (b *IRCBridge) firstWait() time.Duration {
+	if b.ReconnectWait <= 0 {
+		return time.Second
+	}
+	return b.ReconnectWait
+}
+
+// twice as long as the last wait, up to a minute
+func nextWait(wait time.Duration) time.Duration {
+	wait *= 2
+	if wait > maxReconnectWait {
+		wait = maxReconnectWait
+	}
+	return wait
+}
+
+// connects to the IRC server, joins the channel and relays it to the room until the connection is lost
+// tells if the channel was joined
+func (b *IRCBridge) session() (bool, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return false, err
+	}
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		conn.Close()
+		return false, errors.New("closed")
+	}
+	b.conn = conn
+	b.lock.Unlock()
+	joined := false
+	// rejoining after a kick waits like reconnecting does, so a channel that kicks the bridge right away isn't flooded
+	rejoinWait := b.firstWait()
+	var rejoin *time.Timer
+	defer func() {
+		if rejoin != nil {
+			rejoin.Stop()
+		}
+		b.lock.Lock()
+		b.conn = nil
+		b.joined = false
+		b.lock.Unlock()
+		conn.Close()
+	}()
+
+	nick := sanitizeNick(b.Nick)
+	if b.Password != "" {
+		b.send(conn, "PASS %s", b.Password)
+	}
+	b.send(conn, "NICK %s", nick)
+	b.send(conn, "USER %s 0 * :%s bridge", nick, b.client.CurrentRoom().RoomName)
+
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(ircReadTimeout))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return joined, err
+		}
+		m := parseIRCLine(line)
+		switch m.command {
+		case "PING":
+			b.send(conn, "PONG :%s", m.param(0))
+		case "001":
+			// registered, the server tells us the nickname we ended up with
+			nick = m.param(0)
+			b.send(conn, "JOIN %s", b.Channel)
+		case "433":
+			// nickname in use
+			nick += "_"
+			b.send(conn, "NICK %s", nick)
+		case "NICK":
+			if m.nick() == nick {
+				nick = m.param(0)
+			}
+		case "JOIN":
+			if m.nick() == nick && strings.EqualFold(m.param(0), b.Channel) {
+				joined = true
+				b.lock.Lock()
+				b.joined = true
+				b.lock.Unlock()
+				bridgeLog.Info("joined", logging.Fields{"server": b.Server, "channel": b.Channel, "nick": nick})
+			}
+		case "KICK":
+			if strings.EqualFold(m.param(0), b.Channel) && m.param(1) == nick {
+				b.lock.Lock()
+				b.joined = false
+				b.lock.Unlock()
+				bridgeLog.Warn("kicked", logging.Fields{"server": b.Server, "channel": b.Channel, "by": m.nick(), "reason": m.param(2), "retry": rejoinWait.String()})
+				if rejoin != nil {
+					rejoin.Stop()
+				}
+				rejoin = time.AfterFunc(rejoinWait, func() {
+					b.send(conn, "JOIN %s", b.Channel)
+				})
+				rejoinWait = nextWait(rejoinWait)
+			}
+		case "471", "473", "474", "475":
+			// the channel is full, invite only, we're banned, or it needs a key
+			return joined, fmt.Errorf("can't join %s: %s", b.Channel, m.param(len(m.params)-1))
+		case "ERROR":
+			return joined, fmt.Errorf("server said: %s", m.param(0))
+		case "PRIVMSG", "NOTICE":
+			if strings.EqualFold(m.param(0), b.Channel) && m.nick() != nick {
+				b.relayToRoom(m)
+			}
+		}
+	}
+}
+
+// connects to the IRC server, with TLS if asked to
+func (b *IRCBridge) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: ircDialTimeout}
+	if b.TLS {
+		return tls.DialWithDialer(dialer, "tcp", b.Server, nil)
+	}
+	return dialer.Dial("tcp", b.Server)
+}
+
+// posts a channel message to the room, with the IRC nickname in front
+func (b *IRCBridge) relayToRoom(m ircLine) {
+	text := m.param(1)
+	if strings.HasPrefix(text, "\x01") {
+		// CTCP, only actions are relayed
+		if !strings.HasPrefix(text, "\x01ACTION ") || m.command != "PRIVMSG" {
+			return
+		}
+		action := strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+		b.client.Say(fmt.Sprintf("* %s %s", m.nick(), action))
+		return
+	}
+	if m.command == "NOTICE" {
+		b.client.Notice(fmt.Sprintf("<%s> %s", m.nick(), text))
+		return
+	}
+	b.client.Say(fmt.Sprintf("<%s> %s", m.nick(), text))
+}
+
+// a line from the IRC server, like `:nick!user@host PRIVMSG #channel :hello there`
+type ircLine struct {
+	prefix  string   // where it's from, empty for the server we are connected to
+	command string   // a command like PRIVMSG, or a 3 digit reply
+	params  []string // the last one can have spaces
+}
+
+func parseIRCLine(line string) ircLine {
+	line = strings.TrimRight(line, "\r\n")
+	var m ircLine
+	if strings.HasPrefix(line, ":") {
+		m.prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+	m.command, line, _ = strings.Cut(line, " ")
+	m.command = strings.ToUpper(m.command)
+	for line != "" {
+		if strings.HasPrefix(line, ":") {
+			m.params = append(m.params, line[1:])
+			break
+		}
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		if param != "" {
+			m.params = append(m.params, param)
+		}
+	}
+	return m
+}
+
+// the nickname a line is from
+func (m ircLine) nick() string {
+	nick, _, _ := strings.Cut(m.prefix, "!")
+	return nick
+}
+
+// a parameter of the line, empty if there aren't that many
+func (m ircLine) param(i int) string {
+	if i < 0 || i >= len(m.params) {
+		return ""
+	}
+	return m.params[i]
+}
+
+// splits text into parts of at most size bytes, without cutting a character in two
+// size is at least utf8.UTFMax, so every part has a whole character
+func splitText(text string, size int) []string {
+	if size < utf8.UTFMax {
+		size = utf8.UTFMax
+	}
+	var parts []string
+	for len(text) > size {
+		cut := size
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			// not UTF-8, cut it anywhere rather than never
+			cut = size
+		}
+		parts = append(parts, text[:cut])
+		text = text[cut:]
+	}
+	return append(parts, text)
+}
+
+// a nickname cut down to ircNickSize bytes, so the text relayed after it still has room
+func shortNick(nick string) string {
+	if len(nick) <= ircNickSize {
+		return nick
+	}
+	return splitText(nick, ircNickSize-len("…"))[0] + "…"
+}
+
+// IRC nicknames can't have spaces and the like, which our nicknames can
+func sanitizeNick(nick string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || strings.ContainsRune(",*?!@.:#&", r) {
+			return '_'
+		}
+		return r
+	}, nick)
+}
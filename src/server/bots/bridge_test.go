@@ -0,0 +1,404 @@
+package bots
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"irc-final-project/chatroom"
+	"irc-final-project/logging"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// how long the tests wait for something before failing
+const testTimeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	logging.Configure(io.Discard, logging.FormatLogfmt, logging.LevelDebug, nil)
+	os.Exit(m.Run())
+}
+
+// just enough of an IRC server for one channel: it registers clients, lets them join, and hands what they say to the test
+type fakeIRC struct {
+	t        *testing.T
+	listener net.Listener
+	lines    chan string // everything the bridge sends, but PONGs
+	lock     sync.Mutex
+	conn     net.Conn        // the client connected last
+	taken    map[string]bool // nicknames that are already in use
+}
+
+func newFakeIRC(t *testing.T, taken ...string) *fakeIRC {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeIRC{t: t, listener: listener, lines: make(chan string, 256), taken: make(map[string]bool)}
+	for _, nick := range taken {
+		s.taken[nick] = true
+	}
+	go s.accept()
+	t.Cleanup(func() {
+		listener.Close()
+		s.drop()
+	})
+	return s
+}
+
+func (s *fakeIRC) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conn = conn
+		s.lock.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// answers a client like an IRC server would
+func (s *fakeIRC) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	nick, user := "", false
+	welcome := func() {
+		if nick != "" && user {
+			fmt.Fprintf(conn, ":irc.test 001 %s :Welcome\r\n", nick)
+			// make sure the bridge answers pings
+			fmt.Fprintf(conn, "PING :irc.test\r\n")
+		}
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		m := parseIRCLine(line)
+		switch m.command {
+		case "NICK":
+			if s.taken[m.param(0)] {
+				fmt.Fprintf(conn, ":irc.test 433 * %s :Nickname is already in use\r\n", m.param(0))
+				continue
+			}
+			nick = m.param(0)
+			welcome()
+		case "USER":
+			user = true
+			welcome()
+		case "JOIN":
+			fmt.Fprintf(conn, ":%s!bridge@test JOIN %s\r\n", nick, m.param(0))
+		case "PONG":
+			continue
+		}
+		s.lines <- line
+	}
+}
+
+// says something to the client connected last, like another IRC user would
+func (s *fakeIRC) say(line string) {
+	s.t.Helper()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := fmt.Fprintf(s.conn, "%s\r\n", line); err != nil {
+		s.t.Fatalf("irc: %v", err)
+	}
+}
+
+// closes the connection of the client connected last
+func (s *fakeIRC) drop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// waits for the bridge to send a line starting with something, skipping the others
+func (s *fakeIRC) expect(prefix string) string {
+	s.t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case line := <-s.lines:
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		case <-timeout:
+			s.t.Fatalf("irc: timed out waiting for `%s`", prefix)
+		}
+	}
+}
+
+// a bot that hands the room's messages to the test, and talks for a person in the room
+type listener chan chatroom.Message
+
+func (listener) OnJoin(c *chatroom.Client, room *chatroom.Room) {}
+
+func (l listener) OnMessage(c *chatroom.Client, room *chatroom.Room, message chatroom.Message) {
+	l <- message
+}
+
+// waits for a message in the room from someone, with some content
+// empty ones match anything
+func (l listener) expect(t *testing.T, from string, content string) chatroom.Message {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case m := <-l:
+			if (from == "" || m.FromNick == from) && (content == "" || m.Content == content) {
+				return m
+			}
+		case <-timeout:
+			t.Fatalf("room: timed out waiting for <%s> %s", from, content)
+		}
+	}
+}
+
+// starts a bridge from a new room to #team on a fake IRC server, and waits for it to join
+func startTestBridge(t *testing.T, roomName string, irc *fakeIRC) (*IRCBridge, *chatroom.Client, listener) {
+	t.Helper()
+	room := chatroom.NewRoom(roomName)
+	heard := make(listener, 256)
+	person := chatroom.AddBot(room, roomName+"-alice", heard)
+	b := &IRCBridge{Server: irc.listener.Addr().String(), Nick: roomName + "-bridge", Channel: "#team", ReconnectWait: 10 * time.Millisecond}
+	StartIRCBridge(room, b)
+	t.Cleanup(b.Close)
+	irc.expect("JOIN #team")
+	waitJoined(t, b)
+	return b, person, heard
+}
+
+// waits for the bridge to hear that it is in the channel, until then it relays nothing
+func waitJoined(t *testing.T, b *IRCBridge) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		b.lock.Lock()
+		joined := b.joined
+		b.lock.Unlock()
+		if joined {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the bridge to join the channel")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestIRCBridge(t *testing.T) {
+	irc := newFakeIRC(t)
+	b, alice, heard := startTestBridge(t, "bridge", irc)
+	alice.Say("hello irc")
+	if got := irc.expect("PRIVMSG"); got != "PRIVMSG #team :<"+alice.Nickname+"> hello irc" {
+		t.Fatalf("relayed to irc = %q", got)
+	}
+
+	tests := []struct {
+		name     string
+		irc      string // what an IRC user says
+		from     string // who it's from in the room
+		want     string
+		wantKind chatroom.MessageKind
+	}{
+		{"message", ":bob!b@test PRIVMSG #team :hello room", b.client.Nickname, "<bob> hello room", chatroom.KindChat},
+		{"notice", ":bob!b@test NOTICE #team :I'm a bot", b.client.Nickname, "<bob> I'm a bot", chatroom.KindNotice},
+		{"action", ":bob!b@test PRIVMSG #team :\x01ACTION waves\x01", b.client.Nickname, "* bob waves", chatroom.KindChat},
+		// a command from IRC is just text in the room
+		{"command", ":bob!b@test PRIVMSG #team :/exit", b.client.Nickname, "<bob> /exit", chatroom.KindChat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			irc.say(tt.irc)
+			if m := heard.expect(t, tt.from, tt.want); m.Kind != tt.wantKind {
+				t.Errorf("kind = %s, want %s", m.Kind, tt.wantKind)
+			}
+		})
+	}
+
+	t.Run("no loops", func(t *testing.T) {
+		irc.say(":bob!b@test PRIVMSG #team :only once")
+		heard.expect(t, b.client.Nickname, "<bob> only once")
+		// what came from IRC isn't sent back, so the next line the server gets is alice's
+		alice.Say("after that")
+		if got := irc.expect("PRIVMSG"); got != "PRIVMSG #team :<"+alice.Nickname+"> after that" {
+			t.Errorf("relayed to irc = %q, want alice's message", got)
+		}
+	})
+	t.Run("notices stay notices", func(t *testing.T) {
+		alice.Notice("automatic")
+		if got := irc.expect("NOTICE"); got != "NOTICE #team :<"+alice.Nickname+"> automatic" {
+			t.Errorf("relayed to irc = %q", got)
+		}
+	})
+	t.Run("long and multiline messages", func(t *testing.T) {
+		alice.Say(strings.Repeat("é", 300) + "\nsecond line")
+		var got []string
+		for i := 0; i < 3; i++ {
+			got = append(got, strings.TrimPrefix(irc.expect("PRIVMSG"), "PRIVMSG #team :<"+alice.Nickname+"> "))
+		}
+		if got[0]+got[1] != strings.Repeat("é", 300) || got[2] != "second line" {
+			t.Errorf("relayed to irc = %q", got)
+		}
+		for _, part := range got {
+			if len(part) > ircTextSize {
+				t.Errorf("part is %d bytes, want at most %d", len(part), ircTextSize)
+			}
+		}
+	})
+}
+
+func TestIRCBridgeReconnects(t *testing.T) {
+	irc := newFakeIRC(t)
+	b, alice, heard := startTestBridge(t, "reconnect", irc)
+	irc.drop()
+	irc.expect("NICK reconnect-bridge")
+	irc.expect("JOIN #team")
+	waitJoined(t, b)
+
+	alice.Say("still here")
+	irc.expect("PRIVMSG #team :<" + alice.Nickname + "> still here")
+	irc.say(":bob!b@test PRIVMSG #team :welcome back")
+	heard.expect(t, b.client.Nickname, "<bob> welcome back")
+}
+
+func TestIRCBridgeRejoinsAfterKick(t *testing.T) {
+	irc := newFakeIRC(t)
+	b, alice, _ := startTestBridge(t, "kicked", irc)
+	// each kick makes the bridge wait twice as long before joining again
+	for _, wait := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond} {
+		kicked := time.Now()
+		irc.say(":op!o@test KICK #team " + b.Nick + " :go away")
+		irc.expect("JOIN #team")
+		if waited := time.Since(kicked); waited < wait {
+			t.Fatalf("joined again after %s, want at least %s", waited, wait)
+		}
+		waitJoined(t, b)
+	}
+	alice.Say("back again")
+	irc.expect("PRIVMSG #team :<" + alice.Nickname + "> back again")
+}
+
+func TestIRCBridgeNickInUse(t *testing.T) {
+	irc := newFakeIRC(t, "taken-bridge")
+	_, alice, heard := startTestBridge(t, "taken", irc)
+	// lines from the nickname the bridge ended up with are its own
+	irc.say(":taken-bridge_!b@test PRIVMSG #team :from myself")
+	irc.say(":taken-bridge!b@test PRIVMSG #team :from someone else")
+	for m := heard.expect(t, "", ""); ; m = heard.expect(t, "", "") {
+		if strings.Contains(m.Content, "from myself") {
+			t.Fatalf("the bridge relayed its own line: %+v", m)
+		}
+		if m.Content == "<taken-bridge> from someone else" {
+			break
+		}
+	}
+	alice.Say("hi")
+	irc.expect("PRIVMSG #team :<" + alice.Nickname + "> hi")
+}
+
+func TestParseIRCLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want ircLine
+	}{
+		{"PING :irc.test\r\n", ircLine{command: "PING", params: []string{"irc.test"}}},
+		{":bob!b@host PRIVMSG #team :hello there", ircLine{prefix: "bob!b@host", command: "PRIVMSG", params: []string{"#team", "hello there"}}},
+		{":irc.test 001 bridge :Welcome to IRC", ircLine{prefix: "irc.test", command: "001", params: []string{"bridge", "Welcome to IRC"}}},
+		{"join  #team", ircLine{command: "JOIN", params: []string{"#team"}}},
+	}
+	for _, tt := range tests {
+		got := parseIRCLine(tt.line)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("parseIRCLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestIRCTextLines(t *testing.T) {
+	long := strings.Repeat("n", 500)
+	tests := []struct {
+		name     string
+		prefix   string
+		text     string
+		wantText string // the lines put back together, without their prefixes
+	}{
+		{"short", "<alice> ", "hello there", "hello there"},
+		{"long text", "<alice> ", strings.Repeat("word ", 200), strings.Repeat("word ", 200)},
+		{"multibyte text", "<alice> ", strings.Repeat("é世界🙂", 100), strings.Repeat("é世界🙂", 100)},
+		{"lines", "<alice> ", "one\ntwo\r\n\nthree", "onetwothree"},
+		{"long nickname", "<" + shortNick(long) + "> ", strings.Repeat("a", 500), strings.Repeat("a", 500)},
+		{"long multibyte nickname", "* " + shortNick(strings.Repeat("世", 200)) + " ", strings.Repeat("🙂", 200), strings.Repeat("🙂", 200)},
+		// relay never sends these, but they end too
+		{"prefix as long as a line", strings.Repeat("n", ircTextSize), "hi", "hi"},
+		{"prefix longer than a line", long, strings.Repeat("🙂", 10), strings.Repeat("🙂", 10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var text strings.Builder
+			for _, line := range ircTextLines(tt.prefix, tt.text) {
+				if len(tt.prefix) < ircTextSize && len(line) > ircTextSize {
+					t.Errorf("line of %d bytes, want at most %d", len(line), ircTextSize)
+				}
+				if !utf8.ValidString(line) {
+					t.Errorf("line %q cuts a character in two", line)
+				}
+				if !strings.HasPrefix(line, tt.prefix) {
+					t.Fatalf("line %q, want it to start with %q", line, tt.prefix)
+				}
+				text.WriteString(strings.TrimPrefix(line, tt.prefix))
+			}
+			if text.String() != tt.wantText {
+				t.Errorf("lines add up to %q, want %q", text.String(), tt.wantText)
+			}
+		})
+	}
+}
+
+func TestShortNick(t *testing.T) {
+	tests := []struct {
+		nick string
+		want string
+	}{
+		{"alice", "alice"},
+		{strings.Repeat("n", ircNickSize), strings.Repeat("n", ircNickSize)},
+		{strings.Repeat("n", ircNickSize+1), strings.Repeat("n", ircNickSize-len("…")) + "…"},
+		{strings.Repeat("世", ircNickSize), strings.Repeat("世", (ircNickSize-len("…"))/3) + "…"},
+	}
+	for _, tt := range tests {
+		if got := shortNick(tt.nick); got != tt.want {
+			t.Errorf("shortNick(%q) = %q, want %q", tt.nick, got, tt.want)
+		}
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		text string
+		size int
+		want []string
+	}{
+		{"hello", 10, []string{"hello"}},
+		{"hello", 2, []string{"hell", "o"}},
+		{"hello", 0, []string{"hell", "o"}},
+		{"hello", -5, []string{"hell", "o"}},
+		{"ééé", 3, []string{"éé", "é"}},
+		{"🙂🙂", 1, []string{"🙂", "🙂"}},
+		{"\x80\x80\x80\x80\x80", 4, []string{"\x80\x80\x80\x80", "\x80"}},
+	}
+	for _, tt := range tests {
+		got := splitText(tt.text, tt.size)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("splitText(%q, %d) = %q, want %q", tt.text, tt.size, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package bots
+
+import (
+	"fmt"
+	"irc-final-project/chatroom"
+	"strings"
+)
+
+// a sample bot that repeats what it is told
+// `!echo text` in a room says the text back to the room as a notice, and whispers get whispered back
+type Echo struct{}
+
+func (Echo) OnJoin(c *chatroom.Client, room *chatroom.Room) {
+	room.Logf("%s is listening for !echo and !help\n", c.Nickname)
+}
+
+func (Echo) OnMessage(c *chatroom.Client, room *chatroom.Room, message chatroom.Message) {
+	// only messages from people, never its own, and never notices
+	if message.Kind != chatroom.KindChat || message.FromNick == c.Nickname {
+		return
+	}
+	if message.IsDirectMessage {
+		// whispers come with the receiver's nickname in front
+		text := strings.TrimPrefix(message.Content, fmt.Sprintf("(%s) ", c.Nickname))
+		c.Say(fmt.Sprintf("/whisper %s %s", message.FromNick, text))
+		return
+	}
+	command, text, _ := strings.Cut(message.Content, " ")
+	switch command {
+	case "!echo":
+		if text != "" {
+			c.Notice(fmt.Sprintf("%s said: %s", message.FromNick, text))
+		}
+	case "!help":
+		c.Notice("I'm a bot. `!echo text` and I'll say it back, or whisper me and I'll whisper it back.")
+	}
+}
@@ -0,0 +1,66 @@
+package chatroom
+
+import (
+	"fmt"
+	"time"
+)
+
+// says what the calling client is doing, like `/me waves`, which clients show as `* alice waves`
+func me(r *Room, c *Client, args Args) *CommandError {
+	if !r.canSpeak(c) {
+		return &CommandError{
+			CommandName: "me",
+			Reason:      fmt.Sprintf("%s is moderated, only its owner and operators can talk", r.RoomName),
+		}
+	}
+	// they're done typing, same as after a chat message
+	c.lastTyping = time.Time{}
+	r.postMessage(Message{
+		Kind:       KindAction,
+		Uuid:       c.Uuid,
+		FromNick:   c.Nickname,
+		Content:    args.String("action"),
+		SentTime:   time.Now(),
+		ServerName: r.RoomName,
+	})
+	return nil
+}
+
+// sends a notice to the current room or to a user: `/notice target message`
+// notices are like chat messages, but bots must never answer them, so bots can talk without setting each other off
+func notice(r *Room, c *Client, args Args) *CommandError {
+	targetName := args.String("target")
+	message := Message{
+		Kind:       KindNotice,
+		Uuid:       c.Uuid,
+		FromNick:   c.Nickname,
+		Content:    args.String("message"),
+		SentTime:   time.Now(),
+		ServerName: r.RoomName,
+	}
+	if targetName == r.RoomName {
+		if !r.canSpeak(c) {
+			return &CommandError{
+				CommandName: "notice",
+				Reason:      fmt.Sprintf("%s is moderated, only its owner and operators can talk", r.RoomName),
+			}
+		}
+		r.postMessage(message)
+		return nil
+	}
+	target := r.GetClientByNickname(targetName)
+	if target == nil {
+		return &CommandError{
+			CommandName: "notice",
+			Reason:      fmt.Sprintf("%s is neither the current room nor a user who is online", targetName),
+		}
+	}
+	message.Content, message.Rich = ParseRichText(message.Content)
+	message.IsDirectMessage = true
+	if ignoredBy(target, message) {
+		r.Logf("%s ignores %s, dropped notice\n", target.Nickname, c.Nickname)
+		return nil
+	}
+	c.DirectMessageToOtherClient(target, message)
+	return nil
+}
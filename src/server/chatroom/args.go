@@ -0,0 +1,146 @@
+package chatroom
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// what kind of value a command argument is, checked before the command runs
+type ArgType int
+
+const (
+	ArgWord      ArgType = iota // a single word
+	ArgInt                      // a whole number
+	ArgMessageId                // a message id, with or without a leading `#`
+	ArgRoom                     // the name of a room that exists
+	ArgText                     // the rest of the line, spaces and all, only allowed as the last argument
+)
+
+// a positional argument a command takes
+type Arg struct {
+	Name     string
+	Type     ArgType
+	Optional bool // optional arguments can only be followed by other optional arguments
+}
+
+// how the argument is shown in usage strings, eg `[messageId]` or `message...`
+func (a Arg) usage() string {
+	name := a.Name
+	if a.Type == ArgText {
+		name += "..."
+	}
+	if a.Optional {
+		name = "[" + name + "]"
+	}
+	return name
+}
+
+// turns a word into a value of the argument's type
+func (a Arg) parse(word string) (any, error) {
+	switch a.Type {
+	case ArgInt:
+		n, err := strconv.Atoi(word)
+		if err != nil {
+			return nil, fmt.Errorf("`%s` is not a number", word)
+		}
+		return n, nil
+	case ArgMessageId:
+		id, err := strconv.ParseUint(strings.TrimPrefix(word, "#"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("`%s` is not a message id", word)
+		}
+		return id, nil
+	case ArgRoom:
+		room, ok := FindRoom(word)
+		if !ok {
+			return nil, fmt.Errorf("Room `%s` does not exist", word)
+		}
+		return room, nil
+	default:
+		return word, nil
+	}
+}
+
+// an option a command takes, given as `--name value` or `-n value` anywhere before a text argument
+type Flag struct {
+	Name        string
+	Short       string  // a single letter, empty if the option has no short form
+	Type        ArgType // the type of the value
+	Switch      bool    // the option takes no value, it is either given or not, eg `--all`
+	Description string  // what the option does, shown by `/help`
+}
+
+// how the option is shown in usage strings, eg `[--room|-r roomName]`
+func (f Flag) usage() string {
+	name := "--" + f.Name
+	if f.Short != "" {
+		name += "|-" + f.Short
+	}
+	if !f.Switch {
+		name += " " + f.Type.placeholder()
+	}
+	return "[" + name + "]"
+}
+
+// what a value of this type is called in usage strings
+func (t ArgType) placeholder() string {
+	switch t {
+	case ArgInt:
+		return "number"
+	case ArgMessageId:
+		return "messageId"
+	case ArgRoom:
+		return "roomName"
+	default:
+		return "value"
+	}
+}
+
+// the arguments and options a command was called with, checked against the ones it takes
+// getters return the zero value for optional arguments and options that weren't given
+type Args struct {
+	raw    string
+	values map[string]any
+}
+
+// checks if an argument was given
+func (a Args) Has(name string) bool {
+	_, ok := a.values[name]
+	return ok
+}
+
+// checks if a switch option was given
+func (a Args) Bool(name string) bool {
+	b, _ := a.values[name].(bool)
+	return b
+}
+
+// a word or text argument
+func (a Args) String(name string) string {
+	s, _ := a.values[name].(string)
+	return s
+}
+
+// a number argument
+func (a Args) Int(name string) int {
+	n, _ := a.values[name].(int)
+	return n
+}
+
+// a message id argument
+func (a Args) MessageId(name string) uint64 {
+	id, _ := a.values[name].(uint64)
+	return id
+}
+
+// a room argument
+func (a Args) Room(name string) *Room {
+	room, _ := a.values[name].(*Room)
+	return room
+}
+
+// everything after the command name, as it was typed
+func (a Args) Raw() string {
+	return a.raw
+}
@@ -0,0 +1,173 @@
+package chatroom
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"irc-final-project/logging"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// file privileged actions are appended to, one JSON object per line, empty to keep them in memory only
+var AuditFile = "audit.jsonl"
+
+// how many audit entries are kept in memory for `/audit`, the file keeps all of them
+const auditMemory = 10000
+
+// a privileged action, like a kick or someone becoming an operator
+type AuditEntry struct {
+	Time      time.Time `json:"Time"`
+	Action    string    `json:"Action"`              // what was done, like "kick" or "oper"
+	Actor     string    `json:"Actor"`               // the nickname that did it, or "server"
+	ActorUuid string    `json:"ActorUuid,omitempty"` // the uuid of the client that did it, empty for the server
+	Target    string    `json:"Target,omitempty"`    // who or what it was done to
+	Room      string    `json:"Room,omitempty"`      // the room it was done in
+	Details   string    `json:"Details,omitempty"`   // anything else, like the reason for a kick
+}
+
+func (e AuditEntry) String() string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("[%s] %s by %s", e.Time.Format("2006-01-02 15:04:05"), e.Action, e.Actor))
+	if e.Target != "" {
+		builder.WriteString(fmt.Sprintf(": %s", e.Target))
+	}
+	if e.Room != "" {
+		builder.WriteString(fmt.Sprintf(" in %s", e.Room))
+	}
+	if e.Details != "" {
+		builder.WriteString(fmt.Sprintf(" (%s)", e.Details))
+	}
+	return builder.String()
+}
+
+// the audit log, only ever appended to
+type auditLog struct {
+	lock    sync.Mutex
+	entries []AuditEntry // the latest entries, oldest first
+	file    *os.File     // nil if AuditFile is empty or wasn't opened
+}
+
+var audit auditLog
+
+// the log lines of the audit log itself, every entry is also logged here
+var auditLogger = logging.New("audit")
+
+// loads the entries already in AuditFile, and opens it to append new ones
+// a missing file is fine, it is made on the first entry
+func OpenAudit() error {
+	if AuditFile == "" {
+		return nil
+	}
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	existing, err := os.Open(AuditFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		defer existing.Close()
+		scanner := bufio.NewScanner(existing)
+		for line := 1; scanner.Scan(); line++ {
+			var entry AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				return fmt.Errorf("%s:%d: %w", AuditFile, line, err)
+			}
+			audit.keep(entry)
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("%s: %w", AuditFile, err)
+		}
+	}
+	// only the server should read it, it says who the operators are
+	audit.file, err = os.OpenFile(AuditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	return err
+}
+
+// remembers an entry in memory, forgetting the oldest ones, the caller must hold the lock
+func (a *auditLog) keep(entry AuditEntry) {
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > auditMemory {
+		a.entries = append(a.entries[:0:0], a.entries[len(a.entries)-auditMemory:]...)
+	}
+}
+
+// adds an entry to the audit log
+func (a *auditLog) record(entry AuditEntry) {
+	entry.Time = time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.keep(entry)
+	auditLogger.Info(entry.Action, logging.Fields{
+		"actor":  entry.Actor,
+		"uuid":   entry.ActorUuid,
+		"target": entry.Target,
+		"room":   entry.Room,
+		"detail": entry.Details,
+	})
+	if a.file == nil {
+		return
+	}
+	line, _ := json.Marshal(entry)
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		auditLogger.Error("write", logging.Fields{"error": err})
+	}
+}
+
+// the latest entries that match, newest first
+// empty action or actor match any
+func (a *auditLog) latest(count int, action string, actor string) []AuditEntry {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var found []AuditEntry
+	for i := len(a.entries) - 1; i >= 0 && len(found) < count; i-- {
+		entry := a.entries[i]
+		if (action == "" || entry.Action == action) && (actor == "" || entry.Actor == actor) {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+// records a privileged action done by a client in the room, or by the server if c is nil
+func (r *Room) audit(action string, c *Client, target string, details string) {
+	entry := AuditEntry{
+		Action:  action,
+		Actor:   "server",
+		Target:  target,
+		Room:    r.RoomName,
+		Details: details,
+	}
+	if c != nil {
+		entry.Actor = c.Nickname
+		entry.ActorUuid = c.Uuid.String()
+	}
+	audit.record(entry)
+}
+
+// lists the latest privileged actions, newest first: `/audit [count] [--action action] [--actor nickName]`
+func auditCommand(r *Room, c *Client, args Args) *CommandError {
+	count := 20
+	if args.Has("count") {
+		count = args.Int("count")
+		if count < 1 {
+			return &CommandError{
+				CommandName: "audit",
+				Reason:      fmt.Sprintf("`%d` is not a number of entries", count),
+			}
+		}
+	}
+	latest := audit.latest(count, args.String("action"), args.String("actor"))
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("\nAudit log (%d):\n", len(latest)))
+	builder.WriteString("---------\n")
+	for _, entry := range latest {
+		builder.WriteString(entry.String())
+		builder.WriteString("\n")
+	}
+	c.ServerDirectMessage(r.serverMessage(builder.String()))
+	return nil
+}
@@ -0,0 +1,113 @@
+package chatroom
+
+import (
+	"irc-final-project/logging"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// how many messages can wait for a bot before the room starts dropping them
+const botQueueSize = 64
+
+// a program that sits in rooms like a user, without a websocket
+// both methods run on the bot's own goroutine, one call at a time, so they can take their time
+// a bot talks back through its client, with Say or Notice
+// bots must never answer notices, so two bots can't keep answering each other
+type Bot interface {
+	// called when the bot enters a room
+	OnJoin(c *Client, room *Room)
+	// called for everything the bot is sent: room messages, whispers, and the output of its commands
+	OnMessage(c *Client, room *Room, message Message)
+}
+
+// puts a bot in a room under the given nickname
+// the room is started if it isn't running yet
+func AddBot(room *Room, nickname string, bot Bot) *Client {
+	client := &Client{
+		Nickname:   nickname,
+		room:       room,
+		Send:       make(chan Message, botQueueSize),
+		Uuid:       uuid.New(),
+		KickSignal: make(chan *Room, 1),
+		bot:        bot,
+		botJoins:   make(chan *Room, botQueueSize),
+	}
+	// it may be renamed if the nickname is taken
+	users.add(client)
+	go client.runBot()
+	room = room.admit(client)
+	room.Logf("Added bot %s\n", client.Nickname)
+	return client
+}
+
+// checks if a client is a bot rather than a person
+func (c *Client) IsBot() bool {
+	return c.bot != nil
+}
+
+// hands whatever the bot is sent to the bot, until its room closes its channel
+func (c *Client) runBot() {
+	for {
+		select {
+		case room := <-c.botJoins:
+			c.bot.OnJoin(c, room)
+		case message, ok := <-c.Send:
+			if !ok {
+				c.CurrentRoom().Logf("bot %s stopped\n", c.Nickname)
+				return
+			}
+			c.bot.OnMessage(c, c.CurrentRoom(), message)
+		case room := <-c.KickSignal:
+			c.CurrentRoom().Logf("bot %s kicked or exited by %s\n", c.Nickname, room.RoomName)
+			return
+		}
+	}
+}
+
+// tells a bot that it entered a room
+func (c *Client) botJoined(room *Room) {
+	select {
+	case c.botJoins <- room:
+	default:
+		room.Logf("bot %s is too busy to hear that it joined\n", c.Nickname)
+	}
+}
+
+// sends something to the client's current room as if the client typed it, commands included
+// meant for bots, people type into their websocket instead
+func (c *Client) Say(content string) {
+	room := c.CurrentRoom()
+	room.Broadcast <- Message{
+		Kind:       KindChat,
+		Uuid:       c.Uuid,
+		FromNick:   c.Nickname,
+		Content:    content,
+		SentTime:   time.Now(),
+		ServerName: room.RoomName,
+	}
+}
+
+// sends a notice to the client's current room, never run as a command
+// bots should answer with notices, since other bots never answer those
+func (c *Client) Notice(content string) {
+	room := c.CurrentRoom()
+	room.Broadcast <- Message{
+		Kind:       KindNotice,
+		Uuid:       c.Uuid,
+		FromNick:   c.Nickname,
+		Content:    content,
+		SentTime:   time.Now(),
+		ServerName: room.RoomName,
+	}
+}
+
+// queues a message for a bot, since it has no connection to write to
+// the message is dropped if the bot is too far behind
+func (c *Client) sendToBot(message Message) {
+	select {
+	case c.Send <- message:
+	default:
+		c.CurrentRoom().logEvent(logging.LevelWarn, "bot-behind", c, nil)
+	}
+}
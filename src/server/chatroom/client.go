@@ -1,217 +1,472 @@
-package chatroom
-
-import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"log"
-	"net/http"
-	"strings"
-	"time"
-
-	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
-)
-
-// https://github.com/gorilla/websocket/blob/af47554f343b4675b30172ac301638d350db34a5/examples/chat/client.go#L16-L38
-const (
-	// Time allowed to write a message to the peer.
-	writeWait = time.Second * 1
-
-	// Time allowed to read the next pong message from the peer.
-	pongWait = time.Second * 1
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 1024
-)
-
-var (
-	newline = []byte{'\n'}
-	space   = []byte{' '}
-)
-
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
-// middleman between websocket and chatroom
-type Client struct {
-	Uuid        uuid.UUID
-	Nickname    string
-	CurrentRoom *Room           // the room this client is in
-	Connection  *websocket.Conn // connection to the CLIENT
-	Send        chan Message    // channel of outbound messages
-	KickSignal  chan *Room      // used for when a room kicks/force-exists the client
-}
-
-// reads incoming messages from the webclient for relaying to the server
-func (c *Client) readSocket() {
-	// unregister and disconnect when done reading
-	defer func() {
-		log.Println(c.Nickname, "closing readSocket")
-		c.CurrentRoom.Unregister <- c
-		c.CurrentRoom = nil
-		c.Connection.Close()
-	}()
-
-	// setting things for conn...
-	c.Connection.SetReadLimit(maxMessageSize)
-	c.Connection.SetReadDeadline(time.Now().Add(pongWait))
-	c.Connection.SetPongHandler(func(string) error { c.Connection.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-
-	// main message-reading loop
-	for {
-		_, message, err := c.Connection.ReadMessage()
-
-		// failed to get a message
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
-			}
-			break
-		}
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.CurrentRoom.Logf("client got message `%s` from %s\n", string(message), c.Nickname)
-		sent := Message{
-			Uuid:       c.Uuid,
-			FromNick:   c.Nickname,
-			Content:    string(message),
-			SentTime:   time.Now(),
-			ServerName: c.CurrentRoom.RoomName,
-		}
-		c.CurrentRoom.Broadcast <- sent // send the message to the room
-	}
-}
-
-// moves messages from the current room to the websocket connection to the webclient
-func (c *Client) writeSocket() {
-	ticker := time.NewTicker(pingPeriod) // tick every so often
-	defer func() {
-		log.Println(c.Nickname, "closing writeSocket")
-		ticker.Stop()
-		c.Connection.WriteControl(websocket.CloseNormalClosure, []byte{}, time.Now().Add(writeWait))
-		c.Connection.Close()
-	}()
-
-	for {
-		select {
-		case message, ok := <-c.Send:
-			c.Connection.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// room closed the channel
-				log.Println(c.Nickname, "room closed channel")
-				c.Connection.WriteMessage(websocket.CloseMessage, []byte{})
-			}
-			w, err := c.Connection.NextWriter(websocket.TextMessage)
-			if err != nil {
-				// cannot write to the connection
-				log.Println(c.Nickname, "cannot write to connection")
-				return
-			}
-			// send the content of the message to the client
-			// w.Write(message.Content)
-			json.NewEncoder(w).Encode(message)
-
-			// add queued messages to current websocket message
-			n := len(c.Send)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				// w.Write((<-c.Send).Content)
-				json.NewEncoder(w).Encode(<-c.Send)
-			}
-
-			if err := w.Close(); err != nil {
-				// cannot close the writer to the outbound queue
-				log.Println(c.Nickname, "cannot close outbound writer")
-				return
-			}
-		case <-ticker.C:
-			// when on tick
-			c.Connection.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.Connection.WriteMessage(websocket.PingMessage, nil); err != nil {
-				// ping to the server failed
-				log.Println(c.Nickname, "failed to ping")
-				return
-			}
-		case room := <-c.KickSignal:
-			// room wants to kick us out
-			log.Println(c.Nickname, "kicked or exited by", room.RoomName)
-			return
-		}
-	}
-}
-
-// sends a dm from the server to the web client
-func (c Client) ServerDirectMessage(message Message) {
-	w, err := c.Connection.NextWriter(websocket.TextMessage)
-	if err != nil {
-		// cannot write to the connection
-		return
-	}
-	message.IsDirectMessage = true
-	message.Content = "(DM) " + message.Content
-	// send the content of the message to the client
-	// w.Write(message.Content)
-	json.NewEncoder(w).Encode(message)
-	if err := w.Close(); err != nil {
-		// cannot close the writer to the outbound queue
-		return
-	}
-}
-
-// sends a dm from this client to some other client
-func (c Client) DirectMessageToOtherClient(other Client, message Message) {
-	w, err := other.Connection.NextWriter(websocket.TextMessage)
-	if err != nil {
-		// cannot write to the connection
-		return
-	}
-	message.Content = fmt.Sprintf("(%s) ", other.Nickname) + message.Content
-	message.IsDirectMessage = true
-	// send the content of the message to the client
-	// w.Write(message.Content)
-	json.NewEncoder(w).Encode(message)
-	if err := w.Close(); err != nil {
-		// cannot close the writer to the outbound queue
-		return
-	}
-}
-
-// handle websocket requests from peers
-func ServeWebSocket(room *Room, w http.ResponseWriter, r *http.Request) {
-	// convert http to websocket
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		// failed to convert
-		log.Println(err)
-		return
-	}
-	nickname := r.URL.Query().Get("nickname")
-	nickname = strings.ReplaceAll(nickname, " ", "_")
-	room.Logf("Got client with nickname `%s`", nickname)
-
-	if room.NicknameAlreadyExists(nickname) {
-		room.Logf("Nickname %v already exists, changing nickname...\n", nickname)
-		nickname = fmt.Sprintf("%s_%d", nickname, time.Now().Unix()%int64(len(room.Clients)))
-		room.Logf("Nickname is now %s\n", nickname)
-	}
-
-	client := &Client{
-		Nickname:    string(nickname),
-		CurrentRoom: room,
-		Connection:  conn,
-		Send:        make(chan Message),
-		Uuid:        uuid.New(),
-		KickSignal:  make(chan *Room),
-	}
-	// enter the room
-	client.CurrentRoom.Register <- client
-
-	// async getting and writing of messages
-	go client.readSocket()
-	go client.writeSocket()
-}
+package chatroom
+
+import (
+	"bytes"
+	"fmt"
+	"irc-final-project/logging"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// https://github.com/gorilla/websocket/blob/af47554f343b4675b30172ac301638d350db34a5/examples/chat/client.go#L16-L38
+// these can be changed before the server starts, see the config package
+var (
+	// Time allowed to write a message to the peer.
+	WriteWait = time.Second * 1
+
+	// Time allowed to read the next pong message from the peer.
+	PongWait = time.Second * 1
+
+	// Maximum message size allowed from peer.
+	MaxMessageSize int64 = 1024
+
+	// Sizes of the websocket buffers.
+	ReadBufferSize  = 1024
+	WriteBufferSize = 1024
+)
+
+// Send pings to peer with this period. Must be less than PongWait.
+func pingPeriod() time.Duration {
+	return (PongWait * 9) / 10
+}
+
+var (
+	newline = []byte{'\n'}
+	space   = []byte{' '}
+)
+
+// middleman between websocket and chatroom
+type Client struct {
+	Uuid       uuid.UUID
+	Nickname   string
+	Connection *websocket.Conn // connection to the CLIENT
+	protocol   *protocol       // how messages are written to Connection, see the Protocol constants
+	Send       chan Message    // channel of outbound messages
+	KickSignal chan *Room      // used for when a room kicks/force-exists the client
+	lastTyping time.Time       // when the room last told others this client is typing
+	sawMotd    bool            // whether the client was shown the message of the day
+	// the room this client is in, other rooms and http handlers look at it too, see CurrentRoom
+	room     *Room
+	roomLock sync.RWMutex
+	// only one goroutine can write to a websocket connection at a time
+	writeLock sync.Mutex
+	// secret token for http requests on behalf of this client, eg uploads
+	SessionToken string
+	Permission   Permission // what the client is allowed to do
+	// the name the client became an operator as with /oper, empty if it didn't
+	operName string
+	// the IP address the client first connected from, for bans, never changed
+	address string
+	// secret token to reconnect as this client, see ResumeGrace
+	resumeToken string
+	// the id of the last room message written to the connection, changed atomically
+	// a client that resumes is sent the messages after it
+	lastDelivered uint64
+	// whether the client lost its connection and may resume, only used by its room's goroutine
+	detached bool
+	// the direct messages sent while it had no connection, written when it resumes, guarded by writeLock
+	// nil while it has a connection
+	missed []Message
+	// how many messages were dropped in a row because its send queue was full, only used by its room's goroutine
+	dropped int
+	// the bot behind this client, nil for people connected through a websocket
+	bot      Bot
+	botJoins chan *Room // rooms the bot entered, for OnJoin
+}
+
+// the room the client is in, nil once it left the server
+func (c *Client) CurrentRoom() *Room {
+	c.roomLock.RLock()
+	defer c.roomLock.RUnlock()
+	return c.room
+}
+
+func (c *Client) setCurrentRoom(r *Room) {
+	c.roomLock.Lock()
+	defer c.roomLock.Unlock()
+	c.room = r
+}
+
+// reads incoming messages from the webclient for relaying to the server
+func (c *Client) readSocket() {
+	// a client that resumes gets a new connection, this reader only ever uses the one it started with
+	conn := c.Connection
+	// whether the client closed the connection on purpose, rather than losing it
+	closedOnPurpose := false
+	// unregister and disconnect when done reading
+	// a client that lost its connection is kept for a while instead, so it can resume
+	defer func() {
+		c.logEvent(logging.LevelDebug, "read-closed", logging.Fields{"on-purpose": closedOnPurpose})
+		sessions.remove(c)
+		if closedOnPurpose || ResumeGrace <= 0 {
+			c.CurrentRoom().Unregister <- c
+			c.setCurrentRoom(nil)
+		} else {
+			c.CurrentRoom().Detach <- c
+		}
+		conn.Close()
+	}()
+
+	// setting things for conn...
+	conn.SetReadLimit(MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(PongWait))
+	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(PongWait)); return nil })
+
+	// main message-reading loop
+	for {
+		_, message, err := conn.ReadMessage()
+
+		// failed to get a message
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				c.logEvent(logging.LevelWarn, "read-error", logging.Fields{"error": err})
+			}
+			closedOnPurpose = websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+			break
+		}
+		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+		room := c.CurrentRoom()
+		room.Logf("client got message `%s` from %s\n", room.loggable(string(message)), c.Nickname)
+		sent := Message{
+			Kind:       KindChat,
+			Uuid:       c.Uuid,
+			FromNick:   c.Nickname,
+			Content:    string(message),
+			SentTime:   time.Now(),
+			ServerName: room.RoomName,
+		}
+		room.Broadcast <- sent // send the message to the room
+	}
+}
+
+// moves messages from the current room to the websocket connection to the webclient
+func (c *Client) writeSocket() {
+	// a client that resumes gets a new connection and channel, this writer only ever uses the ones it started with
+	conn := c.Connection
+	proto := c.protocol
+	send := c.Send
+	ticker := time.NewTicker(pingPeriod()) // tick every so often
+	defer func() {
+		c.logEvent(logging.LevelDebug, "write-closed", nil)
+		ticker.Stop()
+		c.writeLock.Lock()
+		conn.WriteControl(websocket.CloseNormalClosure, []byte{}, time.Now().Add(WriteWait))
+		c.writeLock.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-send:
+			if !ok {
+				// room closed the channel
+				c.logEvent(logging.LevelDebug, "send-closed", nil)
+				c.writeLock.Lock()
+				conn.SetWriteDeadline(time.Now().Add(WriteWait))
+				conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.writeLock.Unlock()
+				return
+			}
+			if err := c.writeQueued(conn, proto, send, message); err != nil {
+				// cannot write to the connection
+				c.logEvent(logging.LevelWarn, "write-error", logging.Fields{"error": err})
+				return
+			}
+		case <-ticker.C:
+			// when on tick
+			c.writeLock.Lock()
+			conn.SetWriteDeadline(time.Now().Add(WriteWait))
+			err := conn.WriteMessage(websocket.PingMessage, nil)
+			c.writeLock.Unlock()
+			if err != nil {
+				// ping to the server failed
+				c.logEvent(logging.LevelWarn, "ping-error", logging.Fields{"error": err})
+				return
+			}
+		case room := <-c.KickSignal:
+			// room wants to kick us out
+			c.logEvent(logging.LevelDebug, "kicked", logging.Fields{"room": room.RoomName})
+			return
+		}
+	}
+}
+
+// writes a message and whatever else is queued behind it as one websocket message
+func (c *Client) writeQueued(conn *websocket.Conn, proto *protocol, send chan Message, message Message) error {
+	batch := []Envelope{messageEnvelope(message)}
+	lastId := message.Id
+
+	// add queued messages to current websocket message
+	// the room may take the oldest ones back if the queue fills up, so never wait for them
+	n := len(send)
+queued:
+	for i := 0; i < n; i++ {
+		select {
+		case queued, ok := <-send:
+			if !ok {
+				break queued
+			}
+			batch = append(batch, messageEnvelope(queued))
+			if queued.Id > lastId {
+				lastId = queued.Id
+			}
+		default:
+			break queued
+		}
+	}
+
+	c.writeLock.Lock()
+	err := writeFrame(conn, proto, batch)
+	c.writeLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if lastId > atomic.LoadUint64(&c.lastDelivered) {
+		atomic.StoreUint64(&c.lastDelivered, lastId)
+	}
+	return nil
+}
+
+// writes envelopes to a connection as one frame, in the protocol agreed on with the client
+// the caller holds the client's writeLock
+func writeFrame(conn *websocket.Conn, proto *protocol, batch []Envelope) error {
+	conn.SetWriteDeadline(time.Now().Add(WriteWait))
+	w, err := conn.NextWriter(proto.frameType)
+	if err != nil {
+		return err
+	}
+	if err := proto.writeFrame(w, batch); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// the log lines of connections to clients
+var clientLog = logging.New("client")
+
+// logs something that happened to a client's connection
+func (c *Client) logEvent(level logging.Level, event string, fields logging.Fields) {
+	if fields == nil {
+		fields = logging.Fields{}
+	}
+	fields["uuid"] = c.Uuid.String()
+	fields["nick"] = c.Nickname
+	clientLog.Log(level, event, fields)
+}
+
+// sends a dm from the server to the web client
+func (c *Client) ServerDirectMessage(message Message) {
+	message = serverDirectMessage(message)
+	if c.IsBot() {
+		c.sendToBot(message)
+		return
+	}
+	c.write(message)
+}
+
+// a message from the server, made into a dm
+func serverDirectMessage(message Message) Message {
+	message.IsDirectMessage = true
+	message.Content = "(DM) " + message.Content
+	return message
+}
+
+// writes a message straight to the client's connection, without going through its room
+// a client that lost its connection gets it when it resumes
+func (c *Client) write(message Message) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.missed != nil {
+		c.missed = append(c.missed, message)
+		if len(c.missed) > SendQueueSize {
+			// only the newest ones are kept, like in a full send queue
+			c.missed = c.missed[1:]
+		}
+		return
+	}
+	// a client that can't be written to finds out when its writer tries next
+	writeFrame(c.Connection, c.protocol, []Envelope{messageEnvelope(message)})
+}
+
+// keeps the direct messages sent to a client that lost its connection, for when it resumes
+func (c *Client) holdMessages() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.missed = []Message{}
+}
+
+// writes the direct messages a client missed to its new connection, after some others
+// messages sent to it after that are written straight away again
+func (c *Client) releaseMessages(first ...Message) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	batch := make([]Envelope, 0, len(first)+len(c.missed))
+	for _, message := range append(first, c.missed...) {
+		batch = append(batch, messageEnvelope(message))
+	}
+	c.missed = nil
+	writeFrame(c.Connection, c.protocol, batch)
+}
+
+// tells the client it was moved to another room, so it can show the room's name
+func (c *Client) writeSwitch(roomName string) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return writeFrame(c.Connection, c.protocol, []Envelope{{Type: EnvelopeSwitch, Room: roomName}})
+}
+
+// sends a dm from this client to some other client
+func (c *Client) DirectMessageToOtherClient(other *Client, message Message) {
+	prefix := fmt.Sprintf("(%s) ", other.Nickname)
+	message.Content = prefix + message.Content
+	if message.Rich != nil {
+		message.Rich = append([]Span{{Text: prefix}}, message.Rich...)
+	}
+	message.IsDirectMessage = true
+	if other.IsBot() {
+		other.sendToBot(message)
+		return
+	}
+	other.write(message)
+}
+
+// converts http to websocket, with the newest protocol the client asked for
+func upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  ReadBufferSize,
+		WriteBufferSize: WriteBufferSize,
+		Subprotocols:    protocolNames(),
+	}
+	return upgrader.Upgrade(w, r, nil)
+}
+
+// the IP address a request came from, without the port
+func remoteAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// handle websocket requests from peers
+// a client that lost its connection can come back as itself with `?resume=token`, whatever room it asks for
+// the room is put on the room list under names only once the client gets in, see findOrNewRoom
+func ServeWebSocket(room *Room, names []string, w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get("resume"); token != "" {
+		resumeWebSocket(token, w, r)
+		return
+	}
+	nickname := r.URL.Query().Get("nickname")
+	nickname = strings.ReplaceAll(nickname, " ", "_")
+	// banned nicknames and addresses are turned away before they get a websocket
+	address := remoteAddress(r)
+	if ban, ok := bans.find(nickname, address); ok {
+		clientLog.Info("banned", logging.Fields{"nick": nickname, "remote": r.RemoteAddr})
+		http.Error(w, withReason(bannedText(ban, nickname), ban.Reason), http.StatusForbidden)
+		return
+	}
+	// so are people who aren't members of a private room, like someone else's direct messages
+	if !room.IsMember(nickname) {
+		clientLog.Info("not-a-member", logging.Fields{"nick": nickname, "room": room.RoomName, "remote": r.RemoteAddr})
+		http.Error(w, fmt.Sprintf("Room `%s` is private", room.RoomName), http.StatusForbidden)
+		return
+	}
+	conn, err := upgrade(w, r)
+	if err != nil {
+		// failed to convert
+		clientLog.Warn("upgrade", logging.Fields{"error": err, "remote": r.RemoteAddr})
+		return
+	}
+	room.Logf("Got client with nickname `%s`", nickname)
+
+	client := &Client{
+		Nickname:   string(nickname),
+		room:       room,
+		Connection: conn,
+		protocol:   findProtocol(conn.Subprotocol()),
+		Send:       make(chan Message, SendQueueSize),
+		Uuid:       uuid.New(),
+		KickSignal: make(chan *Room, 1),
+		address:    address,
+	}
+	// someone else may have the nickname, on any room
+	users.add(client)
+	if client.Nickname != nickname {
+		room.Logf("Nickname %v already exists, nickname is now %s\n", nickname, client.Nickname)
+		// the new nickname isn't a member of the private room the old one is
+		if !room.IsMember(client.Nickname) {
+			users.remove(client)
+			refuseConnection(conn, fmt.Sprintf("%s is already connected to the private room `%s`", nickname, room.RoomName))
+			return
+		}
+	}
+	// someone may have listed another room by this name since, which is the one to enter
+	if listed := publishRoom(room, names...); listed != room {
+		if !listed.IsMember(client.Nickname) {
+			users.remove(client)
+			refuseConnection(conn, fmt.Sprintf("Room `%s` is private", listed.RoomName))
+			return
+		}
+		room = listed
+		client.setCurrentRoom(room)
+	}
+	sessions.add(client)
+	resumes.add(client)
+	client.ServerDirectMessage(room.sessionMessage(client))
+	// enter the room
+	room.admit(client)
+
+	// async getting and writing of messages
+	go client.readSocket()
+	go client.writeSocket()
+}
+
+// closes a websocket the server won't serve, telling the other end why
+func refuseConnection(conn *websocket.Conn, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(WriteWait))
+	conn.Close()
+}
+
+// gives a client that lost its connection a new one
+// it keeps its uuid, nickname and room, and is sent what it missed
+func resumeWebSocket(token string, w http.ResponseWriter, r *http.Request) {
+	client, ok := resumes.take(token)
+	if !ok {
+		http.Error(w, "Cannot resume: the session ended, or is still connected", http.StatusGone)
+		return
+	}
+	// it may come back from an address that was banned while it was gone
+	address := remoteAddress(r)
+	if ban, ok := bans.find("", address); ok {
+		clientLog.Info("banned", logging.Fields{"nick": client.Nickname, "remote": r.RemoteAddr})
+		http.Error(w, withReason(bannedText(ban, client.Nickname), ban.Reason), http.StatusForbidden)
+		client.CurrentRoom().Unregister <- client
+		return
+	}
+	conn, err := upgrade(w, r)
+	if err != nil {
+		clientLog.Warn("upgrade", logging.Fields{"error": err, "remote": r.RemoteAddr})
+		// it was taken out of waiting, so it has to leave now
+		client.CurrentRoom().Unregister <- client
+		return
+	}
+	// it may speak another protocol this time
+	// nothing is written to it until its room takes it back, see reattach
+	client.writeLock.Lock()
+	client.Connection = conn
+	client.protocol = findProtocol(conn.Subprotocol())
+	client.writeLock.Unlock()
+	sessions.add(client)
+	client.CurrentRoom().admit(client)
+
+	go client.readSocket()
+}
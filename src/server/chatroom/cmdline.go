@@ -0,0 +1,292 @@
+package chatroom
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// one word of a command line, after quotes and escapes are taken out
+type token struct {
+	text   string
+	quoted bool // some of it was quoted or escaped, so it is never an option
+}
+
+var errUnterminatedQuote = errors.New("a quote is never closed")
+
+// reads a command line a word at a time, like a shell does
+// words are separated by spaces, `"double quotes"` and `'single quotes'` keep spaces in a word,
+// and a backslash takes the next character as-is, except inside single quotes
+type tokenizer struct {
+	s   string
+	pos int // where to look for the next word, in bytes
+}
+
+// the rest of the line after the words read so far, as it was typed
+func (tk *tokenizer) rest() string {
+	return strings.TrimSpace(tk.s[tk.pos:])
+}
+
+// reads the next word, returns false if there are no more
+func (tk *tokenizer) next() (token, bool, error) {
+	var current strings.Builder
+	inWord, quoted := false, false
+	var quote rune // the quote we are inside of, 0 if none
+	escaped := false
+	for i, r := range tk.s[tk.pos:] {
+		i += tk.pos
+		if !inWord {
+			if unicode.IsSpace(r) {
+				continue
+			}
+			inWord = true
+		}
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, quoted = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, quoted = r, true
+		case unicode.IsSpace(r):
+			tk.pos = i
+			return token{text: current.String(), quoted: quoted}, true, nil
+		default:
+			current.WriteRune(r)
+		}
+	}
+	tk.pos = len(tk.s)
+	if quote != 0 {
+		return token{}, false, errUnterminatedQuote
+	}
+	if !inWord {
+		return token{}, false, nil
+	}
+	if escaped {
+		// a backslash at the very end stays a backslash
+		current.WriteRune('\\')
+	}
+	return token{text: current.String(), quoted: quoted}, true, nil
+}
+
+// splits a command line into words, see tokenizer
+func splitCommandLine(s string) ([]token, error) {
+	tk := tokenizer{s: s}
+	var tokens []token
+	for {
+		t, ok, err := tk.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return tokens, nil
+		}
+		tokens = append(tokens, t)
+	}
+}
+
+// a text argument: the rest of the line as it was typed, or the inside of the quotes if it is a single quoted word
+// quotes are only looked at in that case, so apostrophes like in `don't` are just text
+func textArg(rest string) string {
+	if tokens, err := splitCommandLine(rest); err == nil && len(tokens) == 1 && tokens[0].quoted {
+		return tokens[0].text
+	}
+	return rest
+}
+
+// splits the first word off of a string
+func nextWord(s string) (string, string) {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	end := strings.IndexFunc(s, unicode.IsSpace)
+	if end < 0 {
+		return s, ""
+	}
+	return s[:end], s[end:]
+}
+
+// checks if a word is an option like `--all` or `-a`, rather than a negative number or a lone dash
+func isOption(word string) bool {
+	return len(word) >= 2 && word[0] == '-' && !unicode.IsDigit(rune(word[1]))
+}
+
+// checks that a command's arguments and options make sense, when registering it
+func checkArgs(args []Arg, flags []Flag) error {
+	seen := make(map[string]bool)
+	optional := false
+	for i, arg := range args {
+		switch {
+		case arg.Name == "" || strings.IndexFunc(arg.Name, unicode.IsSpace) >= 0:
+			return fmt.Errorf("argument %d has no name, or spaces in its name", i+1)
+		case seen[arg.Name]:
+			return fmt.Errorf("argument `%s` is declared twice", arg.Name)
+		case arg.Type == ArgText && i != len(args)-1:
+			return fmt.Errorf("text argument `%s` has to be the last one", arg.Name)
+		case optional && !arg.Optional:
+			return fmt.Errorf("required argument `%s` comes after an optional one", arg.Name)
+		}
+		seen[arg.Name] = true
+		optional = arg.Optional
+	}
+	shorts := make(map[string]bool)
+	for _, flag := range flags {
+		switch {
+		case flag.Name == "" || strings.HasPrefix(flag.Name, "-") || strings.IndexFunc(flag.Name, unicode.IsSpace) >= 0 || strings.Contains(flag.Name, "="):
+			return fmt.Errorf("option `%s` has a bad name", flag.Name)
+		case seen[flag.Name]:
+			return fmt.Errorf("option `%s` has the same name as another argument or option", flag.Name)
+		case flag.Short != "" && (len(flag.Short) != 1 || !isOption("-"+flag.Short) || flag.Short == "-"):
+			return fmt.Errorf("option `%s` has a short form that isn't a single letter", flag.Name)
+		case flag.Short != "" && shorts[flag.Short]:
+			return fmt.Errorf("option `%s` has the same short form as another option", flag.Name)
+		}
+		seen[flag.Name] = true
+		shorts[flag.Short] = true
+	}
+	return nil
+}
+
+// finds an option by its long or short name
+func (cmd Command) findFlag(name string, short bool) (Flag, bool) {
+	for _, flag := range cmd.Flags {
+		if (short && flag.Short == name) || (!short && flag.Name == name) {
+			return flag, true
+		}
+	}
+	return Flag{}, false
+}
+
+// sets an option, reading its value from the next word if it needs one
+func (cmd Command) setFlag(args *Args, flag Flag, given string, value *string, tk *tokenizer) *CommandError {
+	if flag.Switch {
+		if value != nil {
+			return cmd.usageError(fmt.Sprintf("Option `%s` doesn't take a value", given))
+		}
+		args.values[flag.Name] = true
+		return nil
+	}
+	if value == nil {
+		t, ok, err := tk.next()
+		if err != nil {
+			return cmd.usageError(err.Error())
+		}
+		if !ok {
+			return cmd.usageError(fmt.Sprintf("Option `%s` needs a value", given))
+		}
+		value = &t.text
+	}
+	parsed, err := Arg{Name: flag.Name, Type: flag.Type}.parse(*value)
+	if err != nil {
+		return cmd.usageError(fmt.Sprintf("Option `%s`: %v", given, err))
+	}
+	args.values[flag.Name] = parsed
+	return nil
+}
+
+// reads one option, which can be `--name`, `--name=value`, `-n`, or several switches at once like `-abc`
+// an option that needs a value reads it from the next word
+func (cmd Command) parseOption(args *Args, word string, tk *tokenizer) *CommandError {
+	if strings.HasPrefix(word, "--") {
+		name, value, hasValue := strings.Cut(word[2:], "=")
+		flag, ok := cmd.findFlag(name, false)
+		if !ok {
+			return cmd.usageError(fmt.Sprintf("Unknown option `--%s`", name))
+		}
+		if hasValue {
+			return cmd.setFlag(args, flag, "--"+name, &value, tk)
+		}
+		return cmd.setFlag(args, flag, "--"+name, nil, tk)
+	}
+	letters := word[1:]
+	if len(letters) == 1 {
+		flag, ok := cmd.findFlag(letters, true)
+		if !ok {
+			return cmd.usageError(fmt.Sprintf("Unknown option `%s`", word))
+		}
+		return cmd.setFlag(args, flag, word, nil, tk)
+	}
+	for _, letter := range letters {
+		flag, ok := cmd.findFlag(string(letter), true)
+		if !ok {
+			return cmd.usageError(fmt.Sprintf("Unknown option `-%c`", letter))
+		}
+		if !flag.Switch {
+			return cmd.usageError(fmt.Sprintf("Option `-%c` needs a value, so it has to be on its own", letter))
+		}
+		args.values[flag.Name] = true
+	}
+	return nil
+}
+
+// checks what a command was called with against the arguments and options it takes
+// words are split like a shell does, see tokenizer
+// options are only looked for in commands that take some, and only before a text argument starts
+// a text argument is the rest of the line as it was typed, its words aren't split, see textArg
+func (cmd Command) parseArgs(s string) (Args, *CommandError) {
+	args := Args{raw: s, values: make(map[string]any)}
+	tk := tokenizer{s: s}
+	next := 0 // the next positional argument
+	optionsDone := len(cmd.Flags) == 0
+	for {
+		if next < len(cmd.Args) && cmd.Args[next].Type == ArgText {
+			// unless it's an option, the rest of the line is the text
+			rest := tk.rest()
+			word, _ := nextWord(rest)
+			if rest == "" {
+				break
+			}
+			if optionsDone || !(word == "--" || isOption(word)) {
+				args.values[cmd.Args[next].Name] = textArg(rest)
+				next++
+				break
+			}
+		}
+		t, ok, err := tk.next()
+		if err != nil {
+			return args, cmd.usageError(err.Error())
+		}
+		if !ok {
+			break
+		}
+		if !optionsDone && !t.quoted && t.text == "--" {
+			// everything after `--` is an argument, even if it starts with a dash
+			optionsDone = true
+			continue
+		}
+		if !optionsDone && !t.quoted && isOption(t.text) {
+			if cerr := cmd.parseOption(&args, t.text, &tk); cerr != nil {
+				return args, cerr
+			}
+			continue
+		}
+		if next >= len(cmd.Args) {
+			return args, cmd.usageError(fmt.Sprintf("Too many arguments, `%s` was not expected", t.text))
+		}
+		arg := cmd.Args[next]
+		next++
+		value, err := arg.parse(t.text)
+		if err != nil {
+			return args, cmd.usageError(err.Error())
+		}
+		args.values[arg.Name] = value
+	}
+	for _, arg := range cmd.Args[next:] {
+		if !arg.Optional {
+			return args, cmd.usageError(fmt.Sprintf("Missing argument `%s`", arg.Name))
+		}
+	}
+	return args, nil
+}
@@ -0,0 +1,268 @@
+package chatroom
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+		err   error
+	}{
+		{"empty", "", nil, nil},
+		{"only spaces", "   \t ", nil, nil},
+		{"one word", "general", []string{"general"}, nil},
+		{"extra spaces", "  a   b  ", []string{"a", "b"}, nil},
+		{"trailing whitespace", "a b \t\n", []string{"a", "b"}, nil},
+		{"tabs", "a\tb", []string{"a", "b"}, nil},
+		{"double quotes", `"my room" b`, []string{"my room", "b"}, nil},
+		{"single quotes", `'my room' b`, []string{"my room", "b"}, nil},
+		{"empty quotes", `a "" b`, []string{"a", "", "b"}, nil},
+		{"quotes inside a word", `a"b c"d`, []string{"ab cd"}, nil},
+		{"other quote inside quotes", `"it's" 'say "hi"'`, []string{"it's", `say "hi"`}, nil},
+		{"escaped quote", `"say \"hi\""`, []string{`say "hi"`}, nil},
+		{"escaped space", `my\ room`, []string{"my room"}, nil},
+		{"escaped backslash", `a\\b`, []string{`a\b`}, nil},
+		{"backslash in single quotes", `'a\b'`, []string{`a\b`}, nil},
+		{"trailing backslash", `a\`, []string{`a\`}, nil},
+		{"unicode", "héllo 👍", []string{"héllo", "👍"}, nil},
+		{"unterminated double quote", `"my room`, nil, errUnterminatedQuote},
+		{"unterminated single quote", `a 'b`, nil, errUnterminatedQuote},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := splitCommandLine(tt.input)
+			if err != tt.err {
+				t.Fatalf("splitCommandLine(%q) error = %v, want %v", tt.input, err, tt.err)
+			}
+			var got []string
+			for _, token := range tokens {
+				got = append(got, token.text)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitCommandLine(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		wantName string
+		wantArgs string
+	}{
+		{"bare slash", "/", "", ""},
+		{"slash and spaces", "/   ", "", ""},
+		{"space after slash", "/ help", "", "help"},
+		{"no arguments", "/listrooms", "listrooms", ""},
+		{"trailing whitespace", "/listrooms  \t", "listrooms", ""},
+		{"arguments", "/whisper bob hi there", "whisper", "bob hi there"},
+		{"spaces around arguments", "/help   whisper  ", "help", "whisper"},
+		{"tab after name", "/join\tgeneral", "join", "general"},
+		{"quoted arguments", `/join "my room"`, "join", `"my room"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Message{Content: tt.content}.ToCommand()
+			if got.Name != tt.wantName || got.Args != tt.wantArgs {
+				t.Errorf("ToCommand(%q) = (%q, %q), want (%q, %q)", tt.content, got.Name, got.Args, tt.wantName, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	room := NewRoom("my room")
+	cmd := Command{
+		Name: "test",
+		Flags: []Flag{
+			{Name: "room", Short: "r", Type: ArgRoom},
+			{Name: "count", Short: "n", Type: ArgInt},
+			{Name: "all", Short: "a", Switch: true},
+			{Name: "verbose", Short: "v", Switch: true},
+		},
+		Args: []Arg{
+			{Name: "id", Type: ArgMessageId},
+			{Name: "word", Type: ArgWord, Optional: true},
+			{Name: "text", Type: ArgText, Optional: true},
+		},
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]any
+		err   string // part of the error, empty if there should be none
+	}{
+		{"required only", "5", map[string]any{"id": uint64(5)}, ""},
+		{"hash id", "#5", map[string]any{"id": uint64(5)}, ""},
+		{"trailing whitespace", "5 \t ", map[string]any{"id": uint64(5)}, ""},
+		{"optional word", "5 hi", map[string]any{"id": uint64(5), "word": "hi"}, ""},
+		{"quoted word", `5 "hi there"`, map[string]any{"id": uint64(5), "word": "hi there"}, ""},
+		{"text keeps spacing", "5 hi  there   you ", map[string]any{"id": uint64(5), "word": "hi", "text": "there   you"}, ""},
+		{"text keeps quotes inside", `5 hi say "x" now`, map[string]any{"id": uint64(5), "word": "hi", "text": `say "x" now`}, ""},
+		{"quoted text is unquoted", `5 hi "there  you"`, map[string]any{"id": uint64(5), "word": "hi", "text": "there  you"}, ""},
+		{"options before text", "5 hi -v there", map[string]any{"id": uint64(5), "word": "hi", "verbose": true, "text": "there"}, ""},
+		{"dashes in text", "5 hi there -v --all", map[string]any{"id": uint64(5), "word": "hi", "text": "there -v --all"}, ""},
+		{"long option", "--count 3 5", map[string]any{"id": uint64(5), "count": 3}, ""},
+		{"long option with equals", "5 --count=3", map[string]any{"id": uint64(5), "count": 3}, ""},
+		{"short option", "-n 3 5", map[string]any{"id": uint64(5), "count": 3}, ""},
+		{"quoted room option", `-r "my room" 5`, map[string]any{"id": uint64(5), "room": room}, ""},
+		{"switch", "--all 5", map[string]any{"id": uint64(5), "all": true}, ""},
+		{"combined switches", "-av 5", map[string]any{"id": uint64(5), "all": true, "verbose": true}, ""},
+		{"double dash ends options", "5 -- -v", map[string]any{"id": uint64(5), "word": "-v"}, ""},
+		{"quoted dash is an argument", `5 "-v"`, map[string]any{"id": uint64(5), "word": "-v"}, ""},
+		{"negative number is an argument", "5 -3", map[string]any{"id": uint64(5), "word": "-3"}, ""},
+		{"lone dash is an argument", "5 -", map[string]any{"id": uint64(5), "word": "-"}, ""},
+		{"empty", "", nil, "Missing argument `id`"},
+		{"only spaces", "   ", nil, "Missing argument `id`"},
+		{"bad id", "five", nil, "`five` is not a message id"},
+		{"bad count", "--count three 5", nil, "Option `--count`: `three` is not a number"},
+		{"unknown room", "--room nowhere 5", nil, "Room `nowhere` does not exist"},
+		{"unknown long option", "--nope 5", nil, "Unknown option `--nope`"},
+		{"unknown short option", "-x 5", nil, "Unknown option `-x`"},
+		{"unknown combined option", "-ax 5", nil, "Unknown option `-x`"},
+		{"missing option value", "5 --count", nil, "Option `--count` needs a value"},
+		{"value in combined options", "-an 3 5", nil, "Option `-n` needs a value"},
+		{"switch with a value", "--all=yes 5", nil, "Option `--all` doesn't take a value"},
+		{"unterminated quote", `5 "hi`, nil, "a quote is never closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, cerr := cmd.parseArgs(tt.input)
+			if tt.err != "" {
+				if cerr == nil {
+					t.Fatalf("parseArgs(%q) = %v, want an error containing %q", tt.input, args.values, tt.err)
+				}
+				if !strings.Contains(cerr.Reason, tt.err) || !strings.Contains(cerr.Reason, "Usage: /test") {
+					t.Errorf("parseArgs(%q) error = %q, want it to contain %q and the usage", tt.input, cerr.Reason, tt.err)
+				}
+				return
+			}
+			if cerr != nil {
+				t.Fatalf("parseArgs(%q) error = %v", tt.input, cerr)
+			}
+			if !reflect.DeepEqual(args.values, tt.want) {
+				t.Errorf("parseArgs(%q) = %v, want %v", tt.input, args.values, tt.want)
+			}
+		})
+	}
+}
+
+func TestTextArgsTakeApostrophes(t *testing.T) {
+	tests := []struct {
+		command string
+		input   string
+		arg     string // the text argument
+		want    string
+	}{
+		{"whisper", "bob I'm late", "message", "I'm late"},
+		{"reply", "5 don't", "message", "don't"},
+		{"me", "isn't here", "action", "isn't here"},
+		{"notice", "bob it's automatic", "message", "it's automatic"},
+		{"topic", "Bob's room", "topic", "Bob's room"},
+		{"kick", "bob don't spam", "reason", "don't spam"},
+		{"ban", "bob won't stop", "reason", "won't stop"},
+		{"search", "don't", "query", "don't"},
+		{"search", "--all it's \"quoted\"", "query", `it's "quoted"`},
+		{"whisper", "bob 'it is quoted'", "message", "it is quoted"},
+		{"whisper", `bob "don't"`, "message", "don't"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command+" "+tt.input, func(t *testing.T) {
+			cmd, ok := DefaultCommands.Lookup(tt.command)
+			if !ok {
+				t.Fatalf("no command /%s", tt.command)
+			}
+			args, cerr := cmd.parseArgs(tt.input)
+			if cerr != nil {
+				t.Fatalf("parseArgs(%q) error = %v", tt.input, cerr)
+			}
+			if got := args.String(tt.arg); got != tt.want {
+				t.Errorf("parseArgs(%q) %s = %q, want %q", tt.input, tt.arg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseArgsTooMany(t *testing.T) {
+	cmd := Command{Name: "thread", Args: []Arg{{Name: "messageId", Type: ArgMessageId}}}
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"1 2", "Too many arguments, `2` was not expected"},
+		{`1 "a b"`, "Too many arguments, `a b` was not expected"},
+		// commands without options take dashes as arguments
+		{"1 --all", "Too many arguments, `--all` was not expected"},
+	}
+	for _, tt := range tests {
+		_, cerr := cmd.parseArgs(tt.input)
+		if cerr == nil || !strings.Contains(cerr.Reason, tt.err) {
+			t.Errorf("parseArgs(%q) error = %v, want %q", tt.input, cerr, tt.err)
+		}
+	}
+}
+
+func TestCheckArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []Arg
+		flags []Flag
+		ok    bool
+	}{
+		{"nothing", nil, nil, true},
+		{"optional after required", []Arg{{Name: "a"}, {Name: "b", Optional: true}}, nil, true},
+		{"text last", []Arg{{Name: "a"}, {Name: "b", Type: ArgText}}, nil, true},
+		{"options", nil, []Flag{{Name: "all", Short: "a", Switch: true}, {Name: "room"}}, true},
+		{"no name", []Arg{{Name: ""}}, nil, false},
+		{"space in name", []Arg{{Name: "a b"}}, nil, false},
+		{"same name twice", []Arg{{Name: "a"}, {Name: "a"}}, nil, false},
+		{"text not last", []Arg{{Name: "a", Type: ArgText}, {Name: "b"}}, nil, false},
+		{"required after optional", []Arg{{Name: "a", Optional: true}, {Name: "b"}}, nil, false},
+		{"option named like an argument", []Arg{{Name: "a"}}, []Flag{{Name: "a"}}, false},
+		{"option with dashes", nil, []Flag{{Name: "--all"}}, false},
+		{"option with equals", nil, []Flag{{Name: "a=b"}}, false},
+		{"long short form", nil, []Flag{{Name: "all", Short: "al"}}, false},
+		{"digit short form", nil, []Flag{{Name: "all", Short: "1"}}, false},
+		{"same short form twice", nil, []Flag{{Name: "all", Short: "a"}, {Name: "any", Short: "a"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkArgs(tt.args, tt.flags)
+			if (err == nil) != tt.ok {
+				t.Errorf("checkArgs() error = %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCommandListLookup(t *testing.T) {
+	cl := NewCommandList()
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"whisper", "whisper", true},
+		{"WHISPER", "whisper", true},
+		{"w", "whisper", true},
+		{"j", "join", true},
+		{"", "", false},
+		{"nope", "", false},
+	}
+	for _, tt := range tests {
+		cmd, ok := cl.Lookup(tt.name)
+		if ok != tt.ok || cmd.Name != tt.want {
+			t.Errorf("Lookup(%q) = (%q, %v), want (%q, %v)", tt.name, cmd.Name, ok, tt.want, tt.ok)
+		}
+	}
+	if err := cl.Register(Command{Name: "whisper2", Aliases: []string{"W"}, Operation: help}); err == nil {
+		t.Errorf("Register() with a taken alias should fail")
+	}
+}
@@ -1,292 +1,705 @@
-package chatroom
-
-import (
-	"fmt"
-	"strings"
-	"time"
-
-	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
-)
-
-// a command that got called by a client
-type CalledCommand struct {
-	Uuid uuid.UUID // the user running the command
-	Name string    // the name of the command
-	Args string    // the arguments to the command
-}
-
-// a command that operates on a client
-type Command struct {
-	Name       string
-	Operation  func(r *Room, c *Client, s string) *CommandError
-	HelpString string
-}
-
-type CommandError struct {
-	CommandName string
-	Reason      string
-}
-
-// for fmt.Error() string
-func (ce CommandError) Error() string {
-	return fmt.Sprintf("Command %s failed: %s", ce.CommandName, ce.Reason)
-}
-
-// the built-in commands users can run
-// these start with a slash
-type CommandList map[string]Command
-
-// checks if a command is available to run
-func (cl CommandList) InCommandList(commandName string) bool {
-	_, ok := cl[commandName]
-	return ok
-}
-
-func NewCommandList() CommandList {
-	return CommandList{
-		// create a new room
-		"make": {
-			Name:       "make",
-			Operation:  makeRoom,
-			HelpString: "Usage:\n/make roomName\n    Makes a new room with a given name.",
-		},
-		// list rooms, marking which one the client is in
-		"listrooms": {
-			Name:       "listrooms",
-			Operation:  listRoom,
-			HelpString: "Usage:\n/listrooms\n    Lists all open rooms.",
-		},
-		// join a room
-		"join": {
-			Name:       "join",
-			Operation:  joinRoom,
-			HelpString: "Usage:\n/join roomName\n    Moves the client to the given room.",
-		},
-		// exit entirely
-		"exit": {
-			Name:       "exit",
-			Operation:  exitRoom,
-			HelpString: "Usage:\n/exit\n    Leave the server.",
-		},
-		// list the users in the current room
-		"listusers": {
-			Name:       "listusers",
-			Operation:  listUsers,
-			HelpString: "Usage:\n/listusers\n    List the users in the current room.",
-		},
-		// list all users in the current server
-		"listallusers": {
-			Name:       "listallusers",
-			Operation:  listAllUsers,
-			HelpString: "Usage:\n/listallusers\n    List all users in the current server.",
-		},
-		// list commands
-		"help": {
-			Name:       "help",
-			Operation:  help,
-			HelpString: "Usage:\n/help\n    List all available commands.\n/help command\n    Print out the helpstring for that command.",
-		},
-		// whisper: send a dm to another client
-		"whisper": {
-			Name:       "whisper",
-			Operation:  whisper,
-			HelpString: "Usage:\n/whisper nickName message\n    Direct message a user with the given nickname.",
-		},
-	}
-}
-
-// makes a new room, when given a room name
-func makeRoom(r *Room, c *Client, s string) *CommandError {
-	args := strings.SplitN(s, " ", 2)
-	if len(args) != 1 {
-		return &CommandError{
-			CommandName: "make",
-			Reason:      fmt.Sprintf("Wrong number of arguments: want 1 (channel name), got %v", len(args)),
-		}
-	}
-	roomName := args[0]
-	newroom := NewRoom(roomName)
-	c.ServerDirectMessage(r.serverMessage(fmt.Sprintf("Successfully made new room `%s`", roomName)))
-	r.Logln(c.Nickname, fmt.Sprintf("made new room `%s`", newroom.RoomName))
-	return nil
-}
-
-// lists all open rooms
-func listRoom(r *Room, c *Client, s string) *CommandError {
-	var builder strings.Builder
-	builder.WriteString("\nChannels:\n")
-	builder.WriteString("---------\n")
-	for u, room := range ActiveRooms {
-		builder.WriteString(room.RoomName)
-		if u == c.CurrentRoom.Uuid {
-			builder.WriteString(" (* joined)")
-		}
-		builder.WriteString("\n")
-	}
-	c.ServerDirectMessage(r.serverMessage(builder.String()))
-	r.Logln(c.Nickname, "listed rooms")
-	// log.Println(builder.String())
-	return nil
-}
-
-// moves the calling client to a room with a given name
-func joinRoom(r *Room, c *Client, s string) *CommandError {
-	args := strings.SplitN(s, " ", 2)
-	if len(args) != 1 {
-		return &CommandError{
-			CommandName: "join",
-			Reason:      fmt.Sprintf("Wrong number of arguments: want 1 (channel name), got %v", len(args)),
-		}
-	}
-	// see if the wanted room exists
-	nextRoom, ok := ActiveRooms[StringToRoomUUID[args[0]]]
-	if !ok {
-		return &CommandError{
-			CommandName: "join",
-			Reason:      fmt.Sprintf("Room `%v` does not exist", s),
-		}
-	}
-	if !nextRoom.isRunning {
-		r.Logln("running", nextRoom.RoomName)
-		go nextRoom.Run()
-	}
-	// room exists, we're all ok
-	// remove the client from the current room
-	// tell the client to switch to the new room
-	// switch message contains the new room name for the webclient to display
-	switchMessage, err := websocket.NewPreparedMessage(websocket.TextMessage, []byte(nextRoom.RoomName))
-	if err != nil {
-		r.Logf("Cannot make switch message for %v: %v\n", c.Nickname, err)
-		// reset state
-		r.Register <- c
-	}
-	err = c.Connection.WritePreparedMessage(switchMessage)
-	if err != nil {
-		r.Logf("Failed to send switch message to %v: %v", c.Nickname, err)
-	}
-	r.Logf("switching %s from this room", c.Nickname)
-	roomswitch := new(RoomSwitch)
-	roomswitch.client = c
-	roomswitch.targetRoom = nextRoom
-	go func() {
-		r.SwitchRoom <- roomswitch
-	}()
-	inroom, ok := r.Clients[c]
-	r.Logln("in the room:", inroom, ok)
-	return nil
-}
-
-// force the client to leave and disconnect
-func exitRoom(r *Room, c *Client, s string) *CommandError {
-	r.Unregister <- c
-	c.KickSignal <- r
-	return nil
-}
-
-// list all users in the current room
-func listUsers(r *Room, c *Client, s string) *CommandError {
-	var builder strings.Builder
-	builder.WriteString("\nUsers:\n")
-	builder.WriteString("---------\n")
-	for client, inRoom := range r.Clients {
-		if inRoom {
-			builder.WriteString(client.Nickname)
-			if client.Uuid == c.Uuid {
-				builder.WriteString(" (* you)")
-			}
-			builder.WriteString("\n")
-		}
-	}
-	c.ServerDirectMessage(r.serverMessage(builder.String()))
-	r.Logln(c.Nickname, "listed room users")
-	return nil
-}
-
-// list all users in the current server
-func listAllUsers(r *Room, c *Client, s string) *CommandError {
-	var builder strings.Builder
-	builder.WriteString("\nAll Users:\n")
-	builder.WriteString("---------\n")
-	for client, inRoom := range AllUsers {
-		if inRoom {
-			builder.WriteString(client.Nickname)
-			if client.Uuid == c.Uuid {
-				builder.WriteString(" (* you)")
-			}
-			builder.WriteString("\n")
-		}
-	}
-	c.ServerDirectMessage(r.serverMessage(builder.String()))
-	r.Logln(c.Nickname, "listed all users")
-	return nil
-}
-
-// prints out help messages and lists available commands
-func help(r *Room, c *Client, s string) *CommandError {
-	var builder strings.Builder
-	var args []string
-	if len(s) == 0 {
-		args = []string{}
-	} else {
-		args = strings.SplitAfter(s, " ")
-	}
-	fmt.Println(args)
-	fmt.Println(len(args))
-	switch len(args) {
-	case 0:
-		// no args = list commands
-		builder.WriteString("\nAvailable Commands:\n")
-		builder.WriteString("-------------------\n")
-		for command := range r.Commands {
-			builder.WriteString(command)
-			builder.WriteString("\n")
-		}
-		c.ServerDirectMessage(r.serverMessage(builder.String()))
-	case 1:
-		// 1 arg = print the helpstring of the command
-		command, ok := r.Commands[args[0]]
-		if !ok {
-			// command doesn't exist
-			return &CommandError{
-				CommandName: "help",
-				Reason:      fmt.Sprintf("Command `%s` does not exist", args[0]),
-			}
-		}
-		c.ServerDirectMessage(r.serverMessage(command.HelpString))
-	}
-	return nil
-}
-
-// sends a direct message between the calling client and a target, given a nickname and a message
-func whisper(r *Room, c *Client, s string) *CommandError {
-	// expected arguments:
-	// target nickname args[0]
-	// message contents args[1]
-	args := strings.SplitN(s, " ", 2)
-	if len(args) < 2 {
-		return &CommandError{
-			CommandName: "whisper",
-			Reason:      fmt.Sprintf("Wrong number of arguments: want 2 (nickname, contents), got %v args", len(args)),
-		}
-	}
-	targetName := args[0]
-	whisperContents := args[1]
-	target := r.GetClientByNickname(targetName)
-	if target == nil {
-		return &CommandError{
-			CommandName: "whisper",
-			Reason:      fmt.Sprintf("Target client %s does not exist, or is offline", targetName),
-		}
-	}
-	c.DirectMessageToOtherClient(*target, Message{
-		Uuid:            c.Uuid,
-		FromNick:        c.Nickname,
-		Content:         whisperContents,
-		SentTime:        time.Now(),
-		ServerName:      r.RoomName,
-		IsDirectMessage: true,
-	})
-
-	return nil
-}
+package chatroom
+
+import (
+	"errors"
+	"fmt"
+	"irc-final-project/logging"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// a command that got called by a client
+type CalledCommand struct {
+	Uuid uuid.UUID // the user running the command
+	Name string    // the name of the command
+	Args string    // the arguments to the command
+}
+
+// how much a user is trusted, commands can require a level to run
+type Permission int
+
+const (
+	PermissionUser     Permission = iota // everyone
+	PermissionOperator                   // server operators
+)
+
+func (p Permission) String() string {
+	switch p {
+	case PermissionUser:
+		return "user"
+	case PermissionOperator:
+		return "operator"
+	default:
+		return fmt.Sprintf("level %d", int(p))
+	}
+}
+
+// a command that operates on a client
+type Command struct {
+	Name        string
+	Aliases     []string   // other names the command can be run by, eg `j` for `join`
+	Args        []Arg      // the arguments the command takes, checked before it runs
+	Flags       []Flag     // the options the command takes, checked before it runs
+	Permission  Permission // the level a user needs to run the command
+	Description string     // what the command does, shown by `/help` under the usage
+	Operation   func(r *Room, c *Client, args Args) *CommandError
+	Quiet       bool // don't echo the command back to the caller, for commands clients send on their own
+	Secret      bool // keep the arguments out of the logs, eg passwords
+}
+
+type CommandError struct {
+	CommandName string
+	Reason      string
+}
+
+// for fmt.Error() string
+func (ce CommandError) Error() string {
+	return fmt.Sprintf("Command %s failed: %s", ce.CommandName, ce.Reason)
+}
+
+// how to call a command, eg `/reply messageId message...`
+func (cmd Command) Usage() string {
+	var builder strings.Builder
+	builder.WriteString("/" + cmd.Name)
+	for _, flag := range cmd.Flags {
+		builder.WriteString(" " + flag.usage())
+	}
+	for _, arg := range cmd.Args {
+		builder.WriteString(" " + arg.usage())
+	}
+	return builder.String()
+}
+
+// the help text of a command: its usage, aliases and description
+func (cmd Command) HelpString() string {
+	var builder strings.Builder
+	builder.WriteString("Usage:\n" + cmd.Usage() + "\n")
+	if len(cmd.Aliases) > 0 {
+		builder.WriteString("Aliases: /" + strings.Join(cmd.Aliases, ", /") + "\n")
+	}
+	if cmd.Permission > PermissionUser {
+		builder.WriteString(fmt.Sprintf("Needs: %s\n", cmd.Permission))
+	}
+	for _, line := range strings.Split(cmd.Description, "\n") {
+		builder.WriteString("    " + line + "\n")
+	}
+	if len(cmd.Flags) > 0 {
+		builder.WriteString("Options:\n")
+		for _, flag := range cmd.Flags {
+			builder.WriteString(fmt.Sprintf("    %s\n        %s\n", strings.Trim(flag.usage(), "[]"), flag.Description))
+		}
+	}
+	return strings.TrimSuffix(builder.String(), "\n")
+}
+
+// an error about how the command was called, with its usage
+func (cmd Command) usageError(reason string) *CommandError {
+	return &CommandError{
+		CommandName: cmd.Name,
+		Reason:      fmt.Sprintf("%s\nUsage: %s", reason, cmd.Usage()),
+	}
+}
+
+// checks the caller's permission and the arguments, then runs the command
+func (cmd Command) Run(r *Room, c *Client, s string) *CommandError {
+	if c.Permission < cmd.Permission {
+		return &CommandError{
+			CommandName: cmd.Name,
+			Reason:      fmt.Sprintf("Permission denied: you need to be %s", cmd.Permission),
+		}
+	}
+	args, cerr := cmd.parseArgs(s)
+	if cerr != nil {
+		return cerr
+	}
+	return cmd.Operation(r, c, args)
+}
+
+// the commands users can run, by name and alias
+// these start with a slash
+type CommandList struct {
+	lock     sync.RWMutex
+	commands map[string]Command // command name -> command
+	aliases  map[string]string  // alias -> command name
+}
+
+// the commands every room runs, built-in ones and anything registered with RegisterCommand
+var DefaultCommands *CommandList
+
+func init() {
+	// set here, since the built-in commands refer back to rooms
+	DefaultCommands = NewCommandList()
+}
+
+// adds a command that every room can run
+// commands should be registered before the server starts taking connections
+func RegisterCommand(cmd Command) error {
+	return DefaultCommands.Register(cmd)
+}
+
+// makes a command list with the built-in commands
+func NewCommandList() *CommandList {
+	cl := &CommandList{
+		commands: make(map[string]Command),
+		aliases:  make(map[string]string),
+	}
+	for _, cmd := range builtinCommands() {
+		if err := cl.Register(cmd); err != nil {
+			panic(err)
+		}
+	}
+	return cl
+}
+
+// adds a command to the list
+// fails if the name or an alias is taken, or the arguments don't make sense
+func (cl *CommandList) Register(cmd Command) error {
+	if cmd.Name == "" || cmd.Operation == nil {
+		return errors.New("commands need a name and an operation")
+	}
+	cmd.Name = strings.ToLower(cmd.Name)
+	aliases := make([]string, len(cmd.Aliases))
+	for i, alias := range cmd.Aliases {
+		aliases[i] = strings.ToLower(alias)
+	}
+	cmd.Aliases = aliases
+	if err := checkArgs(cmd.Args, cmd.Flags); err != nil {
+		return fmt.Errorf("command %s: %w", cmd.Name, err)
+	}
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if _, ok := cl.resolve(name); ok {
+			return fmt.Errorf("command %s: `%s` is already taken", cmd.Name, name)
+		}
+	}
+	cl.commands[cmd.Name] = cmd
+	for _, alias := range cmd.Aliases {
+		cl.aliases[alias] = cmd.Name
+	}
+	return nil
+}
+
+// finds a command by its name or an alias, ignoring case
+func (cl *CommandList) Lookup(name string) (Command, bool) {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+	return cl.resolve(strings.ToLower(name))
+}
+
+// same as Lookup, the caller must hold the lock
+func (cl *CommandList) resolve(name string) (Command, bool) {
+	if alias, ok := cl.aliases[name]; ok {
+		name = alias
+	}
+	cmd, ok := cl.commands[name]
+	return cmd, ok
+}
+
+// checks if a command is available to run
+func (cl *CommandList) InCommandList(commandName string) bool {
+	_, ok := cl.Lookup(commandName)
+	return ok
+}
+
+// every command, sorted by name
+func (cl *CommandList) All() []Command {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+	commands := make([]Command, 0, len(cl.commands))
+	for _, cmd := range cl.commands {
+		commands = append(commands, cmd)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// the commands built into the server
+func builtinCommands() []Command {
+	return []Command{
+		// create a new room
+		{
+			Name: "make",
+			Flags: []Flag{
+				{Name: "persist", Short: "p", Switch: true, Description: "Keep the room even when nobody is in it, and after the server restarts. Only for operators."},
+				{Name: "topic", Short: "t", Type: ArgWord, Description: "What the room talks about now, in quotes if it has spaces."},
+				{Name: "modes", Short: "m", Type: ArgWord, Description: "Room modes: t so only you and operators can change the topic, m so only you and operators can talk."},
+				{Name: "description", Short: "d", Type: ArgWord, Description: "What the room is for, in quotes if it has spaces."},
+			},
+			Args:        []Arg{{Name: "roomName", Type: ArgWord}},
+			Operation:   makeRoom,
+			Description: "Makes a new room with a given name.",
+		},
+		// list rooms, marking which one the client is in
+		{
+			Name:        "listrooms",
+			Aliases:     []string{"rooms"},
+			Operation:   listRoom,
+			Description: "Lists all open rooms.",
+		},
+		// join a room
+		{
+			Name:        "join",
+			Aliases:     []string{"j"},
+			Args:        []Arg{{Name: "roomName", Type: ArgRoom}},
+			Operation:   joinRoom,
+			Description: "Moves the client to the given room.",
+		},
+		// exit entirely
+		{
+			Name:        "exit",
+			Aliases:     []string{"quit"},
+			Operation:   exitRoom,
+			Description: "Leave the server.",
+		},
+		// list the users in the current room
+		{
+			Name:        "listusers",
+			Aliases:     []string{"users"},
+			Operation:   listUsers,
+			Description: "List the users in the current room.",
+		},
+		// list all users in the current server
+		{
+			Name:        "listallusers",
+			Operation:   listAllUsers,
+			Description: "List all users in the current server.",
+		},
+		// list commands
+		{
+			Name:        "help",
+			Aliases:     []string{"?"},
+			Args:        []Arg{{Name: "command", Type: ArgWord, Optional: true}},
+			Operation:   help,
+			Description: "List all available commands, or print out the help for one command.",
+		},
+		// whisper: send a dm to another client
+		{
+			Name:        "whisper",
+			Aliases:     []string{"w", "msg"},
+			Args:        []Arg{{Name: "nickName", Type: ArgWord}, {Name: "message", Type: ArgText}},
+			Operation:   whisper,
+			Description: "Direct message a user with the given nickname.",
+		},
+		// show or change the topic of the current room
+		{
+			Name:        "topic",
+			Args:        []Arg{{Name: "topic", Type: ArgText, Optional: true}},
+			Operation:   topic,
+			Description: "Show the topic of the current room, or change it. Rooms with mode t only let their owner and operators change it.",
+		},
+		// show what a room is about
+		{
+			Name:        "roominfo",
+			Args:        []Arg{{Name: "roomName", Type: ArgRoom, Optional: true}},
+			Operation:   roomInfoCommand,
+			Description: "Show the description, topic, owner and modes of a room, the current room if not given.",
+		},
+		// show the message of the day again
+		{
+			Name:        "motd",
+			Operation:   showMotd,
+			Description: "Show the message of the day.",
+		},
+		// read the message of the day file again
+		{
+			Name:        "reloadmotd",
+			Permission:  PermissionOperator,
+			Operation:   reloadMotd,
+			Description: "Read the message of the day file again, without restarting the server.",
+		},
+		// become an operator
+		{
+			Name:        "oper",
+			Args:        []Arg{{Name: "name", Type: ArgWord}, {Name: "password", Type: ArgWord}},
+			Operation:   oper,
+			Description: "Become a server operator, with an operator name and password from the server's config.",
+			Quiet:       true,
+			Secret:      true,
+		},
+		// say what you are doing: `* nickname waves`
+		{
+			Name:        "me",
+			Args:        []Arg{{Name: "action", Type: ArgText}},
+			Operation:   me,
+			Description: "Describe what you are doing, like `/me waves`, shown as `* nickname waves`.",
+		},
+		// a message bots must not answer
+		{
+			Name:        "notice",
+			Args:        []Arg{{Name: "target", Type: ArgWord}, {Name: "message", Type: ArgText}},
+			Operation:   notice,
+			Description: "Send a notice to the current room, given by its name, or to a user. Bots never answer notices.",
+		},
+		// disconnect a user
+		{
+			Name:        "kick",
+			Args:        []Arg{{Name: "nickName", Type: ArgWord}, {Name: "reason", Type: ArgText, Optional: true}},
+			Permission:  PermissionOperator,
+			Operation:   kick,
+			Description: "Disconnect a user, telling them why if a reason is given.",
+		},
+		// keep a nickname off the server
+		{
+			Name:        "ban",
+			Args:        []Arg{{Name: "nickName", Type: ArgWord}, {Name: "reason", Type: ArgText, Optional: true}},
+			Permission:  PermissionOperator,
+			Operation:   ban,
+			Description: "Keep a nickname, and the address it is connected from, or an IP address, from connecting, disconnecting them if they are online. `/ban list` lists the bans.",
+		},
+		{
+			Name:        "unban",
+			Args:        []Arg{{Name: "nickName", Type: ArgWord}},
+			Permission:  PermissionOperator,
+			Operation:   unban,
+			Description: "Let a banned nickname or address connect again.",
+		},
+		// see who did what
+		{
+			Name: "audit",
+			Flags: []Flag{
+				{Name: "action", Short: "a", Type: ArgWord, Description: "Only show this action, like kick, ban, unban, make, teardown, oper, oper-failed or reloadmotd."},
+				{Name: "actor", Short: "u", Type: ArgWord, Description: "Only show what this nickname did, or `server`."},
+			},
+			Args:        []Arg{{Name: "count", Type: ArgInt, Optional: true}},
+			Permission:  PermissionOperator,
+			Operation:   auditCommand,
+			Description: "List the latest privileged actions, like kicks, bans and new rooms, newest first. Shows 20 if no count is given.",
+		},
+		// react to a message in the current room
+		{
+			Name:        "react",
+			Args:        []Arg{{Name: "messageId", Type: ArgMessageId}, {Name: "emoji", Type: ArgWord}},
+			Operation:   react,
+			Description: "React to a message with an emoji or a :shortcode:.",
+		},
+		// take back a reaction
+		{
+			Name:        "unreact",
+			Args:        []Arg{{Name: "messageId", Type: ArgMessageId}, {Name: "emoji", Type: ArgWord}},
+			Operation:   unreact,
+			Description: "Remove your reaction from a message.",
+		},
+		// reply to a message in the current room
+		{
+			Name:        "reply",
+			Aliases:     []string{"re"},
+			Args:        []Arg{{Name: "messageId", Type: ArgMessageId}, {Name: "message", Type: ArgText}},
+			Operation:   reply,
+			Description: "Reply to a message, starting or continuing its thread.",
+		},
+		// stop seeing messages from a user
+		{
+			Name:        "ignore",
+			Args:        []Arg{{Name: "nickName", Type: ArgWord}},
+			Operation:   ignore,
+			Description: "Stop seeing room messages and whispers from a user.\n`/ignore list` lists the users you ignore.",
+		},
+		// see messages from an ignored user again
+		{
+			Name:        "unignore",
+			Args:        []Arg{{Name: "nickName", Type: ArgWord}},
+			Operation:   unignore,
+			Description: "See messages from an ignored user again.",
+		},
+		// tell the room that the client is typing
+		{
+			Name:        "typing",
+			Operation:   typing,
+			Description: "Tell the others in the room that you are typing. Sent by clients automatically.",
+			Quiet:       true,
+		},
+		// move the read marker forward
+		{
+			Name:        "markread",
+			Args:        []Arg{{Name: "roomName", Type: ArgRoom, Optional: true}, {Name: "messageId", Type: ArgMessageId, Optional: true}},
+			Operation:   markRead,
+			Description: "Mark a room as read, the current room if not given, up to and including the given message, the newest one if not given.",
+		},
+		// get unread counts
+		{
+			Name:        "unread",
+			Operation:   listUnread,
+			Description: "Get your unread message and mention counts in every room you were in.",
+			Quiet:       true,
+		},
+		// search the history of rooms
+		{
+			Name: "search",
+			Flags: []Flag{
+				{Name: "room", Short: "r", Type: ArgRoom, Description: "Search this room instead of the current one."},
+				{Name: "all", Short: "a", Switch: true, Description: "Search every room you can read."},
+				{Name: "regex", Short: "e", Switch: true, Description: "Match the query as a regular expression."},
+			},
+			Args:        []Arg{{Name: "query", Type: ArgText}},
+			Operation:   search,
+			Description: "Search the messages of a room, the current room unless an option says otherwise.\n`/search roomName query` searches another room too, and `/search * query` every room you can read.\nThe query can contain these filters:\nfrom:nickName     only messages from that user, can be given more than once\nafter:2006-01-02  only messages sent after that date or time\nbefore:2006-01-02 only messages sent before that date or time\npage:2            which page of results to show\nText between slashes, like /staging-[0-9]+/, is matched as a regular expression. Anything else is matched as text, ignoring case.",
+		},
+		// manage highlight keywords
+		{
+			Name:        "highlight",
+			Args:        []Arg{{Name: "action", Type: ArgWord, Optional: true}, {Name: "keyword", Type: ArgWord, Optional: true}},
+			Operation:   highlight,
+			Description: "`/highlight add keyword` highlights messages containing the keyword, like ones mentioning your nickname.\n`/highlight remove keyword` stops highlighting them.\n`/highlight list` lists your keywords, and is the default.",
+		},
+		// list recent mentions
+		{
+			Name:        "mentions",
+			Args:        []Arg{{Name: "count", Type: ArgInt, Optional: true}},
+			Operation:   listMentions,
+			Description: "List the latest messages that mentioned you or your keywords, in any room. Lists 10 if count isn't given.",
+		},
+		// get names for tab completion
+		{
+			Name:        "complete",
+			Operation:   complete,
+			Description: "Get the commands, nicknames and rooms you can use, for tab completion. Sent by clients automatically.",
+			Quiet:       true,
+		},
+		// show a whole thread
+		{
+			Name:        "thread",
+			Args:        []Arg{{Name: "messageId", Type: ArgMessageId}},
+			Operation:   thread,
+			Description: "Show every message in the thread the given message belongs to.",
+		},
+	}
+}
+
+// makes a new room, when given a room name
+// the caller owns it, and it can be made persistent so it is never torn down and comes back after a restart
+func makeRoom(r *Room, c *Client, args Args) *CommandError {
+	roomName := args.String("roomName")
+	exists := &CommandError{
+		CommandName: "make",
+		Reason:      fmt.Sprintf("Room `%s` already exists", roomName),
+	}
+	if _, ok := FindRoom(roomName); ok {
+		return exists
+	}
+	info := RoomInfo{
+		Name:        roomName,
+		Owner:       c.Nickname,
+		Topic:       args.String("topic"),
+		Modes:       args.String("modes"),
+		Description: args.String("description"),
+	}
+	if err := CheckModes(info.Modes); err != nil {
+		return &CommandError{
+			CommandName: "make",
+			Reason:      err.Error(),
+		}
+	}
+	var newroom *Room
+	if args.Bool("persist") {
+		// they stay after the server restarts, when nobody is connected anymore, so operators own them
+		if c.Permission < PermissionOperator {
+			return &CommandError{
+				CommandName: "make",
+				Reason:      "Only operators can make persistent rooms",
+			}
+		}
+		info.Owner = c.operName
+		var err error
+		if newroom, err = NewPersistentRoom(info); err != nil {
+			// the info was checked above, so someone took the name in the meantime
+			return exists
+		}
+		if err := saveRooms(); err != nil {
+			r.logEvent(logging.LevelError, "save-rooms", c, logging.Fields{"error": err})
+		}
+	} else {
+		newroom = newRoom(roomName)
+		// set up before anyone can find it
+		newroom.info.info = info
+		newroom.info.owner = c.Uuid
+		if !rooms.addNew(newroom) {
+			return exists
+		}
+		// start it, so it gets torn down if nobody ever joins
+		newroom.Start()
+	}
+	c.ServerDirectMessage(r.serverMessage(fmt.Sprintf("Successfully made new room `%s`", roomName)))
+	details := ""
+	if newroom.Persistent {
+		details = "persistent"
+	}
+	r.audit("make", c, newroom.RoomName, details)
+	return nil
+}
+
+// lists all open rooms
+func listRoom(r *Room, c *Client, args Args) *CommandError {
+	var builder strings.Builder
+	builder.WriteString("\nChannels:\n")
+	builder.WriteString("---------\n")
+	for _, room := range AllRooms() {
+		builder.WriteString(room.RoomName)
+		if room == c.CurrentRoom() {
+			builder.WriteString(" (* joined)")
+		}
+		if unread, ok := room.unreadFor(c.Nickname); ok && unread.Unread > 0 {
+			builder.WriteString(fmt.Sprintf(" [%s]", unread))
+		}
+		builder.WriteString("\n")
+	}
+	c.ServerDirectMessage(r.serverMessage(builder.String()))
+	c.ServerDirectMessage(r.unreadMessage(unreadSummary(c.Nickname)))
+	r.Logln(c.Nickname, "listed rooms")
+	return nil
+}
+
+// moves the calling client to a room with a given name
+func joinRoom(r *Room, c *Client, args Args) *CommandError {
+	// the wanted room exists, the argument is checked before we get here
+	nextRoom := args.Room("roomName")
+	if !nextRoom.IsMember(c.Nickname) {
+		return &CommandError{
+			CommandName: "join",
+			Reason:      fmt.Sprintf("Room `%v` is private", nextRoom.RoomName),
+		}
+	}
+	// room exists, we're all ok
+	// remove the client from the current room
+	// tell the client to switch to the new room
+	// switch message contains the new room name for the webclient to display
+	if !c.IsBot() {
+		if err := c.writeSwitch(nextRoom.RoomName); err != nil {
+			r.Logf("Failed to send switch message to %v: %v", c.Nickname, err)
+		}
+	}
+	r.Logf("switching %s from this room", c.Nickname)
+	roomswitch := new(RoomSwitch)
+	roomswitch.client = c
+	roomswitch.targetRoom = nextRoom
+	go func() {
+		select {
+		case r.SwitchRoom <- roomswitch:
+		case <-r.done:
+		}
+	}()
+	inroom, ok := r.Clients[c]
+	r.Logln("in the room:", inroom, ok)
+	return nil
+}
+
+// force the client to leave and disconnect
+func exitRoom(r *Room, c *Client, args Args) *CommandError {
+	// this runs on the room's goroutine, so take them out right here
+	// closing their channel stops their writer, which closes the connection
+	r.unregister(c)
+	return nil
+}
+
+// list all users in the current room
+func listUsers(r *Room, c *Client, args Args) *CommandError {
+	var builder strings.Builder
+	builder.WriteString("\nUsers:\n")
+	builder.WriteString("---------\n")
+	for client, inRoom := range r.Clients {
+		if inRoom {
+			builder.WriteString(client.Nickname)
+			if client.IsBot() {
+				builder.WriteString(" [bot]")
+			}
+			if client.Uuid == c.Uuid {
+				builder.WriteString(" (* you)")
+			}
+			builder.WriteString("\n")
+		}
+	}
+	c.ServerDirectMessage(r.serverMessage(builder.String()))
+	r.Logln(c.Nickname, "listed room users")
+	return nil
+}
+
+// list all users in the current server
+func listAllUsers(r *Room, c *Client, args Args) *CommandError {
+	var builder strings.Builder
+	builder.WriteString("\nAll Users:\n")
+	builder.WriteString("---------\n")
+	for _, client := range users.all() {
+		builder.WriteString(client.Nickname)
+		if client.IsBot() {
+			builder.WriteString(" [bot]")
+		}
+		if client.Uuid == c.Uuid {
+			builder.WriteString(" (* you)")
+		}
+		builder.WriteString("\n")
+	}
+	c.ServerDirectMessage(r.serverMessage(builder.String()))
+	r.Logln(c.Nickname, "listed all users")
+	return nil
+}
+
+// prints out help messages and lists available commands
+func help(r *Room, c *Client, args Args) *CommandError {
+	if !args.Has("command") {
+		// no args = list commands
+		var builder strings.Builder
+		builder.WriteString("\nAvailable Commands:\n")
+		builder.WriteString("-------------------\n")
+		for _, command := range r.Commands.All() {
+			if c.Permission < command.Permission {
+				continue
+			}
+			builder.WriteString(command.Usage())
+			if len(command.Aliases) > 0 {
+				builder.WriteString(" (/" + strings.Join(command.Aliases, ", /") + ")")
+			}
+			builder.WriteString("\n")
+		}
+		builder.WriteString("Use /help command to learn more about one.\n")
+		c.ServerDirectMessage(r.serverMessage(builder.String()))
+		return nil
+	}
+	// 1 arg = print the helpstring of the command
+	name := strings.TrimPrefix(args.String("command"), "/")
+	command, ok := r.Commands.Lookup(name)
+	if !ok {
+		// command doesn't exist
+		return &CommandError{
+			CommandName: "help",
+			Reason:      fmt.Sprintf("Command `%s` does not exist", name),
+		}
+	}
+	c.ServerDirectMessage(r.serverMessage(command.HelpString()))
+	return nil
+}
+
+// sends a direct message between the calling client and a target, given a nickname and a message
+func whisper(r *Room, c *Client, args Args) *CommandError {
+	targetName := args.String("nickName")
+	whisperContents := args.String("message")
+	target := r.GetClientByNickname(targetName)
+	if target == nil {
+		return &CommandError{
+			CommandName: "whisper",
+			Reason:      fmt.Sprintf("Target client %s does not exist, or is offline", targetName),
+		}
+	}
+	content, rich := ParseRichText(whisperContents)
+	message := Message{
+		Kind:            KindChat,
+		Uuid:            c.Uuid,
+		FromNick:        c.Nickname,
+		Content:         content,
+		Rich:            rich,
+		SentTime:        time.Now(),
+		ServerName:      r.RoomName,
+		IsDirectMessage: true,
+	}
+	if ignoredBy(target, message) {
+		// the sender isn't told, same as an ignored room message
+		r.Logf("%s ignores %s, dropped whisper\n", target.Nickname, c.Nickname)
+		return nil
+	}
+	c.DirectMessageToOtherClient(target, message)
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package chatroom
+
+import (
+	"sort"
+)
+
+// the names a client can tab-complete, so clients don't have to read them out of `/listusers` and such
+type Completion struct {
+	Commands     []string `json:"Commands"`     // names and aliases of the commands the user can run, without the slash
+	Nicknames    []string `json:"Nicknames"`    // users in the user's current room
+	AllNicknames []string `json:"AllNicknames"` // users online in any room
+	Rooms        []string `json:"Rooms"`        // rooms the user can join
+}
+
+// gathers what a client can complete, all sorted
+func (r *Room) completionFor(c *Client) *Completion {
+	completion := &Completion{}
+	for _, command := range r.Commands.All() {
+		if c.Permission < command.Permission {
+			continue
+		}
+		completion.Commands = append(completion.Commands, command.Name)
+		completion.Commands = append(completion.Commands, command.Aliases...)
+	}
+	for client, inRoom := range r.Clients {
+		if inRoom {
+			completion.Nicknames = append(completion.Nicknames, client.Nickname)
+		}
+	}
+	for _, client := range users.all() {
+		completion.AllNicknames = append(completion.AllNicknames, client.Nickname)
+	}
+	for name, room := range rooms.names() {
+		// dm rooms have two names, only list the ones the user can get into
+		if room.IsMember(c.Nickname) {
+			completion.Rooms = append(completion.Rooms, name)
+		}
+	}
+	sort.Strings(completion.Commands)
+	sort.Strings(completion.Nicknames)
+	sort.Strings(completion.AllNicknames)
+	sort.Strings(completion.Rooms)
+	return completion
+}
+
+// sends the calling client what it can tab-complete
+func complete(r *Room, c *Client, args Args) *CommandError {
+	m := r.serverMessage("")
+	m.Kind = KindCompletion
+	m.Completion = r.completionFor(c)
+	c.ServerDirectMessage(m)
+	return nil
+}
@@ -0,0 +1,287 @@
+package chatroom
+
+import (
+	"fmt"
+	"io"
+	"irc-final-project/logging"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// how long a test client waits for something before failing
+const testTimeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	// the tests share the package's rooms and users, but nothing is written to disk
+	IgnoreFile = ""
+	RoomsFile = ""
+	BansFile = ""
+	AuditFile = ""
+	// debug lines go through every logging call, so the race detector sees them too
+	logging.Configure(io.Discard, logging.FormatLogfmt, logging.LevelDebug, nil)
+	os.Exit(m.Run())
+}
+
+// starts a chat server with the same routes as the real one, and no rooms, users or ignore lists yet
+// the rooms of earlier tests keep running, but can't be found anymore
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	rooms.lock.Lock()
+	rooms.byName = make(map[string]*Room)
+	rooms.lock.Unlock()
+	users.lock.Lock()
+	users.byNickname = make(map[string]*Client)
+	users.lock.Unlock()
+	// the clients of earlier tests can't take their ignore lists with them anymore once they leave
+	ignores.lock.Lock()
+	ignores.ignored = make(map[string]map[string]bool)
+	ignores.lock.Unlock()
+	readMarkers.lock.Lock()
+	readMarkers.markers = make(map[string]map[string]*readMarker)
+	readMarkers.lock.Unlock()
+	highlights.lock.Lock()
+	highlights.keywords = make(map[string][]string)
+	highlights.kept = make(map[string][]string)
+	highlights.lock.Unlock()
+	mentions.lock.Lock()
+	mentions.recent = make(map[string][]Message)
+	mentions.lock.Unlock()
+	srv := httptest.NewServer(NewRouter())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// a websocket client talking to a test server
+type testClient struct {
+	t        *testing.T
+	nickname string          // the nickname the server gave it
+	session  string          // its session token, for the http endpoints
+	resume   string          // its resume token, to get its session back with after losing its connection
+	conn     *websocket.Conn // only written to by the test
+	messages chan Message    // what the server sent, closed when the connection is
+	switches chan string     // the rooms the server said the client was moved to, or frames it couldn't read
+}
+
+// connects to a path like `/ws/room` as a nickname, and waits for the server to say who it is
+// it speaks ProtocolV2, like the clients in this repo
+func dial(t *testing.T, srv *httptest.Server, path string, nickname string) *testClient {
+	t.Helper()
+	return dialWith(t, srv, path, nickname, ProtocolV2)
+}
+
+// same as dial, asking for the given subprotocols
+func dialWith(t *testing.T, srv *httptest.Server, path string, nickname string, subprotocols ...string) *testClient {
+	t.Helper()
+	return dialUrl(t, wsUrl(srv, path, nickname), subprotocols...)
+}
+
+// comes back as the client a resume token belongs to, through any room
+func dialResume(t *testing.T, srv *httptest.Server, token string) *testClient {
+	t.Helper()
+	return dialUrl(t, resumeUrl(srv, token), ProtocolV2)
+}
+
+// connects to a websocket url, and waits for the server to say who the client is
+func dialUrl(t *testing.T, rawUrl string, subprotocols ...string) *testClient {
+	t.Helper()
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = subprotocols
+	conn, _, err := dialer.Dial(rawUrl, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", rawUrl, err)
+	}
+	c := &testClient{
+		t:        t,
+		conn:     conn,
+		messages: make(chan Message, 256),
+		switches: make(chan string, 16),
+	}
+	go c.read()
+	t.Cleanup(c.close)
+	session := c.expectKind(KindSession)
+	c.nickname = strings.TrimPrefix(session.Content, "(DM) Connected as ")
+	c.session = session.SessionToken
+	c.resume = session.ResumeToken
+	return c
+}
+
+// the websocket url of a path like `/ws/room` on a test server, for a nickname
+func wsUrl(srv *httptest.Server, path string, nickname string) string {
+	u := url.URL{
+		Scheme:   "ws",
+		Host:     strings.TrimPrefix(srv.URL, "http://"),
+		Path:     path,
+		RawQuery: url.Values{"nickname": {nickname}}.Encode(),
+	}
+	return u.String()
+}
+
+// the websocket url to resume a session with a token on a test server
+func resumeUrl(srv *httptest.Server, token string) string {
+	u := url.URL{
+		Scheme:   "ws",
+		Host:     strings.TrimPrefix(srv.URL, "http://"),
+		Path:     "/ws/anyroom",
+		RawQuery: url.Values{"resume": {token}}.Encode(),
+	}
+	return u.String()
+}
+
+// tries to connect to a path as a nickname, expecting the server to turn the client away
+// returns the http status the server answered with
+func dialRefused(t *testing.T, srv *httptest.Server, path string, nickname string) int {
+	t.Helper()
+	return dialUrlRefused(t, wsUrl(srv, path, nickname))
+}
+
+// tries to connect to a websocket url, expecting the server to turn the client away
+func dialUrlRefused(t *testing.T, rawUrl string) int {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(rawUrl, nil)
+	if err == nil {
+		conn.Close()
+		t.Fatalf("dial %s: connected, want it refused", rawUrl)
+	}
+	if resp == nil {
+		t.Fatalf("dial %s: %v", rawUrl, err)
+	}
+	return resp.StatusCode
+}
+
+// reads what the server sends until the connection closes
+func (c *testClient) read() {
+	defer close(c.messages)
+	for {
+		_, frame, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		envelopes, err := DecodeFrame(c.conn.Subprotocol(), frame)
+		if err != nil {
+			c.switches <- fmt.Sprintf("unreadable frame %q: %v", frame, err)
+			continue
+		}
+		for _, envelope := range envelopes {
+			switch envelope.Type {
+			case EnvelopeMessage:
+				c.messages <- *envelope.Message
+			case EnvelopeSwitch:
+				c.switches <- envelope.Room
+			default:
+				c.switches <- fmt.Sprintf("unknown envelope %q", frame)
+			}
+		}
+	}
+}
+
+// sends a line, like a person typing it
+func (c *testClient) send(line string) {
+	c.t.Helper()
+	if err := c.conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+		c.t.Fatalf("%s: send %q: %v", c.nickname, line, err)
+	}
+}
+
+// waits for a message that passes a check, skipping the others
+func (c *testClient) expectMessage(what string, ok func(Message) bool) Message {
+	c.t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case m, open := <-c.messages:
+			if !open {
+				c.t.Fatalf("%s: connection closed while waiting for %s", c.nickname, what)
+			}
+			if ok(m) {
+				return m
+			}
+		case <-timeout:
+			c.t.Fatalf("%s: timed out waiting for %s", c.nickname, what)
+		}
+	}
+}
+
+// waits for a message containing some text
+func (c *testClient) expect(text string) Message {
+	c.t.Helper()
+	return c.expectMessage("`"+text+"`", func(m Message) bool { return strings.Contains(m.Content, text) })
+}
+
+// waits for a message of some kind
+func (c *testClient) expectKind(kind MessageKind) Message {
+	c.t.Helper()
+	return c.expectMessage(string(kind)+" message", func(m Message) bool { return m.Kind == kind })
+}
+
+// waits for the server to say the client was moved to a room
+func (c *testClient) expectSwitch(want string) {
+	c.t.Helper()
+	select {
+	case room := <-c.switches:
+		if room != want {
+			c.t.Fatalf("%s: switched to %q, want %q", c.nickname, room, want)
+		}
+	case <-time.After(testTimeout):
+		c.t.Fatalf("%s: timed out waiting to switch to %q", c.nickname, want)
+	}
+}
+
+// waits for the server to close the connection
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case _, open := <-c.messages:
+			if !open {
+				return
+			}
+		case <-timeout:
+			c.t.Fatalf("%s: timed out waiting for the connection to close", c.nickname)
+		}
+	}
+}
+
+// loses the connection, without telling the server, and waits for the server to notice
+func (c *testClient) drop() {
+	c.t.Helper()
+	c.conn.Close()
+	timeout := time.After(testTimeout)
+	for {
+		resumes.lock.Lock()
+		_, waiting := resumes.waiting[resumes.clients[c.resume]]
+		resumes.lock.Unlock()
+		if waiting {
+			return
+		}
+		select {
+		case <-timeout:
+			c.t.Fatalf("%s: timed out waiting for the server to notice the connection is gone", c.nickname)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// leaves like a client would, and waits for the server to take it off
+func (c *testClient) close() {
+	c.t.Helper()
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.conn.Close()
+	timeout := time.After(testTimeout)
+	for {
+		if _, ok := users.find(c.nickname); !ok {
+			return
+		}
+		select {
+		case <-timeout:
+			c.t.Fatalf("%s: timed out waiting for the server to take it off", c.nickname)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
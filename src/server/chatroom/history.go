@@ -0,0 +1,160 @@
+package chatroom
+
+import (
+	"sync"
+)
+
+// how many messages a room remembers, can be changed before the server starts
+var HistorySize = 1000
+
+// the messages that were posted to a room, along with their reactions
+// other rooms may read it (for searching, unread counts...), so it has its own lock
+type roomHistory struct {
+	lock      sync.RWMutex
+	messages  []Message                             // oldest first
+	reactions map[uint64]map[string]map[string]bool // message id -> emoji -> nicknames that reacted
+}
+
+func newRoomHistory() *roomHistory {
+	return &roomHistory{
+		reactions: make(map[uint64]map[string]map[string]bool),
+	}
+}
+
+// remembers a message, forgetting the oldest one if there are too many
+func (h *roomHistory) add(message Message) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.messages = append(h.messages, message)
+	if len(h.messages) > HistorySize {
+		forgotten := h.messages[0]
+		delete(h.reactions, forgotten.Id)
+		h.messages = h.messages[1:]
+	}
+}
+
+// gets a message by its id
+func (h *roomHistory) find(id uint64) (Message, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, m := range h.messages {
+		if m.Id == id {
+			m.Reactions = h.countReactions(id)
+			return m, true
+		}
+	}
+	return Message{}, false
+}
+
+// a copy of every remembered message, oldest first
+func (h *roomHistory) all() []Message {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	messages := make([]Message, len(h.messages))
+	copy(messages, h.messages)
+	return messages
+}
+
+// a copy of the remembered messages after a message id, oldest first
+func (h *roomHistory) since(id uint64) []Message {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	var messages []Message
+	for _, m := range h.messages {
+		if m.Id > id {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// adds a reaction to a message
+// returns false if the user already reacted with that emoji
+func (h *roomHistory) addReaction(id uint64, emoji string, nickname string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	byEmoji, ok := h.reactions[id]
+	if !ok {
+		byEmoji = make(map[string]map[string]bool)
+		h.reactions[id] = byEmoji
+	}
+	nicks, ok := byEmoji[emoji]
+	if !ok {
+		nicks = make(map[string]bool)
+		byEmoji[emoji] = nicks
+	}
+	if nicks[nickname] {
+		return false
+	}
+	nicks[nickname] = true
+	return true
+}
+
+// removes a reaction from a message
+// returns false if the user never reacted with that emoji
+func (h *roomHistory) removeReaction(id uint64, emoji string, nickname string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	nicks, ok := h.reactions[id][emoji]
+	if !ok || !nicks[nickname] {
+		return false
+	}
+	delete(nicks, nickname)
+	if len(nicks) == 0 {
+		delete(h.reactions[id], emoji)
+	}
+	if len(h.reactions[id]) == 0 {
+		delete(h.reactions, id)
+	}
+	return true
+}
+
+// the number of users who reacted with each emoji to a message
+func (h *roomHistory) reactionCounts(id uint64) map[string]int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.countReactions(id)
+}
+
+// same as reactionCounts, the caller must hold the lock
+func (h *roomHistory) countReactions(id uint64) map[string]int {
+	counts := make(map[string]int)
+	for emoji, nicks := range h.reactions[id] {
+		counts[emoji] = len(nicks)
+	}
+	return counts
+}
+
+// every remembered message in the thread that the given message is part of, oldest first
+// the first message is the start of the thread
+func (h *roomHistory) thread(id uint64) []Message {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	byId := make(map[uint64]Message, len(h.messages))
+	for _, m := range h.messages {
+		byId[m.Id] = m
+	}
+	if _, ok := byId[id]; !ok {
+		return nil
+	}
+	// walk up to the start of the thread
+	root := id
+	for {
+		parent, ok := byId[byId[root].ReplyTo]
+		if !ok {
+			break
+		}
+		root = parent.Id
+	}
+	// replies always come after what they reply to, so one pass finds the whole thread
+	inThread := map[uint64]bool{root: true}
+	var messages []Message
+	for _, m := range h.messages {
+		if m.Id == root || (m.ReplyTo != 0 && inThread[m.ReplyTo]) {
+			inThread[m.Id] = true
+			m.Reactions = h.countReactions(m.Id)
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
@@ -0,0 +1,230 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"irc-final-project/logging"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// file the ignore lists are saved to, empty to keep them in memory only
+var IgnoreFile = "ignores.json"
+
+// who each user doesn't want to hear from
+// the lists of connected users belong to their nicknames, and are forgotten when they leave the server
+// anyone can connect with any nickname, so only operators, who proved who they are with /oper, have their lists saved
+type ignoreStore struct {
+	lock    sync.RWMutex
+	ignored map[string]map[string]bool // nickname -> ignored nicknames
+	saved   map[string][]string        // operator name -> ignored nicknames, what's in IgnoreFile
+}
+
+var ignores = ignoreStore{ignored: make(map[string]map[string]bool), saved: make(map[string][]string)}
+
+// loads the saved ignore lists of operators from IgnoreFile
+// a missing file is fine, nobody has ignored anyone yet
+func LoadIgnores() error {
+	if IgnoreFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(IgnoreFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved map[string][]string
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %w", IgnoreFile, err)
+	}
+	ignores.lock.Lock()
+	defer ignores.lock.Unlock()
+	ignores.saved = saved
+	return nil
+}
+
+// saves a client's ignore list to IgnoreFile if they are an operator, the caller must hold the lock
+// if it can't be saved, nothing is changed
+func (s *ignoreStore) save(c *Client) error {
+	if IgnoreFile == "" || c.operName == "" {
+		return nil
+	}
+	saved := make(map[string][]string, len(s.saved)+1)
+	for name, nicks := range s.saved {
+		saved[name] = nicks
+	}
+	if list := s.sortedList(c.Nickname); len(list) > 0 {
+		saved[c.operName] = list
+	} else {
+		delete(saved, c.operName)
+	}
+	if err := saveJSON(IgnoreFile, saved); err != nil {
+		return err
+	}
+	s.saved = saved
+	return nil
+}
+
+// makes a client ignore a user, returns false if they already did
+// if it can't be saved, the user isn't ignored
+func (s *ignoreStore) add(c *Client, ignored string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ignored[c.Nickname][ignored] {
+		return false, nil
+	}
+	s.set(c.Nickname, ignored, true)
+	if err := s.save(c); err != nil {
+		s.set(c.Nickname, ignored, false)
+		return false, err
+	}
+	return true, nil
+}
+
+// makes a client stop ignoring a user, returns false if they weren't ignoring them
+// if it can't be saved, the user stays ignored
+func (s *ignoreStore) remove(c *Client, ignored string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.ignored[c.Nickname][ignored] {
+		return false, nil
+	}
+	s.set(c.Nickname, ignored, false)
+	if err := s.save(c); err != nil {
+		s.set(c.Nickname, ignored, true)
+		return false, err
+	}
+	return true, nil
+}
+
+// ignores a user or stops ignoring them, the caller must hold the lock
+func (s *ignoreStore) set(nickname string, ignored string, ignore bool) {
+	if !ignore {
+		delete(s.ignored[nickname], ignored)
+		if len(s.ignored[nickname]) == 0 {
+			delete(s.ignored, nickname)
+		}
+		return
+	}
+	if s.ignored[nickname] == nil {
+		s.ignored[nickname] = make(map[string]bool)
+	}
+	s.ignored[nickname][ignored] = true
+}
+
+// gives a client that just became an operator the ignore list saved for their operator name
+// it is added to what they ignored so far, which is then saved too
+func (s *ignoreStore) restore(c *Client) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, nick := range s.saved[c.operName] {
+		s.set(c.Nickname, nick, true)
+	}
+	if len(s.ignored[c.Nickname]) == len(s.saved[c.operName]) {
+		// nothing new to save
+		return nil
+	}
+	return s.save(c)
+}
+
+// forgets the ignore list of someone who left the server, saved ones stay saved
+func (s *ignoreStore) forget(nickname string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.ignored, nickname)
+}
+
+// checks if a user ignores another one
+func (s *ignoreStore) has(nickname string, ignored string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.ignored[nickname][ignored]
+}
+
+// the users someone ignores, sorted
+func (s *ignoreStore) list(nickname string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.sortedList(nickname)
+}
+
+// same as list, the caller must hold the lock
+func (s *ignoreStore) sortedList(nickname string) []string {
+	nicks := make([]string, 0, len(s.ignored[nickname]))
+	for nick := range s.ignored[nickname] {
+		nicks = append(nicks, nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// checks if a message should be kept from a client because they ignore its sender
+// messages from the server itself always get through
+func ignoredBy(c *Client, message Message) bool {
+	return message.FromNick != c.Nickname && ignores.has(c.Nickname, message.FromNick)
+}
+
+// ignores a user, or lists the ignored users: `/ignore nickname` or `/ignore list`
+func ignore(r *Room, c *Client, args Args) *CommandError {
+	nickname := args.String("nickName")
+	if nickname == "list" {
+		var builder strings.Builder
+		builder.WriteString("\nIgnored users:\n")
+		builder.WriteString("---------\n")
+		for _, nick := range ignores.list(c.Nickname) {
+			builder.WriteString(nick + "\n")
+		}
+		c.ServerDirectMessage(r.serverMessage(builder.String()))
+		return nil
+	}
+	if nickname == c.Nickname {
+		return &CommandError{
+			CommandName: "ignore",
+			Reason:      "You can't ignore yourself",
+		}
+	}
+	added, err := ignores.add(c, nickname)
+	if err != nil {
+		r.logEvent(logging.LevelError, "save-ignores", c, logging.Fields{"error": err})
+		return &CommandError{
+			CommandName: "ignore",
+			Reason:      fmt.Sprintf("Could not save your ignore list, you are not ignoring %s", nickname),
+		}
+	}
+	if !added {
+		return &CommandError{
+			CommandName: "ignore",
+			Reason:      fmt.Sprintf("You are already ignoring %s", nickname),
+		}
+	}
+	c.ServerDirectMessage(r.serverMessage(fmt.Sprintf("You will no longer see messages from %s", nickname)))
+	r.Logf("%s ignored %s\n", c.Nickname, nickname)
+	return nil
+}
+
+// stops ignoring a user: `/unignore nickname`
+func unignore(r *Room, c *Client, args Args) *CommandError {
+	nickname := args.String("nickName")
+	removed, err := ignores.remove(c, nickname)
+	if err != nil {
+		r.logEvent(logging.LevelError, "save-ignores", c, logging.Fields{"error": err})
+		return &CommandError{
+			CommandName: "unignore",
+			Reason:      fmt.Sprintf("Could not save your ignore list, you are still ignoring %s", nickname),
+		}
+	}
+	if !removed {
+		return &CommandError{
+			CommandName: "unignore",
+			Reason:      fmt.Sprintf("You are not ignoring %s", nickname),
+		}
+	}
+	c.ServerDirectMessage(r.serverMessage(fmt.Sprintf("You will see messages from %s again", nickname)))
+	r.Logf("%s stopped ignoring %s\n", c.Nickname, nickname)
+	return nil
+}
@@ -0,0 +1,784 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCommands(t *testing.T) {
+	srv := newTestServer(t)
+	alice := dial(t, srv, "/ws/commands", "cmd-alice")
+	bob := dial(t, srv, "/ws/commands", "cmd-bob")
+	alice.expect("<cmd-bob> joined commands")
+
+	tests := []struct {
+		name string
+		line string
+		want []string // each is in one of the replies, in order
+	}{
+		{"help", "/help", []string{"Use /help command to learn more about one."}},
+		{"help for a command", "/help whisper", []string{"Direct message a user with the given nickname."}},
+		{"help for an alias", "/? w", []string{"/whisper nickName message"}},
+		{"unknown help", "/help nope", []string{"Command `nope` does not exist"}},
+		{"listusers", "/listusers", []string{"Users:"}},
+		{"listallusers", "/listallusers", []string{"All Users:"}},
+		{"listrooms", "/listrooms", []string{"commands (* joined)"}},
+		{"make", "/make commands-made", []string{"Successfully made new room `commands-made`"}},
+		{"make twice", "/make commands-made", []string{"Room `commands-made` already exists"}},
+		{"made room is listed", "/rooms", []string{"commands-made\n"}},
+		{"unknown command", "/nope", []string{"Command not found: /nope"}},
+		{"missing argument", "/whisper", []string{"Missing argument `nickName`"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice.t = t
+			alice.send(tt.line)
+			for _, want := range tt.want {
+				alice.expect(want)
+			}
+		})
+	}
+
+	t.Run("listusers marks the caller", func(t *testing.T) {
+		bob.t = t
+		bob.send("/listusers")
+		users := bob.expect("Users:")
+		for _, want := range []string{"cmd-alice\n", "cmd-bob (* you)"} {
+			if !strings.Contains(users.Content, want) {
+				t.Errorf("listusers = %q, want it to contain %q", users.Content, want)
+			}
+		}
+	})
+	t.Run("listallusers has users of other rooms", func(t *testing.T) {
+		bob.t = t
+		carol := dial(t, srv, "/ws/commands-elsewhere", "cmd-carol")
+		bob.send("/listallusers")
+		users := bob.expect("All Users:")
+		for _, want := range []string{"cmd-alice\n", "cmd-bob (* you)", "cmd-carol\n"} {
+			if !strings.Contains(users.Content, want) {
+				t.Errorf("listallusers = %q, want it to contain %q", users.Content, want)
+			}
+		}
+		carol.close()
+	})
+}
+
+func TestChat(t *testing.T) {
+	srv := newTestServer(t)
+	alice := dial(t, srv, "/ws/chat", "chat-alice")
+	bob := dial(t, srv, "/ws/chat", "chat-bob")
+	outside := dial(t, srv, "/ws/chat-elsewhere", "chat-outside")
+
+	alice.send("hello everyone")
+	for _, c := range []*testClient{alice, bob} {
+		m := c.expect("hello everyone")
+		if m.FromNick != "chat-alice" || m.Kind != KindChat || m.IsDirectMessage {
+			t.Errorf("%s got %+v, want a chat message from chat-alice", c.nickname, m)
+		}
+	}
+	outside.send("/listusers")
+	if m := outside.expect("Users:"); strings.Contains(m.Content, "chat-alice") {
+		t.Errorf("another room's users = %q, want it without chat-alice", m.Content)
+	}
+}
+
+func TestWhisper(t *testing.T) {
+	srv := newTestServer(t)
+	alice := dial(t, srv, "/ws/whisper", "whisper-alice")
+	// whispers reach other rooms too
+	bob := dial(t, srv, "/ws/whisper-elsewhere", "whisper-bob")
+	carol := dial(t, srv, "/ws/whisper", "whisper-carol")
+
+	alice.send("/whisper whisper-bob just between us")
+	m := bob.expect("just between us")
+	if !m.IsDirectMessage || m.FromNick != "whisper-alice" {
+		t.Errorf("bob got %+v, want a direct message from whisper-alice", m)
+	}
+	alice.send("/w whisper-nobody hello?")
+	alice.expect("Target client whisper-nobody does not exist, or is offline")
+
+	// carol was in the room all along, but only bob was whispered to
+	carol.send("/listusers")
+	carol.expectMessage("the room's users, without the whisper", func(m Message) bool {
+		if strings.Contains(m.Content, "just between us") {
+			t.Errorf("carol got the whisper: %+v", m)
+		}
+		return strings.Contains(m.Content, "Users:")
+	})
+}
+
+func TestJoin(t *testing.T) {
+	srv := newTestServer(t)
+	alice := dial(t, srv, "/ws/join-from", "join-alice")
+	bob := dial(t, srv, "/ws/join-from", "join-bob")
+	carol := dial(t, srv, "/ws/join-to", "join-carol")
+
+	alice.send("/join join-to")
+	// the client is told the name of its new room
+	alice.expectSwitch("join-to")
+	// anything sent before they are in goes to the old room
+	alice.expect("<join-alice> joined join-to")
+	bob.expect("<join-alice> left join-from (switched rooms)")
+	carol.expect("<join-alice> joined join-to")
+
+	alice.send("hello new room")
+	carol.expect("hello new room")
+	bob.send("anyone left?")
+	bob.expect("anyone left?")
+	alice.send("/listusers")
+	users := alice.expect("Users:")
+	if strings.Contains(users.Content, "join-bob") || !strings.Contains(users.Content, "join-carol") {
+		t.Errorf("users after joining = %q, want join-carol without join-bob", users.Content)
+	}
+
+	alice.send("/join join-nowhere")
+	alice.expect("Room `join-nowhere` does not exist")
+}
+
+func TestJoinBothWays(t *testing.T) {
+	srv := newTestServer(t)
+	// rooms swapping users at the same time must not wait on each other
+	var clients []*testClient
+	for i := 0; i < 10; i++ {
+		clients = append(clients, dial(t, srv, fmt.Sprintf("/ws/swap-%d", i%2), fmt.Sprintf("swap-%d", i)))
+	}
+	for round := 0; round < 5; round++ {
+		for i, c := range clients {
+			c.send(fmt.Sprintf("/join swap-%d", (i+round+1)%2))
+		}
+		for i, c := range clients {
+			room := fmt.Sprintf("swap-%d", (i+round+1)%2)
+			c.expectSwitch(room)
+			c.expect(fmt.Sprintf("<%s> joined %s", c.nickname, room))
+		}
+	}
+	for _, c := range clients {
+		c.send("/listrooms")
+		c.expect("(* joined)")
+	}
+}
+
+func TestExit(t *testing.T) {
+	srv := newTestServer(t)
+	alice := dial(t, srv, "/ws/exit", "exit-alice")
+	bob := dial(t, srv, "/ws/exit", "exit-bob")
+
+	alice.send("/exit")
+	alice.expectClosed()
+	bob.expect("<exit-alice> left exit (disconnected)")
+
+	// the room carries on without them
+	bob.send("/listusers")
+	if users := bob.expect("Users:"); strings.Contains(users.Content, "exit-alice") {
+		t.Errorf("users after exit = %q, want it without exit-alice", users.Content)
+	}
+	bob.send("/whisper exit-alice are you there?")
+	bob.expect("Target client exit-alice does not exist, or is offline")
+
+	// and their nickname is free again
+	again := dial(t, srv, "/ws/exit", "exit-alice")
+	if again.nickname != "exit-alice" {
+		t.Errorf("nickname after exit = %s, want exit-alice", again.nickname)
+	}
+}
+
+func TestDirectMessageRoute(t *testing.T) {
+	srv := newTestServer(t)
+	alice := dial(t, srv, "/ws/route-alice/route-bob", "route-alice")
+	bob := dial(t, srv, "/ws/route-bob/route-alice", "route-bob")
+
+	// both ways round lead to the same room
+	alice.expect("<route-bob> joined route-bob-route-alice")
+	alice.send("hi bob")
+	bob.expect("hi bob")
+	bob.send("hi alice")
+	alice.expect("hi alice")
+
+	// nobody else can join it
+	carol := dial(t, srv, "/ws/route-elsewhere", "route-carol")
+	for _, name := range []string{"route-alice-route-bob", "route-bob-route-alice"} {
+		carol.send("/join " + name)
+		carol.expect("is private")
+	}
+	// or connect to it
+	for _, path := range []string{"/ws/route-alice-route-bob", "/ws/route-bob-route-alice", "/ws/route-alice/route-bob", "/ws/route-bob/route-alice"} {
+		if status := dialRefused(t, srv, path, "route-eve"); status != http.StatusForbidden {
+			t.Errorf("dial %s as route-eve: status %d, want %d", path, status, http.StatusForbidden)
+		}
+	}
+	// not even as a member's nickname, which it gets with `_2` at the end
+	conn, _, err := websocket.DefaultDialer.Dial(wsUrl(srv, "/ws/route-alice/route-bob", "route-alice"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("second route-alice: %v, want to be closed", err)
+	}
+	alice.send("still private")
+	bob.expect("still private")
+}
+
+func TestNicknameCollision(t *testing.T) {
+	srv := newTestServer(t)
+	first := dial(t, srv, "/ws/collision", "same")
+	// nicknames are unique on the whole server, not just in a room
+	second := dial(t, srv, "/ws/collision-elsewhere", "same")
+	third := dial(t, srv, "/ws/collision", "same")
+	spaced := dial(t, srv, "/ws/collision", "same 2")
+	for _, tt := range []struct {
+		client *testClient
+		want   string
+	}{
+		{first, "same"},
+		{second, "same_2"},
+		{third, "same_3"},
+		// spaces become underscores, and that nickname is taken
+		{spaced, "same_2_2"},
+	} {
+		if tt.client.nickname != tt.want {
+			t.Errorf("nickname = %s, want %s", tt.client.nickname, tt.want)
+		}
+	}
+
+	third.send("/whisper same_2 found you")
+	second.expect("found you")
+
+	t.Run("at the same time", func(t *testing.T) {
+		const count = 20
+		clients := make([]*testClient, count)
+		var wg sync.WaitGroup
+		for i := range clients {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				clients[i] = dial(t, srv, fmt.Sprintf("/ws/crowd-%d", i%3), "crowd")
+			}(i)
+		}
+		wg.Wait()
+		seen := make(map[string]bool)
+		for _, c := range clients {
+			if c == nil {
+				t.FailNow()
+			}
+			if seen[c.nickname] {
+				t.Errorf("nickname %s was given twice", c.nickname)
+			}
+			seen[c.nickname] = true
+		}
+	})
+}
+
+func TestProtocols(t *testing.T) {
+	srv := newTestServer(t)
+	tests := []struct {
+		name  string
+		asked []string // what the client asks for, in order
+		want  string   // what the server agrees to, empty for no Sec-WebSocket-Protocol
+	}{
+		{"none", nil, ""},
+		{"legacy", []string{ProtocolLegacy}, ProtocolLegacy},
+		{"v2", []string{ProtocolV2}, ProtocolV2},
+		{"cbor", []string{ProtocolV2Cbor}, ProtocolV2Cbor},
+		{"the newest", []string{ProtocolLegacy, ProtocolV2}, ProtocolV2},
+		{"binary over text", []string{ProtocolV2, ProtocolV2Cbor}, ProtocolV2Cbor},
+		{"unknown ones are skipped", []string{"chat.v9", ProtocolV2}, ProtocolV2},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := fmt.Sprintf("protocol-%d", i), fmt.Sprintf("protocol-%d-to", i)
+			c := dialWith(t, srv, "/ws/"+from, "protocol", tt.asked...)
+			if got := c.conn.Subprotocol(); got != tt.want {
+				t.Fatalf("subprotocol = %q, want %q", got, tt.want)
+			}
+			c.send("/help")
+			c.expect("Use /help command to learn more about one.")
+			c.send("/make " + to)
+			c.expect("Successfully made new room")
+			c.send("/join " + to)
+			c.expectSwitch(to)
+			c.expect(fmt.Sprintf("<%s> joined %s", c.nickname, to))
+			// plenty of messages, so some are sent together
+			for j := 0; j < 20; j++ {
+				c.send(fmt.Sprint("message ", j))
+			}
+			for j := 0; j < 20; j++ {
+				c.expect(fmt.Sprint("message ", j))
+			}
+			c.close()
+		})
+	}
+}
+
+func TestUnread(t *testing.T) {
+	srv := newTestServer(t)
+	alice := dial(t, srv, "/ws/unread", "unread-alice")
+	bob := dial(t, srv, "/ws/unread", "unread-bob")
+	dial(t, srv, "/ws/unread-elsewhere", "unread-carol")
+	alice.expect("<unread-bob> joined unread")
+	bob.send("/join unread-elsewhere")
+	bob.expectSwitch("unread-elsewhere")
+	alice.expect("<unread-bob> left unread")
+
+	// waits for bob to be told how much is unread in the room he left
+	expectUnread := func(unread int, mentions int) {
+		t.Helper()
+		want := RoomUnread{Room: "unread", Unread: unread, Mentions: mentions}
+		bob.expectMessage(fmt.Sprintf("unread counts %+v", want), func(m Message) bool {
+			for _, u := range m.Unread {
+				if u == want {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	alice.send("first")
+	first := alice.expect("first")
+	expectUnread(1, 0)
+	alice.send("second, unread-bob")
+	alice.expect("second")
+	expectUnread(2, 1)
+	alice.send("third")
+	alice.expect("third")
+	expectUnread(3, 1)
+
+	// reading up to a message leaves what came after it unread
+	bob.send(fmt.Sprintf("/markread unread %d", first.Id))
+	expectUnread(2, 1)
+	bob.send("/markread unread")
+	expectUnread(0, 0)
+	// his own messages aren't unread
+	bob.send("/join unread")
+	bob.expectSwitch("unread")
+	bob.send("mine")
+	bob.send("/join unread-elsewhere")
+	bob.expectSwitch("unread-elsewhere")
+	alice.send("fourth")
+	expectUnread(1, 0)
+}
+
+func TestSearchEndpoint(t *testing.T) {
+	srv := newTestServer(t)
+	alice := dial(t, srv, "/ws/search-alice/search-bob", "search-alice")
+	eve := dial(t, srv, "/ws/search-elsewhere", "search-eve")
+	alice.send("the password is swordfish")
+	alice.expect("swordfish")
+
+	// searches the dm room with some query parameters, returns the status and how many messages were found
+	search := func(params url.Values) (int, int) {
+		t.Helper()
+		params.Set("q", "swordfish")
+		params.Set("room", "search-bob-search-alice")
+		resp, err := http.Get(srv.URL + "/search?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var results SearchResults
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, results.Total
+	}
+	tests := []struct {
+		name       string
+		params     url.Values
+		wantStatus int
+		wantTotal  int
+	}{
+		{"member", url.Values{"session": {alice.session}}, http.StatusOK, 1},
+		{"not a member", url.Values{"session": {eve.session}}, http.StatusForbidden, 0},
+		// the nickname parameter doesn't say who is searching anymore
+		{"claiming to be a member", url.Values{"session": {eve.session}, "nickname": {"search-alice"}}, http.StatusForbidden, 0},
+		{"no session", url.Values{"nickname": {"search-alice"}}, http.StatusUnauthorized, 0},
+		{"unknown session", url.Values{"session": {"nope"}}, http.StatusUnauthorized, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, total := search(tt.params)
+			if status != tt.wantStatus || total != tt.wantTotal {
+				t.Errorf("search = %d with %d results, want %d with %d", status, total, tt.wantStatus, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestIgnoreSaving(t *testing.T) {
+	srv := newTestServer(t)
+	dir := t.TempDir()
+	IgnoreFile = filepath.Join(dir, "ignores.json")
+	Operators = map[string]string{"ignore-admin": "secret"}
+	t.Cleanup(func() {
+		IgnoreFile = ""
+		Operators = make(map[string]string)
+		ignores.lock.Lock()
+		ignores.saved = make(map[string][]string)
+		ignores.lock.Unlock()
+	})
+	// what's saved in the ignore file
+	saved := func() map[string][]string {
+		t.Helper()
+		data, err := os.ReadFile(IgnoreFile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lists map[string][]string
+		if err := json.Unmarshal(data, &lists); err != nil {
+			t.Fatal(err)
+		}
+		return lists
+	}
+
+	// anyone can use any nickname, so only operators' lists are saved
+	alice := dial(t, srv, "/ws/ignores", "ignore-alice")
+	alice.send("/ignore ignore-mallory")
+	alice.expect("You will no longer see messages from ignore-mallory")
+	if lists := saved(); lists != nil {
+		t.Errorf("saved %v, want nothing", lists)
+	}
+
+	// an operator's list is saved under their operator name
+	admin := dial(t, srv, "/ws/ignores", "ignore-op")
+	admin.send("/oper ignore-admin secret")
+	admin.expect("You are now an operator")
+	admin.send("/ignore ignore-mallory")
+	admin.expect("You will no longer see messages from ignore-mallory")
+	if lists := saved(); !reflect.DeepEqual(lists, map[string][]string{"ignore-admin": {"ignore-mallory"}}) {
+		t.Errorf("saved %v, want ignore-admin's list", lists)
+	}
+
+	// and comes back when they log in again, whatever their nickname
+	admin.close()
+	alice.close()
+	again := dial(t, srv, "/ws/ignores", "ignore-alice")
+	again.send("/ignore list")
+	if list := again.expect("Ignored users:"); strings.Contains(list.Content, "ignore-mallory") {
+		t.Errorf("ignore list of a new ignore-alice = %q, want it empty", list.Content)
+	}
+	again.send("/oper ignore-admin secret")
+	again.expect("You are now an operator")
+	again.send("/ignore list")
+	if list := again.expect("Ignored users:"); !strings.Contains(list.Content, "ignore-mallory") {
+		t.Errorf("ignore list after /oper = %q, want ignore-mallory", list.Content)
+	}
+
+	// a list that can't be saved isn't changed
+	IgnoreFile = filepath.Join(dir, "missing", "ignores.json")
+	again.send("/ignore ignore-trudy")
+	again.expect("Could not save your ignore list, you are not ignoring ignore-trudy")
+	again.send("/unignore ignore-mallory")
+	again.expect("Could not save your ignore list, you are still ignoring ignore-mallory")
+	again.send("/ignore list")
+	if list := again.expect("Ignored users:"); !strings.HasSuffix(list.Content, "---------\nignore-mallory\n") {
+		t.Errorf("ignore list after failing to save = %q, want only ignore-mallory", list.Content)
+	}
+}
+
+func TestHighlightsForgotten(t *testing.T) {
+	srv := newTestServer(t)
+	Operators = map[string]string{"highlight-admin": "secret"}
+	t.Cleanup(func() {
+		Operators = make(map[string]string)
+	})
+	alice := dial(t, srv, "/ws/highlights", "highlight-alice")
+	bob := dial(t, srv, "/ws/highlights", "highlight-bob")
+	alice.send("/highlight add pancakes")
+	alice.expect("Messages containing `pancakes` will be highlighted")
+	bob.send("who wants pancakes?")
+	if m := alice.expect("who wants pancakes?"); !m.Highlight {
+		t.Errorf("got %+v, want it highlighted", m)
+	}
+	alice.send("/mentions")
+	alice.expect("Recent mentions (1)")
+
+	// the next user of the nickname starts without them
+	alice.close()
+	again := dial(t, srv, "/ws/highlights", "highlight-alice")
+	again.send("/highlight list")
+	if list := again.expect("Highlight keywords:"); strings.Contains(list.Content, "pancakes") {
+		t.Errorf("keywords of a new highlight-alice = %q, want none", list.Content)
+	}
+	again.send("/mentions")
+	again.expect("Recent mentions (0)")
+
+	// an operator's keywords come back when they log in again, whatever their nickname
+	again.send("/oper highlight-admin secret")
+	again.expect("You are now an operator")
+	again.send("/highlight add waffles")
+	again.expect("Messages containing `waffles` will be highlighted")
+	again.close()
+	carol := dial(t, srv, "/ws/highlights", "highlight-carol")
+	carol.send("/oper highlight-admin secret")
+	carol.expect("You are now an operator")
+	carol.send("/highlight list")
+	if list := carol.expect("Highlight keywords:"); !strings.Contains(list.Content, "waffles") {
+		t.Errorf("keywords after /oper = %q, want waffles", list.Content)
+	}
+}
+
+func TestSearchCommand(t *testing.T) {
+	srv := newTestServer(t)
+	alice := dial(t, srv, "/ws/search-here", "search-cmd-alice")
+	bob := dial(t, srv, "/ws/search-there", "search-cmd-bob")
+	alice.send("I'm looking for a needle")
+	alice.expect("needle")
+	bob.send("there's a needle here too")
+	bob.expect("needle")
+
+	tests := []struct {
+		name string
+		line string
+		want []string // each is in the results
+		not  []string // none is
+	}{
+		{"current room", "/search needle", []string{"there's a needle here too"}, []string{"I'm looking"}},
+		{"room as the first word", "/search search-here needle", []string{"I'm looking for a needle"}, []string{"here too"}},
+		{"every room", "/search * needle", []string{"I'm looking", "here too"}, nil},
+		{"room option", "/search --room search-here needle", []string{"I'm looking"}, []string{"here too"}},
+		{"all option", "/search -a needle", []string{"I'm looking", "here too"}, nil},
+		{"apostrophes", "/search there's a", []string{"there's a needle here too"}, nil},
+		// a room name alone is what is searched for
+		{"only a room name", "/search search-here", []string{"No messages found"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bob.t = t
+			bob.send(tt.line)
+			results := bob.expectMessage("search results", func(m Message) bool {
+				return strings.Contains(m.Content, "Search results") || strings.Contains(m.Content, "No messages found")
+			})
+			for _, want := range tt.want {
+				if !strings.Contains(results.Content, want) {
+					t.Errorf("%s = %q, want it to contain %q", tt.line, results.Content, want)
+				}
+			}
+			for _, not := range tt.not {
+				if strings.Contains(results.Content, not) {
+					t.Errorf("%s = %q, want it without %q", tt.line, results.Content, not)
+				}
+			}
+		})
+	}
+}
+
+func TestRoomOwner(t *testing.T) {
+	srv := newTestServer(t)
+	// so a nickname is free as soon as its client leaves
+	grace := ResumeGrace
+	ResumeGrace = 0
+	Operators = map[string]string{"owner-admin": "secret"}
+	t.Cleanup(func() {
+		ResumeGrace = grace
+		Operators = make(map[string]string)
+	})
+	alice := dial(t, srv, "/ws/owner-lobby", "owner-alice")
+	alice.send("/make owner-room --modes t")
+	alice.expect("Successfully made new room `owner-room`")
+	alice.send("/join owner-room")
+	alice.expectSwitch("owner-room")
+	alice.send("/topic mine")
+	alice.expect("changed the topic to: mine")
+
+	bob := dial(t, srv, "/ws/owner-room", "owner-bob")
+	bob.send("/topic yours")
+	bob.expect("Only the owner of owner-room and operators can change its topic")
+
+	// the room belongs to alice's connection, not to her nickname
+	alice.close()
+	bob.expect("<owner-alice> left owner-room")
+	eve := dial(t, srv, "/ws/owner-room", "owner-alice")
+	if eve.nickname != "owner-alice" {
+		t.Fatalf("connected as %s, want owner-alice", eve.nickname)
+	}
+	eve.send("/topic taken over")
+	eve.expect("Only the owner of owner-room and operators can change its topic")
+
+	// persistent rooms outlive their maker's connection, so only operators make them
+	eve.send("/make owner-kept --persist")
+	eve.expect("Only operators can make persistent rooms")
+	eve.send("/oper owner-admin secret")
+	eve.expect("You are now an operator")
+	eve.send("/make owner-kept --persist")
+	eve.expect("Successfully made new room `owner-kept`")
+	eve.send("/roominfo owner-kept")
+	eve.expect("Owner: owner-admin")
+}
+
+func TestBans(t *testing.T) {
+	srv := newTestServer(t)
+	grace := ResumeGrace
+	ResumeGrace = 0
+	Operators = map[string]string{"ban-admin": "secret"}
+	t.Cleanup(func() {
+		ResumeGrace = grace
+		Operators = make(map[string]string)
+		bans.lock.Lock()
+		bans.banned = make(map[string]Ban)
+		bans.lock.Unlock()
+	})
+	admin := dial(t, srv, "/ws/ban-lobby", "ban-admin")
+	admin.send("/oper ban-admin secret")
+	admin.expect("You are now an operator")
+
+	// kicking someone in the room the command runs in, and in another room
+	bob := dial(t, srv, "/ws/ban-lobby", "ban-bob")
+	carol := dial(t, srv, "/ws/ban-other", "ban-carol")
+	dave := dial(t, srv, "/ws/ban-other", "ban-dave")
+	admin.send("/kick ban-bob flooding")
+	bob.expect("You were kicked (flooding) by ban-admin")
+	bob.expectClosed()
+	admin.expect("<ban-bob> was kicked (flooding) by ban-admin")
+	admin.send("/kick ban-carol")
+	carol.expectClosed()
+	dave.expect("<ban-carol> was kicked by ban-admin")
+	admin.expect("Kicked ban-carol")
+
+	// everyone here connects from the same address, so only the nickname is banned
+	bob = dial(t, srv, "/ws/ban-lobby", "ban-bob")
+	admin.send("/ban ban-bob spam")
+	admin.expect("Banned ban-bob, but not their address")
+	bob.expectClosed()
+	if status := dialRefused(t, srv, "/ws/ban-lobby", "ban-bob"); status != http.StatusForbidden {
+		t.Errorf("banned nickname got status %d, want %d", status, http.StatusForbidden)
+	}
+	admin.send("/ban 127.0.0.1")
+	admin.expect("You are connected from that address")
+	admin.send("/ban list")
+	admin.expect("ban-bob, by ban-admin on")
+	admin.send("/unban ban-bob")
+	admin.expect("Unbanned ban-bob")
+	dial(t, srv, "/ws/ban-lobby", "ban-bob")
+
+	// an address turns away every nickname connecting from it
+	if _, err := bans.add(Ban{Address: "203.0.113.7", By: "ban-admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bans.find("ban-erin", "203.0.113.7"); !ok {
+		t.Errorf("ban-erin from a banned address was let in")
+	}
+	if _, ok := bans.find("ban-erin", "203.0.113.8"); ok {
+		t.Errorf("ban-erin from another address was turned away")
+	}
+	admin.send("/unban 203.0.113.7")
+	admin.expect("Unbanned 203.0.113.7")
+	if _, ok := bans.find("", "203.0.113.7"); ok {
+		t.Errorf("203.0.113.7 is still banned after /unban")
+	}
+}
+
+func TestResume(t *testing.T) {
+	srv := newTestServer(t)
+	alice := dial(t, srv, "/ws/resume", "resume-alice")
+	// whispers come from other rooms too
+	bob := dial(t, srv, "/ws/resume-elsewhere", "resume-bob")
+	carol := dial(t, srv, "/ws/resume", "resume-carol")
+	if alice.resume == "" {
+		t.Fatal("no resume token in the session message")
+	}
+
+	alice.drop()
+	bob.send("/whisper resume-alice are you there?")
+	bob.expect("are you there?")
+	carol.send("while you were gone")
+	carol.expect("while you were gone")
+
+	// the session message comes first, then what was missed
+	back := dialResume(t, srv, alice.resume)
+	if back.nickname != "resume-alice" {
+		t.Errorf("resumed as %s, want resume-alice", back.nickname)
+	}
+	if back.resume == "" || back.resume == alice.resume {
+		t.Errorf("resumed with resume token %q, want a new one", back.resume)
+	}
+	whisper := back.expect("are you there?")
+	if !whisper.IsDirectMessage || whisper.FromNick != "resume-bob" {
+		t.Errorf("got %+v, want the whisper from resume-bob", whisper)
+	}
+	back.expect("while you were gone")
+	back.send("/listusers")
+	back.expect("resume-carol")
+
+	// carol never saw alice leave or come back
+	carol.send("still here")
+	carol.expectMessage("her own message", func(m Message) bool {
+		if strings.Contains(m.Content, "resume-alice") {
+			t.Errorf("carol was told about alice: %+v", m)
+		}
+		return strings.Contains(m.Content, "still here")
+	})
+	back.expect("still here")
+
+	// a token is only good once
+	if status := dialUrlRefused(t, resumeUrl(srv, alice.resume)); status != http.StatusGone {
+		t.Errorf("reused resume token got status %d, want %d", status, http.StatusGone)
+	}
+	// a client that is still connected can't be taken over
+	if status := dialUrlRefused(t, resumeUrl(srv, back.resume)); status != http.StatusGone {
+		t.Errorf("resume token of a connected client got status %d, want %d", status, http.StatusGone)
+	}
+}
+
+func TestRefusedLeavesNoRoom(t *testing.T) {
+	srv := newTestServer(t)
+	t.Cleanup(func() {
+		bans.lock.Lock()
+		bans.banned = make(map[string]Ban)
+		bans.lock.Unlock()
+	})
+	if _, err := bans.add(Ban{Nickname: "refused-bob", By: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	dial(t, srv, "/ws/refused-alice/refused-carol", "refused-alice")
+
+	for _, tt := range []struct {
+		name   string
+		url    string
+		room   string
+		status int
+	}{
+		{name: "banned", url: wsUrl(srv, "/ws/refused-banned", "refused-bob"), room: "refused-banned", status: http.StatusForbidden},
+		{name: "not a member", url: wsUrl(srv, "/ws/refused-dave/refused-eve", "refused-mallory"), room: "refused-eve-refused-dave", status: http.StatusForbidden},
+		{name: "stale resume token", url: wsUrl(srv, "/ws/refused-resume", "refused-bob") + "&resume=nope", room: "refused-resume", status: http.StatusGone},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := dialUrlRefused(t, tt.url); status != tt.status {
+				t.Errorf("status %d, want %d", status, tt.status)
+			}
+			if _, ok := FindRoom(tt.room); ok {
+				t.Errorf("room %s was left behind", tt.room)
+			}
+		})
+	}
+
+	// a request that isn't a websocket can't be upgraded
+	resp, err := http.Get(srv.URL + "/ws/refused-plain?nickname=refused-frank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, ok := FindRoom("refused-plain"); ok {
+		t.Errorf("room refused-plain was left behind")
+	}
+
+	// the room of the client that got in is still there
+	if _, ok := FindRoom("refused-carol-refused-alice"); !ok {
+		t.Errorf("room refused-carol-refused-alice is missing")
+	}
+}
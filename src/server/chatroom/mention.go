@@ -0,0 +1,271 @@
+package chatroom
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// how many recent mentions are remembered per user
+const maxRecentMentions = 50
+
+// checks if a word shows up in some text on its own, not as part of a longer word, ignoring case
+func containsWord(text string, word string) bool {
+	if word == "" {
+		return false
+	}
+	text, word = strings.ToLower(text), strings.ToLower(word)
+	for start := 0; start < len(text); {
+		i := strings.Index(text[start:], word)
+		if i < 0 {
+			return false
+		}
+		i += start
+		end := i + len(word)
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if (i == 0 || !isWordRune(before)) && (end == len(text) || !isWordRune(after)) {
+			return true
+		}
+		start = i + 1
+	}
+	return false
+}
+
+// checks if a message's content mentions a nickname, either as `@nick` or the bare nick
+func mentionsNickname(content string, nickname string) bool {
+	return containsWord(content, nickname)
+}
+
+// the keywords each user wants to be alerted about, besides their nickname
+// operators' keywords are kept by operator name when they leave, and given back by `/oper`
+type highlightStore struct {
+	lock     sync.RWMutex
+	keywords map[string][]string // nickname -> keywords
+	kept     map[string][]string // operator name -> keywords
+}
+
+var highlights = highlightStore{keywords: make(map[string][]string), kept: make(map[string][]string)}
+
+// adds a keyword for a user, returns false if they already have it
+func (s *highlightStore) add(nickname string, keyword string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, k := range s.keywords[nickname] {
+		if strings.EqualFold(k, keyword) {
+			return false
+		}
+	}
+	s.keywords[nickname] = append(s.keywords[nickname], keyword)
+	return true
+}
+
+// removes a keyword from a user, returns false if they didn't have it
+func (s *highlightStore) remove(nickname string, keyword string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keywords := s.keywords[nickname]
+	for i, k := range keywords {
+		if strings.EqualFold(k, keyword) {
+			s.keywords[nickname] = append(keywords[:i:i], keywords[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// forgets the keywords of someone who left the server, so the next user of the nickname doesn't get them
+// an operator's are kept for the next time they become one
+func (s *highlightStore) forget(c *Client) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if c.operName != "" && len(s.keywords[c.Nickname]) > 0 {
+		s.kept[c.operName] = s.keywords[c.Nickname]
+	}
+	delete(s.keywords, c.Nickname)
+}
+
+// gives a client that just became an operator the keywords they had the last time, on top of their own
+func (s *highlightStore) restore(c *Client) {
+	s.lock.Lock()
+	kept := s.kept[c.operName]
+	delete(s.kept, c.operName)
+	s.lock.Unlock()
+	for _, keyword := range kept {
+		s.add(c.Nickname, keyword)
+	}
+}
+
+// a copy of a user's keywords
+func (s *highlightStore) list(nickname string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]string(nil), s.keywords[nickname]...)
+}
+
+// the users that have keywords
+func (s *highlightStore) nicknames() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	nicknames := make([]string, 0, len(s.keywords))
+	for nickname, keywords := range s.keywords {
+		if len(keywords) > 0 {
+			nicknames = append(nicknames, nickname)
+		}
+	}
+	return nicknames
+}
+
+// checks if a message's content should be highlighted for a user:
+// if it mentions them, or contains one of their keywords
+func (s *highlightStore) matches(nickname string, content string) bool {
+	if mentionsNickname(content, nickname) {
+		return true
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, keyword := range s.keywords[nickname] {
+		if containsWord(content, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// the messages that were highlighted for each user lately, across all rooms
+type mentionStore struct {
+	lock   sync.Mutex
+	recent map[string][]Message // nickname -> messages, oldest first
+}
+
+var mentions = mentionStore{recent: make(map[string][]Message)}
+
+// remembers that a message was highlighted for a user
+func (s *mentionStore) add(nickname string, message Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	recent := append(s.recent[nickname], message)
+	if len(recent) > maxRecentMentions {
+		recent = recent[len(recent)-maxRecentMentions:]
+	}
+	s.recent[nickname] = recent
+}
+
+// forgets the mentions of someone who left the server
+func (s *mentionStore) forget(nickname string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.recent, nickname)
+}
+
+// the latest messages highlighted for a user, newest first
+func (s *mentionStore) latest(nickname string, count int) []Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	recent := s.recent[nickname]
+	if count > len(recent) {
+		count = len(recent)
+	}
+	latest := make([]Message, 0, count)
+	for i := len(recent) - 1; i >= len(recent)-count; i-- {
+		latest = append(latest, recent[i])
+	}
+	return latest
+}
+
+// remembers a new message as a mention for everyone it is highlighted for
+// that is anyone online and anyone with keywords, as long as they may read this room
+func (r *Room) recordMentions(message Message) {
+	if !message.IsChat() {
+		return
+	}
+	candidates := make(map[string]bool)
+	for _, client := range users.all() {
+		candidates[client.Nickname] = true
+	}
+	for _, nickname := range highlights.nicknames() {
+		candidates[nickname] = true
+	}
+	for nickname := range candidates {
+		if nickname != message.FromNick && r.IsMember(nickname) && !ignores.has(nickname, message.FromNick) && highlights.matches(nickname, message.Content) {
+			mentions.add(nickname, message)
+		}
+	}
+}
+
+// marks a message as highlighted if it is for the receiving client
+func highlightFor(c *Client, message Message) Message {
+	if message.IsChat() && message.FromNick != c.Nickname && highlights.matches(c.Nickname, message.Content) {
+		message.Highlight = true
+	}
+	return message
+}
+
+// manages the calling client's highlight keywords
+func highlight(r *Room, c *Client, args Args) *CommandError {
+	action, keyword := args.String("action"), args.String("keyword")
+	if action == "" {
+		action = "list"
+	}
+	switch {
+	case action == "list" && keyword == "":
+		keywords := highlights.list(c.Nickname)
+		sort.Strings(keywords)
+		var builder strings.Builder
+		builder.WriteString("\nHighlight keywords:\n")
+		builder.WriteString("---------\n")
+		builder.WriteString(c.Nickname + " (your nickname)\n")
+		for _, keyword := range keywords {
+			builder.WriteString(keyword + "\n")
+		}
+		c.ServerDirectMessage(r.serverMessage(builder.String()))
+	case action == "add" && keyword != "":
+		if !highlights.add(c.Nickname, keyword) {
+			return &CommandError{
+				CommandName: "highlight",
+				Reason:      fmt.Sprintf("`%s` is already a keyword", keyword),
+			}
+		}
+		c.ServerDirectMessage(r.serverMessage(fmt.Sprintf("Messages containing `%s` will be highlighted", keyword)))
+	case action == "remove" && keyword != "":
+		if !highlights.remove(c.Nickname, keyword) {
+			return &CommandError{
+				CommandName: "highlight",
+				Reason:      fmt.Sprintf("`%s` is not a keyword", keyword),
+			}
+		}
+		c.ServerDirectMessage(r.serverMessage(fmt.Sprintf("Messages containing `%s` will no longer be highlighted", keyword)))
+	default:
+		return &CommandError{
+			CommandName: "highlight",
+			Reason:      "Wrong arguments: want `add keyword`, `remove keyword` or `list`",
+		}
+	}
+	return nil
+}
+
+// lists the messages that were highlighted for the calling client lately, across all rooms
+func listMentions(r *Room, c *Client, args Args) *CommandError {
+	count := 10
+	if args.Has("count") {
+		count = args.Int("count")
+		if count < 1 {
+			return &CommandError{
+				CommandName: "mentions",
+				Reason:      fmt.Sprintf("`%d` is not a number of mentions", count),
+			}
+		}
+	}
+	latest := mentions.latest(c.Nickname, count)
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("\nRecent mentions (%d):\n", len(latest)))
+	builder.WriteString("---------\n")
+	for _, m := range latest {
+		builder.WriteString(fmt.Sprintf("#%d [%s] %s <%s> %s\n", m.Id, m.SentTime.Format("2006-01-02 15:04:05"), m.ServerName, m.FromNick, m.Content))
+	}
+	c.ServerDirectMessage(r.serverMessage(builder.String()))
+	r.Logln(c.Nickname, "listed mentions")
+	return nil
+}
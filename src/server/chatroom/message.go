@@ -1,41 +1,94 @@
-package chatroom
-
-import (
-	"log"
-	"strings"
-	"time"
-
-	"github.com/google/uuid"
-)
-
-// a representation of a message, containing a source and its contents
-type Message struct {
-	Uuid            uuid.UUID `json:"Uuid"`            // the UUID of the user this message is from
-	FromNick        string    `json:"FromNick"`        // the nickname of the user this message is from
-	Content         string    `json:"Content"`         // the actual message
-	SentTime        time.Time `json:"SentTime"`        // when this message was sent
-	ServerName      string    `json:"ServerName"`      // the name of the server this message is being broadcasted to
-	IsDirectMessage bool      `json:"IsDirectMessage"` // whether this is a direct message or not
-}
-
-func (m Message) IsCommand() bool {
-	return len(m.Content) > 0 && m.Content[0] == '/'
-}
-
-// splits a message into a command name and arguments
-// these arguments are a single string
-func (m Message) ToCommand() CalledCommand {
-	components := strings.SplitN(m.Content, " ", 2)
-	command := CalledCommand{Uuid: m.Uuid}
-	if len(components) > 0 {
-		// get the command name
-		if components[0][0] == '/' {
-			command.Name = strings.TrimLeft(components[0], "/")
-		}
-	}
-	if len(components) >= 2 {
-		command.Args = components[1]
-	}
-	log.Println(command)
-	return command
-}
+package chatroom
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// what kind of message this is, so clients know how to display it
+type MessageKind string
+
+const (
+	KindChat           MessageKind = "chat"            // a regular chat message
+	KindAction         MessageKind = "action"          // a user describing what they do, from `/me`
+	KindNotice         MessageKind = "notice"          // like a chat message, but bots must never answer it
+	KindReactionAdd    MessageKind = "reaction-add"    // a user reacted to a message
+	KindReactionRemove MessageKind = "reaction-remove" // a user took back their reaction to a message
+	KindTyping         MessageKind = "typing"          // a user is typing, never stored
+	KindUnread         MessageKind = "unread"          // unread counts for the receiving user, in `Unread`
+	KindSession        MessageKind = "session"         // the receiving client's session token, in `SessionToken`, and resume token, in `ResumeToken`
+	KindFile           MessageKind = "file"            // a user shared a file, in `Attachment`
+	KindCompletion     MessageKind = "completion"      // what the receiving client can tab-complete, in `Completion`
+)
+
+// a representation of a message, containing a source and its contents
+type Message struct {
+	Id              uint64         `json:"Id"`                     // server-wide unique id of this message, 0 if it was never posted to a room
+	Kind            MessageKind    `json:"Kind,omitempty"`         // what kind of message this is
+	Uuid            uuid.UUID      `json:"Uuid"`                   // the UUID of the user this message is from
+	FromNick        string         `json:"FromNick"`               // the nickname of the user this message is from
+	Content         string         `json:"Content"`                // the actual message
+	SentTime        time.Time      `json:"SentTime"`               // when this message was sent
+	ServerName      string         `json:"ServerName"`             // the name of the server this message is being broadcasted to
+	IsDirectMessage bool           `json:"IsDirectMessage"`        // whether this is a direct message or not
+	TargetId        uint64         `json:"TargetId,omitempty"`     // for reactions, the id of the message being reacted to
+	Emoji           string         `json:"Emoji,omitempty"`        // for reactions, the reaction being added or removed
+	Reactions       map[string]int `json:"Reactions,omitempty"`    // reaction counts of the message, or of the target message for reactions
+	ReplyTo         uint64         `json:"ReplyTo,omitempty"`      // the id of the message this is a reply to, 0 if it isn't a reply
+	Quote           *Quote         `json:"Quote,omitempty"`        // a preview of the message this is a reply to
+	Unread          []RoomUnread   `json:"Unread,omitempty"`       // for unread messages, the receiving user's unread counts per room
+	SessionToken    string         `json:"SessionToken,omitempty"` // for session messages, the token to authenticate http requests with
+	ResumeToken     string         `json:"ResumeToken,omitempty"`  // for session messages, the token to reconnect as the same client with, empty if clients can't
+	Attachment      *Attachment    `json:"Attachment,omitempty"`   // for file messages, the shared file
+	Rich            []Span         `json:"Rich,omitempty"`         // the formatted content, if it has any formatting; Content is always plain text
+	Highlight       bool           `json:"Highlight,omitempty"`    // whether the message mentions the receiving user or one of their keywords
+	Completion      *Completion    `json:"Completion,omitempty"`   // for completion messages, the names the receiving client can complete
+}
+
+// a file shared to a room
+type Attachment struct {
+	Id   string `json:"Id"`   // the id to download the file with
+	Name string `json:"Name"` // the original file name
+	Size int64  `json:"Size"` // in bytes
+	Url  string `json:"Url"`  // where to download the file from
+}
+
+// a short preview of a message, shown above replies to it
+type Quote struct {
+	Id       uint64 `json:"Id"`       // the id of the quoted message
+	FromNick string `json:"FromNick"` // who sent the quoted message
+	Content  string `json:"Content"`  // the start of the quoted message
+}
+
+// the id of the last message posted to any room
+var lastMessageId uint64
+
+// hands out the next message id
+func nextMessageId() uint64 {
+	return atomic.AddUint64(&lastMessageId, 1)
+}
+
+// checks if a message is something a user said in a room, as opposed to a server message or an event
+func (m Message) IsChat() bool {
+	return m.Kind == KindChat || m.Kind == KindAction || m.Kind == KindNotice || m.Kind == KindFile
+}
+
+// checks if a message is a command to run, only typed messages can be
+func (m Message) IsCommand() bool {
+	return m.Kind == KindChat && len(m.Content) > 0 && m.Content[0] == '/'
+}
+
+// splits a message into a command name and arguments
+// these arguments are a single string, the command parses them when it runs
+func (m Message) ToCommand() CalledCommand {
+	name, args := nextWord(m.Content)
+	command := CalledCommand{Uuid: m.Uuid, Args: strings.TrimSpace(args)}
+	// get the command name
+	if strings.HasPrefix(name, "/") {
+		command.Name = name[1:]
+	}
+	return command
+}
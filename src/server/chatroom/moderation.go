@@ -0,0 +1,335 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"irc-final-project/logging"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// file the bans are saved to, empty to keep them in memory only
+var BansFile = "bans.json"
+
+// a nickname, an address, or both, that may not connect
+type Ban struct {
+	Nickname string    `json:"Nickname,omitempty"`
+	Address  string    `json:"Address,omitempty"` // the IP address the nickname was connected from, or the banned address alone
+	By       string    `json:"By"`                // the operator that banned it
+	Reason   string    `json:"Reason,omitempty"`  // why, shown to the banned user
+	Time     time.Time `json:"Time"`
+}
+
+// what a ban is listed and lifted by: the nickname, or the address if only an address is banned
+func (b Ban) key() string {
+	if b.Nickname != "" {
+		return b.Nickname
+	}
+	return b.Address
+}
+
+// the banned nicknames and addresses
+// anyone can connect with any nickname, so the address a banned user was connected from is banned too
+type banStore struct {
+	lock   sync.RWMutex
+	banned map[string]Ban // key -> ban
+}
+
+var bans = banStore{banned: make(map[string]Ban)}
+
+// loads the saved bans from BansFile
+// a missing file is fine, nobody was banned yet
+func LoadBans() error {
+	if BansFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(BansFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []Ban
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %w", BansFile, err)
+	}
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+	for _, ban := range saved {
+		bans.banned[ban.key()] = ban
+	}
+	return nil
+}
+
+// writes every ban to BansFile, the caller must hold the lock
+func (s *banStore) save() error {
+	if BansFile == "" {
+		return nil
+	}
+	return saveJSON(BansFile, s.sortedList())
+}
+
+// bans a nickname or an address, returns false if it was already banned
+// if it can't be saved, nothing is banned
+func (s *banStore) add(ban Ban) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.banned[ban.key()]; ok {
+		return false, nil
+	}
+	s.banned[ban.key()] = ban
+	if err := s.save(); err != nil {
+		delete(s.banned, ban.key())
+		return false, err
+	}
+	return true, nil
+}
+
+// lifts the ban on a nickname or an address, returns false if it wasn't banned
+// if it can't be saved, the ban stays
+func (s *banStore) remove(key string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ban, ok := s.banned[key]
+	if !ok {
+		return false, nil
+	}
+	delete(s.banned, key)
+	if err := s.save(); err != nil {
+		s.banned[key] = ban
+		return false, err
+	}
+	return true, nil
+}
+
+// the ban keeping someone with a nickname, connecting from an address, out, if there is one
+func (s *banStore) find(nickname string, address string) (Ban, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if ban, ok := s.banned[nickname]; ok && nickname != "" {
+		return ban, true
+	}
+	// there are few bans, so they are simply looked through
+	for _, ban := range s.banned {
+		if address != "" && ban.Address == address {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+// every ban, sorted by nickname
+func (s *banStore) list() []Ban {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.sortedList()
+}
+
+// same as list, the caller must hold the lock
+func (s *banStore) sortedList() []Ban {
+	list := make([]Ban, 0, len(s.banned))
+	for _, ban := range s.banned {
+		list = append(list, ban)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key() < list[j].key() })
+	return list
+}
+
+// finds the online user an operator wants to act on, who can't be the operator themselves
+func (r *Room) moderationTarget(commandName string, c *Client, nickname string) (*Client, *CommandError) {
+	if nickname == c.Nickname {
+		return nil, &CommandError{
+			CommandName: commandName,
+			Reason:      "You can't do that to yourself",
+		}
+	}
+	target := r.GetClientByNickname(nickname)
+	if target == nil {
+		return nil, &CommandError{
+			CommandName: commandName,
+			Reason:      fmt.Sprintf("No user named `%s` is online", nickname),
+		}
+	}
+	return target, nil
+}
+
+// disconnects a client, telling them and their room why
+// the room they are in notices they are gone like any other disconnect
+// only called from r's goroutine, and never waits on another room
+func (r *Room) disconnect(target *Client, by *Client, why string) {
+	target.ServerDirectMessage(r.serverMessage(fmt.Sprintf("You were %s by %s", why, by.Nickname)))
+	room := target.CurrentRoom()
+	if room == nil {
+		// already on their way out
+		return
+	}
+	announce := room.serverMessage(fmt.Sprintf("---- <%s> was %s by %s ----", target.Nickname, why, by.Nickname))
+	// they can't come back by resuming
+	// if they lost their connection, or are a bot, there's no connection to close, so they are taken out of the room too
+	leave := resumes.forget(target) || target.IsBot()
+	if room == r {
+		// we are on the room's goroutine
+		r.postMessage(announce)
+		if leave {
+			r.unregister(target)
+		}
+	} else {
+		// the room may be torn down in the meantime, then there's nobody to tell
+		go func() {
+			select {
+			case room.Broadcast <- announce:
+			case <-room.done:
+				return
+			}
+			if leave {
+				select {
+				case room.Unregister <- target:
+				case <-room.done:
+				}
+			}
+		}()
+	}
+	// stops the writer, which closes the connection, then reading fails and the client is unregistered
+	// a kick that wasn't picked up yet does the same, so this never waits
+	select {
+	case target.KickSignal <- r:
+	default:
+	}
+}
+
+// what a kick or a ban says, with the reason if there is one
+func withReason(what string, reason string) string {
+	if reason == "" {
+		return what
+	}
+	return fmt.Sprintf("%s (%s)", what, reason)
+}
+
+// what someone turned away by a ban is told
+func bannedText(ban Ban, nickname string) string {
+	if ban.Nickname == nickname {
+		return fmt.Sprintf("%s is banned from this server", nickname)
+	}
+	return "Your address is banned from this server"
+}
+
+// disconnects a user: `/kick nickName [reason]`
+func kick(r *Room, c *Client, args Args) *CommandError {
+	target, err := r.moderationTarget("kick", c, args.String("nickName"))
+	if err != nil {
+		return err
+	}
+	reason := args.String("reason")
+	r.disconnect(target, c, withReason("kicked", reason))
+	r.audit("kick", c, target.Nickname, reason)
+	c.ServerDirectMessage(r.serverMessage(fmt.Sprintf("Kicked %s", target.Nickname)))
+	return nil
+}
+
+// keeps a nickname from connecting, and disconnects it if it is online: `/ban nickName [reason]`
+// the address an online nickname is connected from is banned with it, an address can be banned alone too
+// `/ban list` lists the bans
+func ban(r *Room, c *Client, args Args) *CommandError {
+	nickname := args.String("nickName")
+	if nickname == "list" && !args.Has("reason") {
+		list := bans.list()
+		var builder strings.Builder
+		builder.WriteString(fmt.Sprintf("\nBans (%d):\n", len(list)))
+		builder.WriteString("---------\n")
+		for _, b := range list {
+			builder.WriteString(b.key())
+			if b.Nickname != "" && b.Address != "" {
+				builder.WriteString(fmt.Sprintf(" (%s)", b.Address))
+			}
+			builder.WriteString(fmt.Sprintf(", by %s on %s", b.By, b.Time.Format("2006-01-02 15:04:05")))
+			if b.Reason != "" {
+				builder.WriteString(fmt.Sprintf(": %s", b.Reason))
+			}
+			builder.WriteString("\n")
+		}
+		c.ServerDirectMessage(r.serverMessage(builder.String()))
+		return nil
+	}
+	if nickname == c.Nickname {
+		return &CommandError{
+			CommandName: "ban",
+			Reason:      "You can't do that to yourself",
+		}
+	}
+	reason := args.String("reason")
+	b := Ban{Nickname: nickname, By: c.Nickname, Reason: reason, Time: time.Now()}
+	target := r.GetClientByNickname(nickname)
+	note := ""
+	switch {
+	case net.ParseIP(nickname) != nil:
+		// an address alone
+		if nickname == c.address {
+			return &CommandError{
+				CommandName: "ban",
+				Reason:      "You are connected from that address",
+			}
+		}
+		b.Nickname, b.Address = "", nickname
+	case target != nil && target.address == c.address:
+		// like people on the same network, only the nickname is banned
+		note = ", but not their address, you are connected from it too"
+	case target != nil:
+		// so they can't come back under another nickname
+		b.Address = target.address
+	}
+	added, err := bans.add(b)
+	if err != nil {
+		r.logEvent(logging.LevelError, "save-bans", c, logging.Fields{"error": err})
+		return &CommandError{
+			CommandName: "ban",
+			Reason:      fmt.Sprintf("Could not save the bans, %s is not banned", nickname),
+		}
+	}
+	if !added {
+		return &CommandError{
+			CommandName: "ban",
+			Reason:      fmt.Sprintf("%s is already banned", nickname),
+		}
+	}
+	details := reason
+	if b.Nickname != "" && b.Address != "" {
+		details = withReason(b.Address, reason)
+	}
+	r.audit("ban", c, b.key(), details)
+	// everyone connected from a banned address goes too, the operator can't be one of them
+	for _, client := range users.all() {
+		if client != c && (client == target || (b.Address != "" && client.address == b.Address)) {
+			r.disconnect(client, c, withReason("banned", reason))
+		}
+	}
+	c.ServerDirectMessage(r.serverMessage(fmt.Sprintf("Banned %s%s", nickname, note)))
+	return nil
+}
+
+// lets a banned nickname or address connect again: `/unban nickName`
+func unban(r *Room, c *Client, args Args) *CommandError {
+	nickname := args.String("nickName")
+	removed, err := bans.remove(nickname)
+	if err != nil {
+		r.logEvent(logging.LevelError, "save-bans", c, logging.Fields{"error": err})
+		return &CommandError{
+			CommandName: "unban",
+			Reason:      fmt.Sprintf("Could not save the bans, %s is still banned", nickname),
+		}
+	}
+	if !removed {
+		return &CommandError{
+			CommandName: "unban",
+			Reason:      fmt.Sprintf("%s is not banned", nickname),
+		}
+	}
+	r.audit("unban", c, nickname, "")
+	c.ServerDirectMessage(r.serverMessage(fmt.Sprintf("Unbanned %s", nickname)))
+	return nil
+}
@@ -0,0 +1,121 @@
+package chatroom
+
+import (
+	"bytes"
+	"fmt"
+	"irc-final-project/logging"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// the server's name, shown in the message of the day
+var ServerName = "irc-final-project"
+
+// file with the message of the day, a text/template, empty for none
+var MotdFile = ""
+
+// the message of the day, shown to clients when they connect
+type motdStore struct {
+	lock     sync.RWMutex
+	template *template.Template // nil if there is no message of the day
+}
+
+var motd motdStore
+
+// what the message of the day template can use, like `{{.Nickname}}` or `{{.Users}}`
+type MotdData struct {
+	ServerName string    // the server's name
+	Nickname   string    // the nickname of the client it is shown to
+	Room       string    // the room the client is in
+	Users      int       // how many users are online, bots included
+	Rooms      int       // how many rooms there are
+	Time       time.Time // when it is shown
+}
+
+// reads the message of the day from MotdFile
+// if the file can't be read or isn't a valid template, the current message is kept
+func LoadMotd() error {
+	if MotdFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(MotdFile)
+	if err != nil {
+		return err
+	}
+	t, err := template.New("motd").Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return err
+	}
+	motd.lock.Lock()
+	defer motd.lock.Unlock()
+	motd.template = t
+	return nil
+}
+
+// fills in the message of the day for a client
+// returns false if there is no message of the day
+func (s *motdStore) render(r *Room, c *Client) (string, bool) {
+	s.lock.RLock()
+	t := s.template
+	s.lock.RUnlock()
+	if t == nil {
+		return "", false
+	}
+	data := MotdData{
+		ServerName: ServerName,
+		Nickname:   c.Nickname,
+		Room:       r.RoomName,
+		Rooms:      len(AllRooms()),
+		Users:      users.count(),
+		Time:       time.Now(),
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		r.logEvent(logging.LevelError, "motd", c, logging.Fields{"error": err})
+		return "", false
+	}
+	return strings.TrimRight(buf.String(), "\n"), true
+}
+
+// sends the message of the day to a client, if there is one
+func (r *Room) sendMotd(c *Client) bool {
+	text, ok := motd.render(r, c)
+	if ok {
+		c.ServerDirectMessage(r.serverMessage("\n" + text))
+	}
+	return ok
+}
+
+// shows the message of the day again: `/motd`
+func showMotd(r *Room, c *Client, args Args) *CommandError {
+	if !r.sendMotd(c) {
+		return &CommandError{
+			CommandName: "motd",
+			Reason:      "There is no message of the day",
+		}
+	}
+	return nil
+}
+
+// reads the message of the day file again, without restarting the server: `/reloadmotd`
+func reloadMotd(r *Room, c *Client, args Args) *CommandError {
+	if MotdFile == "" {
+		return &CommandError{
+			CommandName: "reloadmotd",
+			Reason:      "The server has no message of the day file",
+		}
+	}
+	if err := LoadMotd(); err != nil {
+		r.audit("reloadmotd", c, MotdFile, fmt.Sprintf("failed: %v", err))
+		return &CommandError{
+			CommandName: "reloadmotd",
+			Reason:      fmt.Sprintf("Kept the old message of the day: %v", err),
+		}
+	}
+	c.ServerDirectMessage(r.serverMessage("Reloaded the message of the day"))
+	r.audit("reloadmotd", c, MotdFile, "")
+	return nil
+}
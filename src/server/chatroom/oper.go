@@ -0,0 +1,51 @@
+package chatroom
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"irc-final-project/logging"
+)
+
+// operator names and their passwords, for `/oper`
+// set before the server starts, see the config package
+var Operators = make(map[string]string)
+
+// makes the calling client an operator if the name and password match: `/oper name password`
+func oper(r *Room, c *Client, args Args) *CommandError {
+	name, password := args.String("name"), args.String("password")
+	expected, ok := Operators[name]
+	// compare even for unknown names, so the time taken doesn't tell which names exist
+	matches := subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+	if !ok || !matches {
+		r.audit("oper-failed", c, name, "")
+		return &CommandError{
+			CommandName: "oper",
+			Reason:      "Wrong operator name or password",
+		}
+	}
+	c.Permission = PermissionOperator
+	c.operName = name
+	c.ServerDirectMessage(r.serverMessage(fmt.Sprintf("You are now an operator, as %s", name)))
+	r.audit("oper", c, name, "")
+	highlights.restore(c)
+	if err := ignores.restore(c); err != nil {
+		r.logEvent(logging.LevelError, "save-ignores", c, logging.Fields{"error": err})
+		return &CommandError{
+			CommandName: "oper",
+			Reason:      "Could not save your ignore list, it is only kept until you leave",
+		}
+	}
+	return nil
+}
+
+// what a message looks like in the logs, without the arguments of secret commands
+func (r *Room) loggable(content string) string {
+	if !(Message{Kind: KindChat, Content: content}).IsCommand() {
+		return content
+	}
+	command := Message{Content: content}.ToCommand()
+	if cmd, ok := r.Commands.Lookup(command.Name); ok && cmd.Secret && command.Args != "" {
+		return "/" + command.Name + " ***"
+	}
+	return content
+}
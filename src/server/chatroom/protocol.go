@@ -0,0 +1,169 @@
+package chatroom
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+)
+
+// the websocket subprotocols a client can ask for with Sec-WebSocket-Protocol
+// whichever it asks for, a client sends lines of text: messages and commands, like someone typing them
+const (
+	// each frame has one JSON message, or several separated by newlines, and the room name after `/join` is sent as plain text
+	// clients that don't ask for a subprotocol get this one
+	ProtocolLegacy = "chat.v1"
+	// each frame has one JSON envelope, or a JSON array of them when several were waiting to be sent
+	ProtocolV2 = "chat.v2"
+	// the same as chat.v2 in CBOR (RFC 8949), in binary frames: smaller, and cheaper to encode
+	// the keys are the same as in JSON, times have tag 1 and uuids are byte strings
+	ProtocolV2Cbor = "chat.v2.cbor"
+)
+
+// what a chat.v2 frame holds
+type Envelope struct {
+	Type    EnvelopeType
+	Message *Message `json:",omitempty"` // for EnvelopeMessage
+	Room    string   `json:",omitempty"` // the room the client is now in, for EnvelopeSwitch
+}
+
+type EnvelopeType string
+
+const (
+	EnvelopeMessage EnvelopeType = "message" // a message from a room, or a direct message
+	EnvelopeSwitch  EnvelopeType = "switch"  // the client was moved to another room, after `/join`
+)
+
+// wraps a message in an envelope
+func messageEnvelope(message Message) Envelope {
+	return Envelope{Type: EnvelopeMessage, Message: &message}
+}
+
+// how envelopes are put in websocket frames
+type protocol struct {
+	name       string
+	frameType  int                                       // websocket.TextMessage or websocket.BinaryMessage
+	writeFrame func(w io.Writer, batch []Envelope) error // writes envelopes as one frame
+	readFrame  func(frame []byte) ([]Envelope, error)    // reads the envelopes in a frame
+}
+
+// the protocols the server speaks, the ones it would rather use first
+var protocols = []*protocol{
+	{name: ProtocolV2Cbor, frameType: websocket.BinaryMessage, writeFrame: writeCbor, readFrame: readCbor},
+	{name: ProtocolV2, frameType: websocket.TextMessage, writeFrame: writeV2, readFrame: readV2},
+	{name: ProtocolLegacy, frameType: websocket.TextMessage, writeFrame: writeLegacy, readFrame: readLegacy},
+}
+
+// how CBOR is written: times are tagged, so clients know what they are, and are kept to about a microsecond
+var cborEncoding = func() cbor.EncMode {
+	mode, err := cbor.EncOptions{Time: cbor.TimeUnixDynamic, TimeTag: cbor.EncTagRequired}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}()
+
+// the names of the protocols the server speaks, for the upgrader
+func protocolNames() []string {
+	names := make([]string, len(protocols))
+	for i, p := range protocols {
+		names[i] = p.name
+	}
+	return names
+}
+
+// finds the protocol agreed on with a client, the legacy one if it didn't ask for any
+func findProtocol(name string) *protocol {
+	for _, p := range protocols {
+		if p.name == name {
+			return p
+		}
+	}
+	return findProtocol(ProtocolLegacy)
+}
+
+// reads the envelopes in a frame the server wrote in a protocol, for clients written in go
+func DecodeFrame(protocolName string, frame []byte) ([]Envelope, error) {
+	return findProtocol(protocolName).readFrame(frame)
+}
+
+// chat.v2: one envelope, or an array of them
+func writeV2(w io.Writer, batch []Envelope) error {
+	if len(batch) == 1 {
+		return json.NewEncoder(w).Encode(batch[0])
+	}
+	return json.NewEncoder(w).Encode(batch)
+}
+
+func readV2(frame []byte) ([]Envelope, error) {
+	if bytes.HasPrefix(frame, []byte("[")) {
+		var batch []Envelope
+		err := json.Unmarshal(frame, &batch)
+		return batch, err
+	}
+	var envelope Envelope
+	err := json.Unmarshal(frame, &envelope)
+	return []Envelope{envelope}, err
+}
+
+// chat.v2.cbor: one envelope, or an array of them
+func writeCbor(w io.Writer, batch []Envelope) error {
+	if len(batch) == 1 {
+		return cborEncoding.NewEncoder(w).Encode(batch[0])
+	}
+	return cborEncoding.NewEncoder(w).Encode(batch)
+}
+
+func readCbor(frame []byte) ([]Envelope, error) {
+	// the major type in the top 3 bits of the first byte, 4 is an array
+	if len(frame) > 0 && frame[0]>>5 == 4 {
+		var batch []Envelope
+		err := cbor.Unmarshal(frame, &batch)
+		return batch, err
+	}
+	var envelope Envelope
+	err := cbor.Unmarshal(frame, &envelope)
+	return []Envelope{envelope}, err
+}
+
+// chat.v1: messages separated by newlines, a room switch is only ever sent alone, as the room's name
+func writeLegacy(w io.Writer, batch []Envelope) error {
+	for i, envelope := range batch {
+		if i > 0 {
+			if _, err := w.Write(newline); err != nil {
+				return err
+			}
+		}
+		var err error
+		if envelope.Type == EnvelopeSwitch {
+			_, err = io.WriteString(w, envelope.Room)
+		} else {
+			err = json.NewEncoder(w).Encode(envelope.Message)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a frame that isn't JSON is the name of the room the client was moved to
+func readLegacy(frame []byte) ([]Envelope, error) {
+	var batch []Envelope
+	decoder := json.NewDecoder(bytes.NewReader(frame))
+	for {
+		var m Message
+		if err := decoder.Decode(&m); err == io.EOF {
+			return batch, nil
+		} else if err != nil {
+			if len(batch) > 0 {
+				return batch, fmt.Errorf("message %d: %w", len(batch)+1, err)
+			}
+			return []Envelope{{Type: EnvelopeSwitch, Room: string(frame)}}, nil
+		}
+		batch = append(batch, messageEnvelope(m))
+	}
+}
@@ -0,0 +1,147 @@
+package chatroom
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestWriteFrame(t *testing.T) {
+	first := Message{Id: 1, Kind: KindChat, FromNick: "alice", Content: "two\nlines"}
+	second := Message{Id: 2, Kind: KindChat, FromNick: "bob", Content: "hi"}
+	firstJson := `{"Id":1,"Kind":"chat","Uuid":"00000000-0000-0000-0000-000000000000","FromNick":"alice","Content":"two\nlines","SentTime":"0001-01-01T00:00:00Z","ServerName":"","IsDirectMessage":false}`
+	secondJson := `{"Id":2,"Kind":"chat","Uuid":"00000000-0000-0000-0000-000000000000","FromNick":"bob","Content":"hi","SentTime":"0001-01-01T00:00:00Z","ServerName":"","IsDirectMessage":false}`
+	tests := []struct {
+		name     string
+		protocol string
+		batch    []Envelope
+		want     string
+	}{
+		{"v2 message", ProtocolV2, []Envelope{messageEnvelope(first)},
+			`{"Type":"message","Message":` + firstJson + "}\n"},
+		{"v2 batch", ProtocolV2, []Envelope{messageEnvelope(first), messageEnvelope(second)},
+			`[{"Type":"message","Message":` + firstJson + `},{"Type":"message","Message":` + secondJson + "}]\n"},
+		{"v2 switch", ProtocolV2, []Envelope{{Type: EnvelopeSwitch, Room: "dev"}},
+			`{"Type":"switch","Room":"dev"}` + "\n"},
+		{"legacy message", ProtocolLegacy, []Envelope{messageEnvelope(first)},
+			firstJson + "\n"},
+		{"legacy batch", ProtocolLegacy, []Envelope{messageEnvelope(first), messageEnvelope(second)},
+			firstJson + "\n\n" + secondJson + "\n"},
+		{"legacy switch", ProtocolLegacy, []Envelope{{Type: EnvelopeSwitch, Room: "dev"}},
+			"dev"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := findProtocol(tt.protocol).writeFrame(&buf, tt.batch); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("frame =\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+	message := Message{
+		Id:        7,
+		Kind:      KindChat,
+		Uuid:      uuid.New(),
+		FromNick:  "alice",
+		Content:   "two\nlines",
+		SentTime:  time.Date(2024, 5, 1, 12, 30, 0, 123456000, time.UTC),
+		Reactions: map[string]int{"👍": 2},
+		Rich:      []Span{{Text: "two\nlines", Bold: true}},
+	}
+	batches := map[string][]Envelope{
+		"one":    {messageEnvelope(message)},
+		"batch":  {messageEnvelope(message), messageEnvelope(message)},
+		"switch": {{Type: EnvelopeSwitch, Room: "dev"}},
+	}
+	for _, p := range protocols {
+		for name, batch := range batches {
+			t.Run(p.name+" "+name, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := p.writeFrame(&buf, batch); err != nil {
+					t.Fatal(err)
+				}
+				got, err := DecodeFrame(p.name, buf.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, envelope := range got {
+					if envelope.Message == nil {
+						continue
+					}
+					// cbor times are floats, so they are only kept to about a microsecond
+					if d := envelope.Message.SentTime.Sub(message.SentTime); d > time.Microsecond || d < -time.Microsecond {
+						t.Errorf("sent time %s, want %s", envelope.Message.SentTime, message.SentTime)
+					}
+					envelope.Message.SentTime = message.SentTime
+				}
+				if !reflect.DeepEqual(got, batch) {
+					t.Errorf("decoded %+v, want %+v", got, batch)
+				}
+			})
+		}
+	}
+}
+
+// a chat message like most of what rooms send
+func benchmarkMessage(i int) Message {
+	return Message{
+		Id:         uint64(i),
+		Kind:       KindChat,
+		Uuid:       uuid.New(),
+		FromNick:   "someone",
+		Content:    strings.Repeat("chat ", 12),
+		SentTime:   time.Now(),
+		ServerName: "main",
+	}
+}
+
+// go test -bench WriteFrame -benchmem ./chatroom
+func BenchmarkWriteFrame(b *testing.B) {
+	for _, p := range protocols {
+		for _, size := range []int{1, 16} {
+			batch := make([]Envelope, size)
+			for i := range batch {
+				batch[i] = messageEnvelope(benchmarkMessage(i))
+			}
+			b.Run(fmt.Sprintf("%s/%d", p.name, size), func(b *testing.B) {
+				var buf bytes.Buffer
+				p.writeFrame(&buf, batch)
+				b.SetBytes(int64(buf.Len()))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					buf.Reset()
+					p.writeFrame(&buf, batch)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDecodeFrame(b *testing.B) {
+	for _, p := range protocols {
+		batch := make([]Envelope, 16)
+		for i := range batch {
+			batch[i] = messageEnvelope(benchmarkMessage(i))
+		}
+		var buf bytes.Buffer
+		p.writeFrame(&buf, batch)
+		b.Run(p.name, func(b *testing.B) {
+			b.SetBytes(int64(buf.Len()))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				DecodeFrame(p.name, buf.Bytes())
+			}
+		})
+	}
+}
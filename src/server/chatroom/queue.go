@@ -0,0 +1,87 @@
+package chatroom
+
+import (
+	"fmt"
+	"irc-final-project/logging"
+	"sync/atomic"
+	"time"
+)
+
+// how clients that can't keep up are handled, can be changed before the server starts
+var (
+	// how many messages can wait to be written to a client
+	SendQueueSize = 256
+
+	// when a client's queue is full, its oldest message is dropped to make room
+	// after this many drops in a row, the client is warned that it is falling behind
+	DroppedBeforeWarning = 16
+
+	// after this many drops in a row, the client is disconnected
+	DroppedBeforeDisconnect = 128
+)
+
+// how many clients were disconnected for not keeping up, since the server started
+var slowDisconnects uint64
+
+// queues a message for a client, making room if its queue is full
+// a client that keeps falling behind is warned, then disconnected
+// only called from the room's goroutine, returns false if the client was disconnected
+func (r *Room) enqueue(client *Client, message Message) bool {
+	if trySend(client, message) {
+		if len(client.Send) <= cap(client.Send)/2 {
+			// caught up
+			client.dropped = 0
+		}
+		return true
+	}
+	client.dropped++
+	switch {
+	case client.dropped >= DroppedBeforeDisconnect:
+		r.dropSlowClient(client)
+		return false
+	case client.dropped == DroppedBeforeWarning:
+		r.logEvent(logging.LevelWarn, "slow-client", client, logging.Fields{"dropped": client.dropped, "queue": cap(client.Send)})
+		warning := r.serverMessage(fmt.Sprintf("(DM) You are falling behind: %d messages were dropped. You will be disconnected if this goes on.", client.dropped))
+		warning.IsDirectMessage = true
+		dropOldest(client)
+		trySend(client, warning)
+	}
+	dropOldest(client)
+	trySend(client, message)
+	return true
+}
+
+// queues a message for a client if there is room
+func trySend(client *Client, message Message) bool {
+	select {
+	case client.Send <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// takes the oldest message out of a client's queue, unless its writer just took it
+func dropOldest(client *Client) {
+	select {
+	case <-client.Send:
+	default:
+	}
+}
+
+// disconnects a client that doesn't read what it is sent, and tells the room
+func (r *Room) dropSlowClient(client *Client) {
+	total := atomic.AddUint64(&slowDisconnects, 1)
+	r.logEvent(logging.LevelWarn, "slow-client-disconnect", client, logging.Fields{
+		"reason":  fmt.Sprintf("dropped %d messages in a row, its send queue of %d stays full", client.dropped, cap(client.Send)),
+		"dropped": client.dropped,
+		"total":   total,
+	})
+	r.announce(r.serverMessage(fmt.Sprintf("---- <%s> left %s (could not keep up) ----", client.Nickname, r.RoomName)))
+	delete(r.Clients, client)
+	users.remove(client)
+	r.lastActive = time.Now()
+	resumes.forget(client)
+	// the writer stops and closes the connection
+	close(client.Send)
+}
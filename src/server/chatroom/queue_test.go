@@ -0,0 +1,53 @@
+package chatroom
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEnqueue(t *testing.T) {
+	defer func(warning, disconnect int) {
+		DroppedBeforeWarning, DroppedBeforeDisconnect = warning, disconnect
+	}(DroppedBeforeWarning, DroppedBeforeDisconnect)
+	DroppedBeforeWarning, DroppedBeforeDisconnect = 2, 4
+	tests := []struct {
+		name      string
+		sent      int    // messages queued without the client reading any
+		wantQueue string // the messages waiting afterwards, oldest first
+		wantGone  bool   // whether the client was disconnected
+	}{
+		{"fits", 3, "1 2 3", false},
+		{"drops the oldest", 5, "2 3 4 5", false},
+		{"warns", 6, "4 5 warning 6", false},
+		{"disconnects", 8, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRoom("test")
+			client := &Client{Nickname: "slow", Send: make(chan Message, 4)}
+			r.Clients[client] = true
+			for i := 1; i <= tt.sent; i++ {
+				r.enqueue(client, Message{Content: fmt.Sprint(i)})
+			}
+			_, inRoom := r.Clients[client]
+			if inRoom == tt.wantGone {
+				t.Fatalf("client in room = %v, want %v", inRoom, !tt.wantGone)
+			}
+			if tt.wantGone {
+				return
+			}
+			var queue []string
+			for len(client.Send) > 0 {
+				m := <-client.Send
+				if strings.Contains(m.Content, "falling behind") {
+					m.Content = "warning"
+				}
+				queue = append(queue, m.Content)
+			}
+			if got := strings.Join(queue, " "); got != tt.wantQueue {
+				t.Errorf("queue = %q, want %q", got, tt.wantQueue)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package chatroom
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// the longest emoji sequence allowed as a reaction, in runes
+// long enough for flags, skin tones and joined sequences like 👩‍💻
+const maxReactionRunes = 8
+
+// what a reaction shortcode looks like, eg `:thumbsup:`
+var shortcodePattern = regexp.MustCompile(`^:[a-z0-9_+\-]{1,32}:$`)
+
+// common shortcodes, so that `:thumbsup:` and 👍 count as the same reaction
+// shortcodes not in here are kept as-is
+var reactionShortcodes = map[string]string{
+	":+1:":               "👍",
+	":thumbsup:":         "👍",
+	":-1:":               "👎",
+	":thumbsdown:":       "👎",
+	":heart:":            "❤️",
+	":smile:":            "😄",
+	":laughing:":         "😆",
+	":joy:":              "😂",
+	":tada:":             "🎉",
+	":eyes:":             "👀",
+	":fire:":             "🔥",
+	":rocket:":           "🚀",
+	":pray:":             "🙏",
+	":thinking:":         "🤔",
+	":white_check_mark:": "✅",
+	":x:":                "❌",
+	":wave:":             "👋",
+}
+
+// turns a reaction into the form it is counted under
+// returns false if it is neither a shortcode nor a short emoji
+func normalizeReaction(reaction string) (string, bool) {
+	reaction = strings.TrimSpace(reaction)
+	if shortcodePattern.MatchString(reaction) {
+		if emoji, ok := reactionShortcodes[reaction]; ok {
+			return emoji, true
+		}
+		return reaction, true
+	}
+	if reaction == "" || utf8.RuneCountInString(reaction) > maxReactionRunes {
+		return "", false
+	}
+	// emoji are all outside of ascii, and aren't letters or digits
+	for _, r := range reaction {
+		if r < utf8.RuneSelf || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) {
+			return "", false
+		}
+	}
+	return reaction, true
+}
+
+// gets the message id and the reaction from reaction command arguments
+func reactionArgs(commandName string, args Args) (uint64, string, *CommandError) {
+	emoji, ok := normalizeReaction(args.String("emoji"))
+	if !ok {
+		return 0, "", &CommandError{
+			CommandName: commandName,
+			Reason:      fmt.Sprintf("`%s` is not an emoji or a :shortcode:", args.String("emoji")),
+		}
+	}
+	return args.MessageId("messageId"), emoji, nil
+}
+
+// adds the calling client's reaction to a message in the current room
+func react(r *Room, c *Client, args Args) *CommandError {
+	id, emoji, cerr := reactionArgs("react", args)
+	if cerr != nil {
+		return cerr
+	}
+	if _, ok := r.history.find(id); !ok {
+		return &CommandError{
+			CommandName: "react",
+			Reason:      fmt.Sprintf("Message #%d is not in room `%s`", id, r.RoomName),
+		}
+	}
+	if !r.history.addReaction(id, emoji, c.Nickname) {
+		return &CommandError{
+			CommandName: "react",
+			Reason:      fmt.Sprintf("You already reacted %s to message #%d", emoji, id),
+		}
+	}
+	r.sendToAll(r.reactionMessage(KindReactionAdd, c, id, emoji))
+	r.Logf("%s reacted %s to #%d\n", c.Nickname, emoji, id)
+	return nil
+}
+
+// removes the calling client's reaction from a message in the current room
+func unreact(r *Room, c *Client, args Args) *CommandError {
+	id, emoji, cerr := reactionArgs("unreact", args)
+	if cerr != nil {
+		return cerr
+	}
+	if !r.history.removeReaction(id, emoji, c.Nickname) {
+		return &CommandError{
+			CommandName: "unreact",
+			Reason:      fmt.Sprintf("You have not reacted %s to message #%d", emoji, id),
+		}
+	}
+	r.sendToAll(r.reactionMessage(KindReactionRemove, c, id, emoji))
+	r.Logf("%s removed reaction %s from #%d\n", c.Nickname, emoji, id)
+	return nil
+}
+
+// the event sent to the room when a reaction is added or removed
+// it carries the new reaction counts of the target message, so clients don't need to keep count themselves
+func (r *Room) reactionMessage(kind MessageKind, c *Client, id uint64, emoji string) Message {
+	verb := "reacted %s to"
+	if kind == KindReactionRemove {
+		verb = "removed reaction %s from"
+	}
+	return Message{
+		Kind:       kind,
+		Uuid:       c.Uuid,
+		FromNick:   c.Nickname,
+		Content:    fmt.Sprintf("%s "+verb+" #%d", c.Nickname, emoji, id),
+		SentTime:   time.Now(),
+		ServerName: r.RoomName,
+		TargetId:   id,
+		Emoji:      emoji,
+		Reactions:  r.history.reactionCounts(id),
+	}
+}
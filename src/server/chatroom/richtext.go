@@ -0,0 +1,345 @@
+package chatroom
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// mIRC formatting control codes
+const (
+	ircBold          = '\x02'
+	ircColor         = '\x03'
+	ircHexColor      = '\x04'
+	ircReset         = '\x0F'
+	ircMonospace     = '\x11'
+	ircReverse       = '\x16'
+	ircItalic        = '\x1D'
+	ircStrikethrough = '\x1E'
+	ircUnderline     = '\x1F'
+)
+
+// a run of text that is all formatted the same way
+// colors are mIRC color numbers, 0 to 15 for the usual ones and up to 98 for the extended ones
+type Span struct {
+	Text      string `json:"Text"`
+	Bold      bool   `json:"Bold,omitempty"`
+	Italic    bool   `json:"Italic,omitempty"`
+	Underline bool   `json:"Underline,omitempty"`
+	Strike    bool   `json:"Strike,omitempty"`
+	Code      bool   `json:"Code,omitempty"`      // inline code
+	CodeBlock bool   `json:"CodeBlock,omitempty"` // a block of code
+	Fg        *int   `json:"Fg,omitempty"`        // text color, nil for the default
+	Bg        *int   `json:"Bg,omitempty"`        // background color, nil for the default
+}
+
+// checks if two spans are formatted the same way
+func (s Span) sameStyle(o Span) bool {
+	return s.Bold == o.Bold && s.Italic == o.Italic && s.Underline == o.Underline && s.Strike == o.Strike &&
+		s.Code == o.Code && s.CodeBlock == o.CodeBlock && sameColor(s.Fg, o.Fg) && sameColor(s.Bg, o.Bg)
+}
+
+// checks if the span has any formatting at all
+func (s Span) isPlain() bool {
+	return s.sameStyle(Span{})
+}
+
+func sameColor(a, b *int) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+// the formatting state while parsing
+type richTextParser struct {
+	input []rune
+	pos   int
+	spans []Span
+	text  strings.Builder // text of the span being built
+
+	// irc control code state
+	bold, italic, underline, strike, monospace bool
+	fg, bg                                     *int
+
+	// markdown state
+	mdBold, mdItalic, mdCode, mdBlock bool
+	mdItalicDelim                     rune
+}
+
+// the formatting of the text at the current position
+func (p *richTextParser) style() Span {
+	return Span{
+		Bold:      p.bold || p.mdBold,
+		Italic:    p.italic || p.mdItalic,
+		Underline: p.underline,
+		Strike:    p.strike,
+		Code:      (p.monospace || p.mdCode) && !p.mdBlock,
+		CodeBlock: p.mdBlock,
+		Fg:        p.fg,
+		Bg:        p.bg,
+	}
+}
+
+// ends the current span, before the formatting changes
+func (p *richTextParser) flush() {
+	if p.text.Len() == 0 {
+		return
+	}
+	span := p.style()
+	span.Text = p.text.String()
+	p.text.Reset()
+	if n := len(p.spans); n > 0 && p.spans[n-1].sameStyle(span) {
+		p.spans[n-1].Text += span.Text
+		return
+	}
+	p.spans = append(p.spans, span)
+}
+
+// checks if the input continues with the given string at the current position
+func (p *richTextParser) at(s string) bool {
+	i := p.pos
+	for _, r := range s {
+		if i >= len(p.input) || p.input[i] != r {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// checks if the given delimiter shows up again later, with something in between
+// escaped ones don't count, except for code, where backslashes are kept as they are
+func (p *richTextParser) closedLater(delim string) bool {
+	rest := string(p.input[p.pos+utf8.RuneCountInString(delim):])
+	for offset := 0; ; {
+		i := strings.Index(rest[offset:], delim)
+		if i < 0 {
+			return false
+		}
+		i += offset
+		if i == 0 {
+			return false
+		}
+		if rest[i-1] != '\\' || delim[0] == '`' {
+			return true
+		}
+		offset = i + len(delim)
+	}
+}
+
+// the rune at an offset from the current position, or a space outside the input
+func (p *richTextParser) peek(offset int) rune {
+	i := p.pos + offset
+	if i < 0 || i >= len(p.input) {
+		return ' '
+	}
+	return p.input[i]
+}
+
+// reads up to two digits of a color number
+func (p *richTextParser) readColor() *int {
+	color, digits := 0, 0
+	for digits < 2 && p.pos < len(p.input) && p.input[p.pos] >= '0' && p.input[p.pos] <= '9' {
+		color = color*10 + int(p.input[p.pos]-'0')
+		p.pos++
+		digits++
+	}
+	if digits == 0 || color > 98 {
+		return nil
+	}
+	return &color
+}
+
+// skips a rrggbb hex color, returns false if there isn't one
+func (p *richTextParser) skipHexColor() bool {
+	if p.pos+6 > len(p.input) {
+		return false
+	}
+	for _, r := range p.input[p.pos : p.pos+6] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	p.pos += 6
+	return true
+}
+
+// handles an irc control code at the current position
+// returns false if there isn't one
+func (p *richTextParser) controlCode() bool {
+	toggle := func(b *bool) {
+		p.flush()
+		*b = !*b
+		p.pos++
+	}
+	switch p.input[p.pos] {
+	case ircBold:
+		toggle(&p.bold)
+	case ircItalic:
+		toggle(&p.italic)
+	case ircUnderline:
+		toggle(&p.underline)
+	case ircStrikethrough:
+		toggle(&p.strike)
+	case ircMonospace:
+		toggle(&p.monospace)
+	case ircReverse:
+		// swap colors
+		p.flush()
+		p.fg, p.bg = p.bg, p.fg
+		p.pos++
+	case ircReset:
+		p.flush()
+		p.bold, p.italic, p.underline, p.strike, p.monospace = false, false, false, false, false
+		p.fg, p.bg = nil, nil
+		p.pos++
+	case ircColor:
+		// \x03fg[,bg], or \x03 alone to go back to the default colors
+		p.flush()
+		p.pos++
+		fg := p.readColor()
+		if fg == nil {
+			p.fg, p.bg = nil, nil
+			return true
+		}
+		p.fg = fg
+		if p.pos+1 < len(p.input) && p.input[p.pos] == ',' && unicode.IsDigit(p.input[p.pos+1]) {
+			p.pos++
+			p.bg = p.readColor()
+		}
+	case ircHexColor:
+		// hex colors aren't supported, drop them along with their rrggbb[,rrggbb]
+		p.pos++
+		if p.skipHexColor() && p.peek(0) == ',' {
+			p.pos++
+			if !p.skipHexColor() {
+				p.pos--
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// handles a markdown delimiter at the current position
+// returns false if there isn't one
+func (p *richTextParser) markdown() bool {
+	// nothing is formatted inside code
+	switch {
+	case p.at("```") && (p.mdBlock || (!p.mdCode && p.closedLater("```"))):
+		p.flush()
+		p.mdBlock = !p.mdBlock
+		p.pos += 3
+		return true
+	case p.mdBlock:
+		return false
+	case p.at("`") && (p.mdCode || p.closedLater("`")):
+		p.flush()
+		p.mdCode = !p.mdCode
+		p.pos++
+		return true
+	case p.mdCode:
+		return false
+	case p.at("**") && ((p.mdBold && !unicode.IsSpace(p.peek(-1))) || (!p.mdBold && !unicode.IsSpace(p.peek(2)) && p.closedLater("**"))):
+		p.flush()
+		p.mdBold = !p.mdBold
+		p.pos += 2
+		return true
+	}
+	r := p.input[p.pos]
+	if r != '*' && r != '_' {
+		return false
+	}
+	if p.mdItalic && r == p.mdItalicDelim && !unicode.IsSpace(p.peek(-1)) {
+		// `_` only closes at the end of a word, so snake_case stays as it is
+		if r == '_' && isWordRune(p.peek(1)) {
+			return false
+		}
+		p.flush()
+		p.mdItalic = false
+		p.pos++
+		return true
+	}
+	if !p.mdItalic && !unicode.IsSpace(p.peek(1)) && p.closedLater(string(r)) {
+		if r == '_' && isWordRune(p.peek(-1)) {
+			return false
+		}
+		p.flush()
+		p.mdItalic = true
+		p.mdItalicDelim = r
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// handles a backslash before a markdown delimiter, which writes the delimiter as it is
+// returns false if there isn't one
+func (p *richTextParser) escape() bool {
+	if p.mdCode || p.mdBlock || !p.at("\\") || !strings.ContainsRune("*_`\\", p.peek(1)) || p.pos+1 >= len(p.input) {
+		return false
+	}
+	p.text.WriteRune(p.input[p.pos+1])
+	p.pos += 2
+	return true
+}
+
+// copies a link at the current position as it is, so the `_` and `*` in it aren't taken for formatting
+// punctuation at its end is left out, it most likely ends the sentence or the formatting around the link
+// returns false if there isn't one
+func (p *richTextParser) link() bool {
+	if p.mdCode || p.mdBlock || !(p.at("http://") || p.at("https://")) || isWordRune(p.peek(-1)) {
+		return false
+	}
+	end := p.pos
+	for end < len(p.input) && !unicode.IsSpace(p.input[end]) && !unicode.IsControl(p.input[end]) {
+		end++
+	}
+	for end > p.pos && strings.ContainsRune(".,:;!?*_~`'\")", p.input[end-1]) {
+		// unless it closes a parenthesis in the link, like wiki/Go_(language)
+		if p.input[end-1] == ')' && strings.ContainsRune(string(p.input[p.pos:end]), '(') {
+			break
+		}
+		end--
+	}
+	for ; p.pos < end; p.pos++ {
+		p.text.WriteRune(p.input[p.pos])
+	}
+	return true
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// parses irc formatting codes and a bit of markdown (**bold**, *italics*, _italics_, `code` and ```code blocks```)
+// a backslash keeps a markdown delimiter as it is, and links are never formatted
+// returns the text without any formatting, and the formatted spans
+// the spans are nil if there is no formatting
+func ParseRichText(s string) (string, []Span) {
+	p := richTextParser{input: []rune(s)}
+	for p.pos < len(p.input) {
+		if p.controlCode() || p.escape() || p.link() || p.markdown() {
+			continue
+		}
+		p.text.WriteRune(p.input[p.pos])
+		p.pos++
+	}
+	p.flush()
+
+	var plain strings.Builder
+	formatted := false
+	for _, span := range p.spans {
+		plain.WriteString(span.Text)
+		formatted = formatted || !span.isPlain()
+	}
+	if !formatted {
+		return plain.String(), nil
+	}
+	return plain.String(), p.spans
+}
+
+// removes all formatting from a message, for plain text
+func StripRichText(s string) string {
+	plain, _ := ParseRichText(s)
+	return plain
+}
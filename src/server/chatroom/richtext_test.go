@@ -0,0 +1,87 @@
+package chatroom
+
+import (
+	"reflect"
+	"testing"
+)
+
+// a pointer to a color number, for the spans of the tests
+func color(n int) *int {
+	return &n
+}
+
+func TestParseRichText(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantPlain string
+		want      []Span // nil when nothing is formatted
+	}{
+		{"plain", "hello there", "hello there", nil},
+		{"empty", "", "", nil},
+
+		// markdown
+		{"bold", "a **b** c", "a b c", []Span{{Text: "a "}, {Text: "b", Bold: true}, {Text: " c"}}},
+		{"italics with stars", "*a*", "a", []Span{{Text: "a", Italic: true}}},
+		{"italics with underscores", "_a_ b", "a b", []Span{{Text: "a", Italic: true}, {Text: " b"}}},
+		{"inline code", "run `go test`", "run go test", []Span{{Text: "run "}, {Text: "go test", Code: true}}},
+		{"code block", "```x := 1```", "x := 1", []Span{{Text: "x := 1", CodeBlock: true}}},
+
+		// nesting
+		{"italics in bold", "**a *b* c**", "a b c", []Span{{Text: "a ", Bold: true}, {Text: "b", Bold: true, Italic: true}, {Text: " c", Bold: true}}},
+		{"bold in italics", "_a **b**_", "a b", []Span{{Text: "a ", Italic: true}, {Text: "b", Bold: true, Italic: true}}},
+		{"nothing is formatted in code", "`**a** _b_`", "**a** _b_", []Span{{Text: "**a** _b_", Code: true}}},
+		{"nothing is formatted in code blocks", "```*a* `b` ```", "*a* `b` ", []Span{{Text: "*a* `b` ", CodeBlock: true}}},
+		{"irc codes in markdown", "**a \x1Db\x1D**", "a b", []Span{{Text: "a ", Bold: true}, {Text: "b", Bold: true, Italic: true}}},
+
+		// unterminated markers are text
+		{"unterminated bold", "a **b", "a **b", nil},
+		{"unterminated italics", "a *b", "a *b", nil},
+		{"unterminated code", "a `b", "a `b", nil},
+		{"unterminated code block", "```a", "```a", nil},
+		{"lone star", "2 * 3 = 6", "2 * 3 = 6", nil},
+		{"star before a space", "* a*", "* a*", nil},
+		{"empty bold", "****", "****", nil},
+		{"snake_case", "my_var_name", "my_var_name", nil},
+		{"unterminated irc code runs to the end", "\x02a", "a", []Span{{Text: "a", Bold: true}}},
+
+		// escapes
+		{"escaped stars", `\*a\*`, "*a*", nil},
+		{"escaped underscore", `\_a_`, "_a_", nil},
+		{"escaped backtick", "\\`a`", "`a`", nil},
+		{"escaped backslash", `a\\*b*`, `a\b`, []Span{{Text: `a\`}, {Text: "b", Italic: true}}},
+		{"escaped closing delimiter", `*a\*`, "*a*", nil},
+		{"escaped delimiter inside italics", `*a\*b*`, "a*b", []Span{{Text: "a*b", Italic: true}}},
+		{"backslash before anything else", `C:\dir`, `C:\dir`, nil},
+		{"backslashes stay in code", "`a\\*`", `a\*`, []Span{{Text: `a\*`, Code: true}}},
+
+		// links
+		{"link", "see https://example.com/a_b_c", "see https://example.com/a_b_c", nil},
+		{"stars in a link", "http://example.com/*a*", "http://example.com/*a*", nil},
+		{"link in italics", "*see https://example.com/x_y*", "see https://example.com/x_y", []Span{{Text: "see https://example.com/x_y", Italic: true}}},
+		{"link at the end of a sentence", "go to https://example.com.", "go to https://example.com.", nil},
+		{"link with parentheses", "(https://en.wikipedia.org/wiki/Go_(language))", "(https://en.wikipedia.org/wiki/Go_(language))", nil},
+		{"link in code", "`https://example.com/_a_`", "https://example.com/_a_", []Span{{Text: "https://example.com/_a_", Code: true}}},
+		{"not a link inside a word", "xhttps://a.com/_b_", "xhttps://a.com/b", []Span{{Text: "xhttps://a.com/"}, {Text: "b", Italic: true}}},
+
+		// irc codes
+		{"irc bold", "\x02a\x02 b", "a b", []Span{{Text: "a", Bold: true}, {Text: " b"}}},
+		{"irc colors", "\x034,2a\x03 b", "a b", []Span{{Text: "a", Fg: color(4), Bg: color(2)}, {Text: " b"}}},
+		{"irc color without a number", "\x03a", "a", nil},
+		{"irc reverse", "\x033,5\x16a", "a", []Span{{Text: "a", Fg: color(5), Bg: color(3)}}},
+		{"irc reset", "\x02\x1Da\x0Fb", "ab", []Span{{Text: "a", Bold: true, Italic: true}, {Text: "b"}}},
+		{"irc hex colors are dropped", "\x04ff0000,00ff00a", "a", nil},
+		{"irc monospace", "\x11a\x11", "a", []Span{{Text: "a", Code: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain, spans := ParseRichText(tt.input)
+			if plain != tt.wantPlain {
+				t.Errorf("ParseRichText(%q) plain = %q, want %q", tt.input, plain, tt.wantPlain)
+			}
+			if !reflect.DeepEqual(spans, tt.want) {
+				t.Errorf("ParseRichText(%q) spans = %+v, want %+v", tt.input, spans, tt.want)
+			}
+		})
+	}
+}
@@ -1,197 +1,412 @@
-package chatroom
-
-import (
-	"fmt"
-	"log"
-	"time"
-
-	"github.com/google/uuid"
-)
-
-var ActiveRooms = make(map[uuid.UUID]*Room)       // the list of channels
-var StringToRoomUUID = make(map[string]uuid.UUID) // convert a channel name to its uuid
-var AllUsers = make(map[*Client]IsInRoom)
-
-type IsInRoom bool
-
-// manages active clients, and broadcasting to active clients
-type Room struct {
-	Uuid       uuid.UUID            // unique room identifier
-	RoomName   string               // name of the room
-	Clients    map[*Client]IsInRoom // the list of registered clients
-	Broadcast  chan Message         // inbound messages from clients
-	Register   chan *Client         // register requests from clients
-	Unregister chan *Client         // unregister requests from clients
-	SwitchRoom chan *RoomSwitch     // room switch requests from clients
-	isRunning  bool
-	Commands   CommandList // commands available to the server
-}
-
-type PrivateRoom struct {
-	Room
-	AllowedUsers map[uuid.UUID]bool
-}
-
-// holds a client and the target room they are switching to
-type RoomSwitch struct {
-	client     *Client
-	targetRoom *Room
-}
-
-// create a new room with a given name
-func NewRoom(roomName string) *Room {
-	r := &Room{
-		Uuid:       uuid.New(),
-		RoomName:   roomName,
-		Clients:    make(map[*Client]IsInRoom),
-		Broadcast:  make(chan Message),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
-		SwitchRoom: make(chan *RoomSwitch),
-		Commands:   NewCommandList(),
-	}
-	ActiveRooms[r.Uuid] = r
-	StringToRoomUUID[roomName] = r.Uuid
-	return r
-}
-
-// helper log functions
-func (r Room) Logf(format string, v ...any) {
-	log.Printf("[%v] %s", r.RoomName, fmt.Sprintf(format, v...))
-}
-func (r Room) Logln(v ...any) {
-	log.Printf("[%v] %s", r.RoomName, fmt.Sprintln(v...))
-}
-
-// getting client by a criteria
-func (r Room) GetClientByUuid(uuid uuid.UUID) *Client {
-	for c := range r.Clients {
-		if c.Uuid == uuid {
-			return c
-		}
-	}
-	return nil
-}
-func (r Room) GetClientByNickname(nickname string) *Client {
-	for c, isInRoom := range AllUsers {
-		if c.Nickname == nickname && isInRoom {
-			return c
-		}
-	}
-	return nil
-}
-
-// run the server
-func (r *Room) Run() {
-	r.isRunning = true
-
-	r.Logln("Starting room")
-	for {
-		select {
-		case client := <-r.Register:
-			// register an incoming user
-			r.Logf("Register %s\n", client.Nickname)
-			// broadcast "joined" message
-			go func() {
-				r.Broadcast <- r.serverMessage(fmt.Sprintf("---- <%s> joined %s ----", client.Nickname, r.RoomName))
-			}()
-			r.Clients[client] = true
-			AllUsers[client] = true
-		case client := <-r.Unregister:
-			// unregister an outgoing user
-			// check if the user is actually in the room first
-			if _, ok := r.Clients[client]; ok {
-				// they are in, remove them
-				r.Logf("Unregister %s\n", client.Nickname)
-				// broadcast "left" message
-				go func() {
-					r.Broadcast <- r.serverMessage(fmt.Sprintf("---- <%s> left %s (disconnected) ----", client.Nickname, r.RoomName))
-				}()
-				// remove from the client list
-				delete(r.Clients, client)
-				AllUsers[client] = false
-				// close the sending channel
-				close(client.Send)
-			}
-		case message := <-r.Broadcast:
-			// a message just came in from some client
-			// check if it's a slash-command first
-			if message.IsCommand() {
-				// got a command
-				r.Logf("Got command `%s` from %v\n", message.Content, message.FromNick)
-				command := message.ToCommand()
-				callingClient := r.GetClientByUuid(command.Uuid)
-				// check if the commad is in the command list
-				if r.Commands.InCommandList(command.Name) {
-					// in the list, ok to run
-					callingClient.ServerDirectMessage(r.serverMessage(message.Content))
-					// go func() {
-					// call command
-					err := r.Commands[command.Name].Operation(r, callingClient, command.Args)
-					if err != nil {
-						callingClient.ServerDirectMessage(r.serverMessage(err.Error()))
-					}
-					// }()
-				} else {
-					// otherwise say that the command doesn't exist
-					callingClient.ServerDirectMessage(r.serverMessage(fmt.Sprintf("Command not found: %s", message.Content)))
-				}
-			} else {
-				for client := range r.Clients {
-					// broadcast to all clients
-					// append the sender's username to the message
-					select {
-					case client.Send <- message:
-						r.Logf("Sent message from %s to %s\n", message.FromNick, client.Nickname)
-						// successful send
-						// nop
-					default:
-						// the client we are trying to send to doesn't exist
-						// remove them from our client list
-						r.Logf("%s is not logged in\n", client.Nickname)
-						close(client.Send)
-						delete(r.Clients, client)
-					}
-				}
-			}
-		case rs := <-r.SwitchRoom:
-			// a client wants to switch rooms
-			if _, ok := r.Clients[rs.client]; ok {
-				// remove client from client list
-				delete(r.Clients, rs.client)
-				// send "left" message
-				go func() {
-					r.Broadcast <- r.serverMessage(fmt.Sprintf("---- <%s> left %s (switched rooms) ----", rs.client.Nickname, r.RoomName))
-				}()
-				// DON'T close the send channel, need for the next room
-				// physically swtich the room
-				rs.client.CurrentRoom = rs.targetRoom
-				// move the client into the new room
-				rs.targetRoom.Register <- rs.client
-				r.Logf("Successfully moved %v to %v\n", rs.client.Nickname, rs.targetRoom.RoomName)
-			}
-		}
-	}
-}
-
-// helper method to send a message originating from the server itself
-func (r Room) serverMessage(content string) Message {
-	return Message{
-		Uuid:            r.Uuid,
-		FromNick:        fmt.Sprintf("{%s}", r.RoomName),
-		Content:         content,
-		SentTime:        time.Now(),
-		ServerName:      r.RoomName,
-		IsDirectMessage: true,
-	}
-}
-
-// checks if the nickname already exists in the room
-func (r Room) NicknameAlreadyExists(nickname string) bool {
-	for client, isInRoom := range r.Clients {
-		if isInRoom && client.Nickname == nickname {
-			return true
-		}
-	}
-	return false
-}
+package chatroom
+
+import (
+	"fmt"
+	"irc-final-project/logging"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type IsInRoom bool
+
+// manages active clients, and broadcasting to active clients
+type Room struct {
+	Uuid       uuid.UUID            // unique room identifier
+	RoomName   string               // name of the room
+	Clients    map[*Client]IsInRoom // the list of registered clients
+	Broadcast  chan Message         // inbound messages from clients
+	Register   chan *Client         // register requests from clients
+	Unregister chan *Client         // unregister requests from clients
+	Detach     chan *Client         // clients that lost their connection, and may resume
+	SwitchRoom chan *RoomSwitch     // room switch requests from clients
+	deliveries chan delivery        // server messages for one client in the room, from other rooms
+	state      int32                // roomNew, roomRunning or roomClosed, changed atomically
+	done       chan struct{}        // closed when the room is torn down
+	lastActive time.Time            // when someone was last in the room or said something there
+	Commands   *CommandList         // commands available to the server
+	history    *roomHistory         // messages posted to this room
+	info       *roomInfo            // owner, topic, modes and description
+	// nicknames allowed in a private room, like a dm between two users
+	// nil for public rooms, which everyone can join and read
+	AllowedNicks map[string]bool
+	// never torn down when idle, and saved to RoomsFile
+	Persistent bool
+}
+
+// the states a room goes through
+const (
+	roomNew     int32 = iota // made, but not started yet
+	roomRunning              // its goroutine is running
+	roomClosed               // torn down, its goroutine is gone
+)
+
+type PrivateRoom struct {
+	Room
+	AllowedUsers map[uuid.UUID]bool
+}
+
+// holds a client and the target room they are switching to
+type RoomSwitch struct {
+	client     *Client
+	targetRoom *Room
+}
+
+// holds a client and a server message for them, see Room.deliver
+type delivery struct {
+	client  *Client
+	message Message
+}
+
+// create a new room with a given name
+func NewRoom(roomName string) *Room {
+	r := newRoom(roomName)
+	AddRoomName(roomName, r)
+	return r
+}
+
+// same as NewRoom, without adding the room to the room list
+func newRoom(roomName string) *Room {
+	return &Room{
+		Uuid:       uuid.New(),
+		RoomName:   roomName,
+		Clients:    make(map[*Client]IsInRoom),
+		Broadcast:  make(chan Message),
+		Register:   make(chan *Client),
+		Unregister: make(chan *Client),
+		Detach:     make(chan *Client),
+		SwitchRoom: make(chan *RoomSwitch),
+		deliveries: make(chan delivery),
+		done:       make(chan struct{}),
+		Commands:   DefaultCommands,
+		history:    newRoomHistory(),
+		info:       &roomInfo{info: RoomInfo{Name: roomName}},
+	}
+}
+
+// runs the room, unless it is already running
+func (r *Room) Start() {
+	if atomic.CompareAndSwapInt32(&r.state, roomNew, roomRunning) {
+		go r.Run()
+	}
+}
+
+// puts a client in a room, starting the room if needed
+// if the room was torn down in the meantime, the client goes to the room that replaced it
+// returns the room the client ended up in
+func (r *Room) admit(c *Client) *Room {
+	for {
+		r.Start()
+		c.setCurrentRoom(r)
+		select {
+		case r.Register <- c:
+			return r
+		case <-r.done:
+			r = reopenRoom(r)
+		}
+	}
+}
+
+// makes a new private room that only the given nicknames can join and read
+func NewPrivateRoom(roomName string, nicknames ...string) *Room {
+	r := NewRoom(roomName)
+	r.AllowedNicks = make(map[string]bool)
+	for _, nickname := range nicknames {
+		r.AllowedNicks[nickname] = true
+	}
+	return r
+}
+
+// checks if a user may join and read this room
+func (r *Room) IsMember(nickname string) bool {
+	return r.AllowedNicks == nil || r.AllowedNicks[nickname]
+}
+
+// the log lines of rooms, and of commands run in them
+var roomLog = logging.New("room")
+
+// helper log functions, for details that are only logged at debug level
+func (r *Room) Logf(format string, v ...any) {
+	r.logEvent(logging.LevelDebug, "debug", nil, logging.Fields{"msg": strings.TrimSpace(fmt.Sprintf(format, v...))})
+}
+func (r *Room) Logln(v ...any) {
+	r.logEvent(logging.LevelDebug, "debug", nil, logging.Fields{"msg": strings.TrimSpace(fmt.Sprintln(v...))})
+}
+
+// logs something that happened in the room, to a client if c isn't nil
+func (r *Room) logEvent(level logging.Level, event string, c *Client, fields logging.Fields) {
+	if fields == nil {
+		fields = logging.Fields{}
+	}
+	fields["room"] = r.RoomName
+	if c != nil {
+		fields["uuid"] = c.Uuid.String()
+		fields["nick"] = c.Nickname
+	}
+	roomLog.Log(level, event, fields)
+}
+
+// getting client by a criteria
+func (r *Room) GetClientByUuid(uuid uuid.UUID) *Client {
+	for c := range r.Clients {
+		if c.Uuid == uuid {
+			return c
+		}
+	}
+	return nil
+}
+func (r *Room) GetClientByNickname(nickname string) *Client {
+	c, _ := users.find(nickname)
+	return c
+}
+
+// run the server
+func (r *Room) Run() {
+	atomic.StoreInt32(&r.state, roomRunning)
+	r.lastActive = time.Now()
+	// check for being idle every so often, if idle rooms are torn down
+	var idleCheck <-chan time.Time
+	if RoomIdleTimeout > 0 && !r.Persistent {
+		ticker := time.NewTicker(RoomIdleTimeout / 4)
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+
+	r.logEvent(logging.LevelInfo, "start", nil, logging.Fields{"persistent": r.Persistent})
+	for {
+		select {
+		case <-idleCheck:
+			if r.isIdle() {
+				r.tearDown()
+				return
+			}
+		case client := <-r.Register:
+			if client.detached {
+				// they are back, nobody needs to know they were gone
+				r.reattach(client)
+				continue
+			}
+			// register an incoming user
+			r.logEvent(logging.LevelInfo, "join", client, logging.Fields{"bot": client.IsBot()})
+			// broadcast "joined" message
+			r.announce(r.serverMessage(fmt.Sprintf("---- <%s> joined %s ----", client.Nickname, r.RoomName)))
+			r.Clients[client] = true
+			// the client won't see anything older, so start reading from here
+			readMarkers.advance(client.Nickname, r.RoomName, r.history.latestId(), r.history)
+			if !client.IsBot() && !client.sawMotd {
+				// only in the first room they enter
+				client.sawMotd = true
+				r.sendMotd(client)
+			}
+			if topic := r.Info().Topic; topic != "" {
+				client.ServerDirectMessage(r.serverMessage(fmt.Sprintf("Topic of %s: %s", r.RoomName, topic)))
+			}
+			client.ServerDirectMessage(r.unreadMessage(unreadSummary(client.Nickname)))
+			if client.IsBot() {
+				client.botJoined(r)
+			}
+		case client := <-r.Unregister:
+			// unregister an outgoing user
+			r.unregister(client)
+		case client := <-r.Detach:
+			if _, ok := r.Clients[client]; !ok {
+				continue
+			}
+			// keep them in the room without a connection for a while, unless they can't resume
+			if !resumes.wait(client, func() { r.Unregister <- client }) {
+				r.unregister(client)
+				continue
+			}
+			r.logEvent(logging.LevelInfo, "detach", client, logging.Fields{"grace": ResumeGrace.String()})
+			client.detached = true
+			client.holdMessages()
+			close(client.Send)
+		case d := <-r.deliveries:
+			// they may have left since, and those who lost their connection are told when they resume
+			if _, ok := r.Clients[d.client]; !ok || d.client.detached {
+				continue
+			}
+			if d.client.IsBot() {
+				d.client.sendToBot(serverDirectMessage(d.message))
+				continue
+			}
+			r.enqueue(d.client, serverDirectMessage(d.message))
+		case message := <-r.Broadcast:
+			r.lastActive = time.Now()
+			// a message just came in from some client
+			// check if it's a slash-command first
+			if message.IsCommand() {
+				// got a command
+				command := message.ToCommand()
+				callingClient := r.GetClientByUuid(command.Uuid)
+				if callingClient == nil {
+					// they left, or switched rooms, after sending it
+					r.logEvent(logging.LevelDebug, "command-dropped", nil, logging.Fields{"command": command.Name})
+					continue
+				}
+				r.logEvent(logging.LevelInfo, "command", callingClient, logging.Fields{"command": command.Name, "line": r.loggable(message.Content)})
+				// check if the commad is in the command list
+				if cmd, ok := r.Commands.Lookup(command.Name); ok {
+					// in the list, ok to run
+					if !cmd.Quiet {
+						callingClient.ServerDirectMessage(r.serverMessage(message.Content))
+					}
+					// go func() {
+					// call command
+					err := cmd.Run(r, callingClient, command.Args)
+					if err != nil {
+						callingClient.ServerDirectMessage(r.serverMessage(err.Error()))
+					}
+					// }()
+				} else {
+					// otherwise say that the command doesn't exist
+					callingClient.ServerDirectMessage(r.serverMessage(fmt.Sprintf("Command not found: %s", message.Content)))
+				}
+			} else {
+				if sender := r.GetClientByUuid(message.Uuid); sender != nil {
+					if !r.canSpeak(sender) {
+						sender.ServerDirectMessage(r.serverMessage(fmt.Sprintf("%s is moderated, only its owner and operators can talk", r.RoomName)))
+						continue
+					}
+					// they're done typing, let their next typing signal through right away
+					sender.lastTyping = time.Time{}
+				}
+				r.postMessage(message)
+			}
+		case rs := <-r.SwitchRoom:
+			// a client wants to switch rooms
+			if _, ok := r.Clients[rs.client]; ok {
+				// remove client from client list
+				delete(r.Clients, rs.client)
+				r.lastActive = time.Now()
+				// send "left" message
+				r.announce(r.serverMessage(fmt.Sprintf("---- <%s> left %s (switched rooms) ----", rs.client.Nickname, r.RoomName)))
+				// DON'T close the send channel, need for the next room
+				// physically swtich the room, and move the client into the new room
+				// not on this goroutine, the other room may be moving someone here at the same time
+				go func(rs *RoomSwitch) {
+					target := rs.targetRoom.admit(rs.client)
+					r.logEvent(logging.LevelInfo, "leave", rs.client, logging.Fields{"reason": "switched rooms", "to": target.RoomName})
+				}(rs)
+			}
+		}
+	}
+}
+
+// takes a client out of the room for good, and tells everyone they left
+func (r *Room) unregister(client *Client) {
+	// check if the user is actually in the room first
+	if _, ok := r.Clients[client]; !ok {
+		return
+	}
+	// they are in, remove them
+	r.logEvent(logging.LevelInfo, "leave", client, logging.Fields{"reason": "disconnected"})
+	// broadcast "left" message
+	r.announce(r.serverMessage(fmt.Sprintf("---- <%s> left %s (disconnected) ----", client.Nickname, r.RoomName)))
+	// remove from the client list
+	delete(r.Clients, client)
+	users.remove(client)
+	r.lastActive = time.Now()
+	resumes.forget(client)
+	// close the sending channel, unless it was closed when they lost their connection
+	if !client.detached {
+		close(client.Send)
+	}
+}
+
+// takes back a client that resumed after losing its connection, with the new connection already set
+// they are told their new tokens, then sent the direct messages and room messages they missed, as if they never left
+func (r *Room) reattach(client *Client) {
+	r.logEvent(logging.LevelInfo, "resume", client, nil)
+	client.detached = false
+	client.Send = make(chan Message, SendQueueSize)
+	client.dropped = 0
+	client.releaseMessages(serverDirectMessage(r.sessionMessage(client)))
+	for _, message := range r.history.since(atomic.LoadUint64(&client.lastDelivered)) {
+		if !ignoredBy(client, message) {
+			client.write(highlightFor(client, message))
+		}
+	}
+	readMarkers.advance(client.Nickname, r.RoomName, r.history.latestId(), r.history)
+	client.ServerDirectMessage(r.unreadMessage(unreadSummary(client.Nickname)))
+	// only now is there a send queue for it to write from
+	go client.writeSocket()
+}
+
+// gives a message an id, remembers it, and broadcasts it to all clients in the room
+func (r *Room) postMessage(message Message) {
+	message.Id = nextMessageId()
+	if message.Kind == KindChat || message.Kind == KindAction || message.Kind == KindNotice {
+		// keep formatting codes out of the plain text
+		message.Content, message.Rich = ParseRichText(message.Content)
+	}
+	r.history.add(message)
+	r.sendToAll(message)
+	for client := range r.Clients {
+		if client.detached {
+			// they will see it when they resume
+			continue
+		}
+		// they saw it come in
+		readMarkers.advance(client.Nickname, r.RoomName, message.Id, r.history)
+	}
+	r.recordMentions(message)
+	r.notifyUnread(message)
+}
+
+// broadcasts a server message through the room's goroutine, usually from that goroutine itself
+// so it doesn't wait, and gives up if the room is torn down first
+func (r *Room) announce(message Message) {
+	go func() {
+		select {
+		case r.Broadcast <- message:
+		case <-r.done:
+		}
+	}()
+}
+
+// hands a server message for one of the room's clients to the room, to queue like its other messages
+// called from other rooms, so it doesn't wait for this one, which may be handing something to them
+func (r *Room) deliver(client *Client, message Message) {
+	go func() {
+		select {
+		case r.deliveries <- delivery{client: client, message: message}:
+		case <-r.done:
+		}
+	}()
+}
+
+// sends a message to all clients in the room, without remembering it
+func (r *Room) sendToAll(message Message) {
+	r.sendToAllExcept(nil, message)
+}
+
+// sends a message to all clients in the room but one, without remembering it
+func (r *Room) sendToAllExcept(except *Client, message Message) {
+	for client := range r.Clients {
+		if client == except || client.detached || ignoredBy(client, message) {
+			continue
+		}
+		if client.IsBot() {
+			// bots that fall behind miss messages, but stay in the room
+			client.sendToBot(highlightFor(client, message))
+			continue
+		}
+		// broadcast to all clients
+		r.enqueue(client, highlightFor(client, message))
+	}
+}
+
+// helper method to send a message originating from the server itself
+func (r *Room) serverMessage(content string) Message {
+	return Message{
+		Uuid:            r.Uuid,
+		FromNick:        fmt.Sprintf("{%s}", r.RoomName),
+		Content:         content,
+		SentTime:        time.Now(),
+		ServerName:      r.RoomName,
+		IsDirectMessage: true,
+	}
+}
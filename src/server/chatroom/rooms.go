@@ -0,0 +1,390 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"irc-final-project/logging"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// file the persistent rooms are saved to, empty to not save them
+var RoomsFile = "rooms.json"
+
+// how long a room nobody is in is kept around before it is torn down, 0 to keep every room
+// persistent rooms are never torn down
+var RoomIdleTimeout = time.Minute * 10
+
+// the modes a room can have
+// t: only the room's owner and operators can change the topic
+// m: only the room's owner and operators can talk
+const ValidModes = "mt"
+
+// what a room is about, saved for persistent rooms
+type RoomInfo struct {
+	Name        string `json:"Name"`
+	Owner       string `json:"Owner,omitempty"`       // who made the room: the operator name for persistent rooms, the nickname for others
+	Topic       string `json:"Topic,omitempty"`       // what is being talked about now, can be changed with `/topic`
+	Modes       string `json:"Modes,omitempty"`       // letters from ValidModes
+	Description string `json:"Description,omitempty"` // what the room is for
+}
+
+// a room's info, other rooms may read it so it has its own lock
+type roomInfo struct {
+	lock sync.RWMutex
+	info RoomInfo
+	// the client that made the room and owns it, uuid.Nil for persistent rooms, which operators own
+	// anyone can connect with the owner's nickname, so ownership goes with the client rather than the nickname
+	owner uuid.UUID
+}
+
+// the rooms on the server, by name
+// dm rooms have two names, one for each order of the two nicknames
+type roomRegistry struct {
+	lock   sync.RWMutex
+	byName map[string]*Room
+}
+
+var rooms = roomRegistry{byName: make(map[string]*Room)}
+
+// finds a room by its name
+func FindRoom(name string) (*Room, bool) {
+	rooms.lock.RLock()
+	defer rooms.lock.RUnlock()
+	r, ok := rooms.byName[name]
+	return r, ok
+}
+
+// every room, once each, sorted by name
+func AllRooms() []*Room {
+	rooms.lock.RLock()
+	seen := make(map[*Room]bool)
+	var all []*Room
+	for _, r := range rooms.byName {
+		if !seen[r] {
+			seen[r] = true
+			all = append(all, r)
+		}
+	}
+	rooms.lock.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].RoomName < all[j].RoomName })
+	return all
+}
+
+// gives a room another name it can be found by, like the second name of a dm room
+func AddRoomName(name string, r *Room) {
+	rooms.lock.Lock()
+	defer rooms.lock.Unlock()
+	rooms.byName[name] = r
+}
+
+// adds a room under its name, unless another room has that name
+// returns false if one does
+func (reg *roomRegistry) addNew(r *Room) bool {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if _, ok := reg.byName[r.RoomName]; ok {
+		return false
+	}
+	reg.byName[r.RoomName] = r
+	return true
+}
+
+// every name and the room it belongs to
+func (reg *roomRegistry) names() map[string]*Room {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	names := make(map[string]*Room, len(reg.byName))
+	for name, r := range reg.byName {
+		names[name] = r
+	}
+	return names
+}
+
+// forgets every name of a room
+func (reg *roomRegistry) remove(r *Room) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	for name, room := range reg.byName {
+		if room == r {
+			delete(reg.byName, name)
+		}
+	}
+}
+
+// finds a room by its name, or makes one that isn't on the room list yet
+// it is listed by publishRoom once someone gets in, so nobody turned away leaves a room behind
+// returns the names to list it under
+func findOrNewRoom(name string) (*Room, []string) {
+	if r, ok := FindRoom(name); ok {
+		return r, []string{name}
+	}
+	return newRoom(name), []string{name}
+}
+
+// finds the private room of two users, or makes one only the two of them can read, like findOrNewRoom
+// this room is called `targetname-sourcename` and `sourcename-targetname`, both names point to the same room
+func findOrNewDirectRoom(source, target string) (*Room, []string) {
+	names := []string{target + "-" + source, source + "-" + target}
+	rooms.lock.RLock()
+	defer rooms.lock.RUnlock()
+	for _, name := range names {
+		if r, ok := rooms.byName[name]; ok {
+			return r, names
+		}
+	}
+	r := newRoom(names[0])
+	r.AllowedNicks = map[string]bool{source: true, target: true}
+	return r, names
+}
+
+// puts a room on the room list under whichever of its names are missing
+// if another room took one of the names in the meantime, that room is listed and returned instead
+// and a room that was torn down is replaced by a new room like it
+func publishRoom(r *Room, names ...string) *Room {
+	rooms.lock.Lock()
+	defer rooms.lock.Unlock()
+	listed := r
+	found := false
+	for _, name := range names {
+		if room, ok := rooms.byName[name]; ok {
+			listed = room
+			found = true
+			break
+		}
+	}
+	if !found && atomic.LoadInt32(&r.state) == roomClosed {
+		listed = newRoom(r.RoomName)
+		listed.AllowedNicks = r.AllowedNicks
+	}
+	// set whichever key is missing
+	for _, name := range names {
+		if _, ok := rooms.byName[name]; !ok {
+			rooms.byName[name] = listed
+		}
+	}
+	return listed
+}
+
+// a room to use instead of one that was torn down
+// that is whichever room has its name now, or a new room like it
+func reopenRoom(old *Room) *Room {
+	return publishRoom(old, old.RoomName)
+}
+
+// checks that modes are letters from ValidModes, each given once
+func CheckModes(modes string) error {
+	for i, mode := range modes {
+		if !strings.ContainsRune(ValidModes, mode) {
+			return fmt.Errorf("`%c` is not a room mode, the modes are `%s`", mode, ValidModes)
+		}
+		if strings.ContainsRune(modes[:i], mode) {
+			return fmt.Errorf("mode `%c` is given twice", mode)
+		}
+	}
+	return nil
+}
+
+// makes a room that is never torn down for being idle, and starts it
+// fails if a room already has its name
+func NewPersistentRoom(info RoomInfo) (*Room, error) {
+	if info.Name == "" {
+		return nil, errors.New("a room needs a name")
+	}
+	if err := CheckModes(info.Modes); err != nil {
+		return nil, fmt.Errorf("room `%s`: %w", info.Name, err)
+	}
+	r := newRoom(info.Name)
+	// set up before anyone can find it
+	r.Persistent = true
+	r.info.info = info
+	if !rooms.addNew(r) {
+		return nil, fmt.Errorf("room `%s` already exists", info.Name)
+	}
+	r.Start()
+	return r, nil
+}
+
+// a copy of the room's info
+func (r *Room) Info() RoomInfo {
+	r.info.lock.RLock()
+	defer r.info.lock.RUnlock()
+	return r.info.info
+}
+
+// checks if the room has a mode
+func (r *Room) hasMode(mode rune) bool {
+	return strings.ContainsRune(r.Info().Modes, mode)
+}
+
+// checks if a client runs the room: the client that made it, or a server operator
+func (r *Room) isRoomOperator(c *Client) bool {
+	if c.Permission >= PermissionOperator {
+		return true
+	}
+	r.info.lock.RLock()
+	defer r.info.lock.RUnlock()
+	return r.info.owner != uuid.Nil && r.info.owner == c.Uuid
+}
+
+// checks if a client may talk in the room, see mode m
+func (r *Room) canSpeak(c *Client) bool {
+	return !r.hasMode('m') || r.isRoomOperator(c)
+}
+
+// checks if the room can be torn down: nobody is in it, and nobody has been for a while
+// only called from the room's goroutine
+func (r *Room) isIdle() bool {
+	return !r.Persistent && RoomIdleTimeout > 0 && len(r.Clients) == 0 && time.Since(r.lastActive) >= RoomIdleTimeout
+}
+
+// takes an idle room off the room list, and lets anyone trying to join it know to look for it again
+// only called from the room's goroutine, which stops right after
+func (r *Room) tearDown() {
+	// closed before it is off the list, so publishRoom never puts it back
+	atomic.StoreInt32(&r.state, roomClosed)
+	rooms.remove(r)
+	readMarkers.clear(r.RoomName)
+	close(r.done)
+	r.logEvent(logging.LevelInfo, "teardown", nil, logging.Fields{"idle": RoomIdleTimeout.String()})
+	r.audit("teardown", nil, r.RoomName, fmt.Sprintf("idle for %s", RoomIdleTimeout))
+}
+
+// loads the rooms saved in RoomsFile, and starts them
+// rooms that already exist, like the ones from the config file, only get their saved topic back
+// a missing file is fine, no room was saved yet
+func LoadRooms() error {
+	if RoomsFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(RoomsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []RoomInfo
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %w", RoomsFile, err)
+	}
+	for _, info := range saved {
+		if r, ok := FindRoom(info.Name); ok {
+			r.info.lock.Lock()
+			r.info.info.Topic = info.Topic
+			r.info.lock.Unlock()
+			continue
+		}
+		if _, err := NewPersistentRoom(info); err != nil {
+			return fmt.Errorf("%s: %w", RoomsFile, err)
+		}
+	}
+	return nil
+}
+
+// writes every persistent room to RoomsFile
+func saveRooms() error {
+	if RoomsFile == "" {
+		return nil
+	}
+	var saved []RoomInfo
+	for _, r := range AllRooms() {
+		if r.Persistent {
+			saved = append(saved, r.Info())
+		}
+	}
+	return saveJSON(RoomsFile, saved)
+}
+
+// writes something as JSON to a file
+// it is written to a temporary file first, so a crash can't leave half a file behind
+func saveJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// shows or changes the topic of the current room: `/topic [topic]`
+func topic(r *Room, c *Client, args Args) *CommandError {
+	if !args.Has("topic") {
+		info := r.Info()
+		if info.Topic == "" {
+			c.ServerDirectMessage(r.serverMessage(fmt.Sprintf("%s has no topic", r.RoomName)))
+		} else {
+			c.ServerDirectMessage(r.serverMessage(fmt.Sprintf("Topic of %s: %s", r.RoomName, info.Topic)))
+		}
+		return nil
+	}
+	if r.hasMode('t') && !r.isRoomOperator(c) {
+		return &CommandError{
+			CommandName: "topic",
+			Reason:      fmt.Sprintf("Only the owner of %s and operators can change its topic", r.RoomName),
+		}
+	}
+	newTopic := args.String("topic")
+	r.info.lock.Lock()
+	r.info.info.Topic = newTopic
+	r.info.lock.Unlock()
+	if r.Persistent {
+		if err := saveRooms(); err != nil {
+			r.logEvent(logging.LevelError, "save-rooms", c, logging.Fields{"error": err})
+		}
+	}
+	r.sendToAll(r.serverMessage(fmt.Sprintf("---- <%s> changed the topic to: %s ----", c.Nickname, newTopic)))
+	r.Logf("%s changed the topic to `%s`\n", c.Nickname, newTopic)
+	return nil
+}
+
+// shows what a room is about, the current room if not given: `/roominfo [roomName]`
+func roomInfoCommand(r *Room, c *Client, args Args) *CommandError {
+	room := r
+	if args.Has("roomName") {
+		room = args.Room("roomName")
+	}
+	info := room.Info()
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("\nRoom %s:\n", room.RoomName))
+	builder.WriteString("---------\n")
+	if info.Description != "" {
+		builder.WriteString(fmt.Sprintf("Description: %s\n", info.Description))
+	}
+	if info.Topic != "" {
+		builder.WriteString(fmt.Sprintf("Topic: %s\n", info.Topic))
+	}
+	if info.Owner != "" {
+		builder.WriteString(fmt.Sprintf("Owner: %s\n", info.Owner))
+	}
+	if info.Modes != "" {
+		builder.WriteString(fmt.Sprintf("Modes: +%s\n", info.Modes))
+	}
+	if room.Persistent {
+		builder.WriteString("Persistent\n")
+	}
+	if room.AllowedNicks != nil {
+		builder.WriteString("Private\n")
+	}
+	c.ServerDirectMessage(r.serverMessage(builder.String()))
+	return nil
+}
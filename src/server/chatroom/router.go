@@ -0,0 +1,42 @@
+package chatroom
+
+import (
+	"irc-final-project/logging"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// the chat's http routes: the websockets, search and file sharing
+// the server adds its own, like the web client's page
+func NewRouter() *mux.Router {
+	r := mux.NewRouter()
+	// search room history
+	r.HandleFunc("/search", ServeSearch)
+	// share files to a room, and download them
+	r.HandleFunc("/upload", ServeUpload)
+	r.HandleFunc("/files/{id}", ServeFile)
+	// for private messaging people
+	r.HandleFunc("/ws/{sourcename}/{targetname}", ServeDirectMessages)
+	// actual websocket connection for the client to communicate with the server
+	r.HandleFunc("/ws/{servername}", ServeRoom)
+	return r
+}
+
+// connects a client to the room in the path, making the room if there is none
+func ServeRoom(w http.ResponseWriter, r *http.Request) {
+	httpLog.Debug("websocket", logging.Fields{"path": r.URL.Path})
+	room, names := findOrNewRoom(mux.Vars(r)["servername"])
+	// the room is listed and started when the client enters it
+	ServeWebSocket(room, names, w, r)
+}
+
+// connects a client to the private room it shares with another user
+// sourcename is you, targetname is the person you're sending the dms to
+func ServeDirectMessages(w http.ResponseWriter, r *http.Request) {
+	httpLog.Debug("websocket", logging.Fields{"path": r.URL.Path})
+	vars := mux.Vars(r)
+	room, names := findOrNewDirectRoom(vars["sourcename"], vars["targetname"])
+	// the room is listed and started when the client enters it
+	ServeWebSocket(room, names, w, r)
+}
@@ -0,0 +1,295 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"irc-final-project/logging"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how many search results fit on one page
+const searchPageSize = 10
+
+// the date and time formats accepted by `after:` and `before:`
+var searchTimeFormats = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+var (
+	ErrNoSuchRoom  = errors.New("room does not exist")
+	ErrPrivateRoom = errors.New("room is private")
+)
+
+// what to look for in room history
+type SearchQuery struct {
+	Rooms  []string       // names of the rooms to search, empty for every room the user can read
+	Nicks  []string       // only messages from these users, empty for any user
+	After  time.Time      // only messages sent after this, zero for no limit
+	Before time.Time      // only messages sent before this, zero for no limit
+	Text   string         // text the message has to contain, ignoring case
+	Regex  *regexp.Regexp // if not nil, used instead of Text
+	Page   int            // which page of results to return, starting at 1
+}
+
+// one page of messages matching a search, newest first
+type SearchResults struct {
+	Messages []Message `json:"Messages"`
+	Total    int       `json:"Total"` // how many messages matched in total
+	Page     int       `json:"Page"`
+	Pages    int       `json:"Pages"`
+}
+
+// parses a date or a date and time for searching
+func parseSearchTime(s string) (time.Time, error) {
+	for _, format := range searchTimeFormats {
+		if t, err := time.ParseInLocation(format, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("`%s` is not a date like 2006-01-02 or a time like 2006-01-02T15:04", s)
+}
+
+// parses a page number for searching
+func parseSearchPage(s string) (int, error) {
+	page, err := strconv.Atoi(s)
+	if err != nil || page < 1 {
+		return 0, fmt.Errorf("`%s` is not a page number", s)
+	}
+	return page, nil
+}
+
+// compiles a regular expression for searching, ignoring case
+func compileSearchRegex(s string) (*regexp.Regexp, error) {
+	regex, err := regexp.Compile("(?i)" + s)
+	if err != nil {
+		return nil, fmt.Errorf("`%s` is not a valid regular expression: %v", s, err)
+	}
+	return regex, nil
+}
+
+// parses the query part of `/search`, made of filters like `from:nick` and the text to look for
+func ParseSearchQuery(s string) (SearchQuery, error) {
+	query := SearchQuery{Page: 1}
+	var text []string
+	for _, word := range strings.Fields(s) {
+		key, value, found := strings.Cut(word, ":")
+		if !found || value == "" {
+			text = append(text, word)
+			continue
+		}
+		var err error
+		switch key {
+		case "from":
+			query.Nicks = append(query.Nicks, value)
+		case "after":
+			query.After, err = parseSearchTime(value)
+		case "before":
+			query.Before, err = parseSearchTime(value)
+		case "page":
+			query.Page, err = parseSearchPage(value)
+		default:
+			// not a filter, eg a url
+			text = append(text, word)
+		}
+		if err != nil {
+			return query, err
+		}
+	}
+	query.Text = strings.Join(text, " ")
+	if len(query.Text) >= 2 && strings.HasPrefix(query.Text, "/") && strings.HasSuffix(query.Text, "/") {
+		regex, err := compileSearchRegex(query.Text[1 : len(query.Text)-1])
+		if err != nil {
+			return query, err
+		}
+		query.Regex = regex
+	}
+	return query, nil
+}
+
+// checks if a message matches the query, not looking at which room it is in
+func (q SearchQuery) matches(m Message) bool {
+	if !m.IsChat() {
+		return false
+	}
+	if len(q.Nicks) > 0 {
+		found := false
+		for _, nick := range q.Nicks {
+			if strings.EqualFold(nick, m.FromNick) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !q.After.IsZero() && !m.SentTime.After(q.After) {
+		return false
+	}
+	if !q.Before.IsZero() && !m.SentTime.Before(q.Before) {
+		return false
+	}
+	if q.Regex != nil {
+		return q.Regex.MatchString(m.Content)
+	}
+	return strings.Contains(strings.ToLower(m.Content), strings.ToLower(q.Text))
+}
+
+// searches the history of the rooms a user can read
+// rooms the user isn't a member of are an error if asked for by name, and skipped otherwise
+func Search(q SearchQuery, nickname string) (SearchResults, error) {
+	var rooms []*Room
+	if len(q.Rooms) == 0 {
+		for _, room := range AllRooms() {
+			if room.IsMember(nickname) {
+				rooms = append(rooms, room)
+			}
+		}
+	} else {
+		for _, name := range q.Rooms {
+			room, ok := FindRoom(name)
+			if !ok {
+				return SearchResults{}, fmt.Errorf("`%s`: %w", name, ErrNoSuchRoom)
+			}
+			if !room.IsMember(nickname) {
+				return SearchResults{}, fmt.Errorf("`%s`: %w", name, ErrPrivateRoom)
+			}
+			rooms = append(rooms, room)
+		}
+	}
+
+	var matches []Message
+	for _, room := range rooms {
+		for _, m := range room.history.all() {
+			if q.matches(m) {
+				matches = append(matches, m)
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Id > matches[j].Id })
+
+	results := SearchResults{
+		Total: len(matches),
+		Page:  q.Page,
+		Pages: (len(matches) + searchPageSize - 1) / searchPageSize,
+	}
+	if results.Page < 1 {
+		results.Page = 1
+	}
+	start := (results.Page - 1) * searchPageSize
+	if start < len(matches) {
+		end := start + searchPageSize
+		if end > len(matches) {
+			end = len(matches)
+		}
+		results.Messages = matches[start:end]
+	}
+	return results, nil
+}
+
+// searches room history: `/search [--room roomName] [--all] [--regex] query`
+// `/search roomName query` and `/search * query` work too, when the first word is a room or `*`
+func search(r *Room, c *Client, args Args) *CommandError {
+	s := args.String("query")
+	rooms := []string{r.RoomName}
+	switch {
+	case args.Bool("all"):
+		rooms = nil
+	case args.Has("room"):
+		rooms = []string{args.Room("room").RoomName}
+	default:
+		if word, rest := nextWord(s); strings.TrimSpace(rest) != "" {
+			if word == "*" {
+				rooms, s = nil, strings.TrimSpace(rest)
+			} else if room, ok := FindRoom(word); ok {
+				rooms, s = []string{room.RoomName}, strings.TrimSpace(rest)
+			}
+		}
+	}
+	query, err := ParseSearchQuery(s)
+	if err == nil && args.Bool("regex") {
+		query.Regex, err = compileSearchRegex(query.Text)
+	}
+	if err != nil {
+		return &CommandError{CommandName: "search", Reason: err.Error()}
+	}
+	query.Rooms = rooms
+	results, err := Search(query, c.Nickname)
+	if err != nil {
+		return &CommandError{CommandName: "search", Reason: err.Error()}
+	}
+
+	var builder strings.Builder
+	if results.Total == 0 {
+		builder.WriteString("\nNo messages found.\n")
+	} else if len(results.Messages) == 0 {
+		builder.WriteString(fmt.Sprintf("\nNo page %d, there are %d pages of results.\n", results.Page, results.Pages))
+	} else {
+		first := (results.Page-1)*searchPageSize + 1
+		builder.WriteString(fmt.Sprintf("\nSearch results %d-%d of %d (page %d/%d):\n", first, first+len(results.Messages)-1, results.Total, results.Page, results.Pages))
+		builder.WriteString("---------\n")
+		for _, m := range results.Messages {
+			builder.WriteString(fmt.Sprintf("#%d [%s] %s <%s> %s\n", m.Id, m.SentTime.Format("2006-01-02 15:04:05"), m.ServerName, m.FromNick, m.Content))
+		}
+		if results.Page < results.Pages {
+			builder.WriteString(fmt.Sprintf("Add page:%d to the search to see more.\n", results.Page+1))
+		}
+	}
+	c.ServerDirectMessage(r.serverMessage(builder.String()))
+	r.Logf("%s searched for `%s`, %d results\n", c.Nickname, s, results.Total)
+	return nil
+}
+
+// http endpoint for searching room history
+// GET /search?session=...&q=...&room=...&from=...&after=...&before=...&regex=true&page=...
+// `room` and `from` can be given more than once, and the query can use the same filters as `/search`
+// the session is the searching client's, so private rooms are only searched for their members
+func ServeSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	client, ok := sessions.get(params.Get("session"))
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusUnauthorized)
+		return
+	}
+	query, err := ParseSearchQuery(params.Get("q"))
+	if err == nil && params.Get("regex") == "true" {
+		query.Regex, err = compileSearchRegex(query.Text)
+	}
+	if err == nil && params.Get("after") != "" {
+		query.After, err = parseSearchTime(params.Get("after"))
+	}
+	if err == nil && params.Get("before") != "" {
+		query.Before, err = parseSearchTime(params.Get("before"))
+	}
+	if err == nil && params.Get("page") != "" {
+		query.Page, err = parseSearchPage(params.Get("page"))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.Rooms = params["room"]
+	query.Nicks = append(query.Nicks, params["from"]...)
+
+	results, err := Search(query, client.Nickname)
+	switch {
+	case errors.Is(err, ErrNoSuchRoom):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		httpLog.Error("search", logging.Fields{"error": err, "path": r.URL.Path})
+	}
+}
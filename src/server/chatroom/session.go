@@ -0,0 +1,136 @@
+package chatroom
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// makes a random hex token that can't be guessed
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// the connected clients by their session token
+// lets http requests act on behalf of a websocket connection, eg for uploads
+type sessionStore struct {
+	lock    sync.RWMutex
+	clients map[string]*Client
+}
+
+var sessions = sessionStore{clients: make(map[string]*Client)}
+
+// gives a client a new session token
+func (s *sessionStore) add(c *Client) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c.SessionToken = newToken()
+	s.clients[c.SessionToken] = c
+}
+
+// gets the client a session token belongs to
+func (s *sessionStore) get(token string) (*Client, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	c, ok := s.clients[token]
+	return c, ok
+}
+
+// ends a client's session
+func (s *sessionStore) remove(c *Client) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.clients, c.SessionToken)
+}
+
+// the message telling a newly connected client about its session
+func (r *Room) sessionMessage(c *Client) Message {
+	m := r.serverMessage("Connected as " + c.Nickname)
+	m.Kind = KindSession
+	m.SessionToken = c.SessionToken
+	m.ResumeToken = c.resumeToken
+	return m
+}
+
+// how long a client that lost its connection can come back as itself, 0 to not let clients resume
+// until then, it stays in its room without anyone being told it left
+var ResumeGrace = time.Second * 30
+
+// the tokens clients can resume their session with, after losing their connection
+type resumeStore struct {
+	lock    sync.Mutex
+	clients map[string]*Client      // resume token -> client, for every client that can resume
+	waiting map[*Client]*time.Timer // clients that lost their connection -> when to give up on them
+}
+
+var resumes = resumeStore{clients: make(map[string]*Client), waiting: make(map[*Client]*time.Timer)}
+
+// gives a client a new resume token, if clients can resume
+func (s *resumeStore) add(c *Client) {
+	if ResumeGrace <= 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.clients, c.resumeToken)
+	c.resumeToken = newToken()
+	s.clients[c.resumeToken] = c
+}
+
+// keeps a client that lost its connection for ResumeGrace, then calls giveUp
+// returns false if the client can't resume, because it was kicked or has no token
+func (s *resumeStore) wait(c *Client, giveUp func()) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if c.resumeToken == "" || s.clients[c.resumeToken] != c {
+		return false
+	}
+	s.waiting[c] = time.AfterFunc(ResumeGrace, func() {
+		if s.forget(c) {
+			giveUp()
+		}
+	})
+	return true
+}
+
+// gets the client waiting to resume with a token, and gives it a new token
+// returns false if no client is waiting with it: it was never given out, the grace ran out, or the client is still connected
+func (s *resumeStore) take(token string) (*Client, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, ok := s.clients[token]
+	if !ok {
+		return nil, false
+	}
+	timer, ok := s.waiting[c]
+	if !ok || !timer.Stop() {
+		// still connected, or being given up on right now
+		return nil, false
+	}
+	delete(s.waiting, c)
+	delete(s.clients, token)
+	c.resumeToken = newToken()
+	s.clients[c.resumeToken] = c
+	return c, true
+}
+
+// makes a client's token useless, when it leaves for good
+// returns true if the client was waiting to resume
+func (s *resumeStore) forget(c *Client) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.clients[c.resumeToken] == c {
+		delete(s.clients, c.resumeToken)
+	}
+	timer, waiting := s.waiting[c]
+	if waiting {
+		timer.Stop()
+		delete(s.waiting, c)
+	}
+	return waiting
+}
@@ -0,0 +1,74 @@
+package chatroom
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// how much of a message is shown when quoting it
+const maxQuoteRunes = 80
+
+// makes a short preview of a message for replies to show
+func quoteOf(m Message) *Quote {
+	content := m.Content
+	if utf8.RuneCountInString(content) > maxQuoteRunes {
+		content = string([]rune(content)[:maxQuoteRunes]) + "…"
+	}
+	return &Quote{
+		Id:       m.Id,
+		FromNick: m.FromNick,
+		Content:  content,
+	}
+}
+
+// posts a reply to a message in the current room
+func reply(r *Room, c *Client, args Args) *CommandError {
+	id := args.MessageId("messageId")
+	parent, ok := r.history.find(id)
+	if !ok {
+		return &CommandError{
+			CommandName: "reply",
+			Reason:      fmt.Sprintf("Message #%d is not in room `%s`", id, r.RoomName),
+		}
+	}
+	r.postMessage(Message{
+		Kind:       KindChat,
+		Uuid:       c.Uuid,
+		FromNick:   c.Nickname,
+		Content:    args.String("message"),
+		SentTime:   time.Now(),
+		ServerName: r.RoomName,
+		ReplyTo:    parent.Id,
+		Quote:      quoteOf(parent),
+	})
+	r.Logf("%s replied to #%d\n", c.Nickname, id)
+	return nil
+}
+
+// lists every message in a thread, indenting replies under what they reply to
+func thread(r *Room, c *Client, args Args) *CommandError {
+	id := args.MessageId("messageId")
+	messages := r.history.thread(id)
+	if len(messages) == 0 {
+		return &CommandError{
+			CommandName: "thread",
+			Reason:      fmt.Sprintf("Message #%d is not in room `%s`", id, r.RoomName),
+		}
+	}
+	depth := make(map[uint64]int, len(messages))
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("\nThread #%d (%d replies):\n", messages[0].Id, len(messages)-1))
+	builder.WriteString("---------\n")
+	for _, m := range messages {
+		if m.Id != messages[0].Id {
+			depth[m.Id] = depth[m.ReplyTo] + 1
+		}
+		builder.WriteString(strings.Repeat("    ", depth[m.Id]))
+		builder.WriteString(fmt.Sprintf("#%d [%s] <%s> %s\n", m.Id, m.SentTime.Format("15:04:05"), m.FromNick, m.Content))
+	}
+	c.ServerDirectMessage(r.serverMessage(builder.String()))
+	r.Logln(c.Nickname, "fetched thread", messages[0].Id)
+	return nil
+}
@@ -0,0 +1,35 @@
+package chatroom
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// typing signals from a client are passed on at most this often
+	typingRateLimit = time.Second * 2
+
+	// how long clients should show someone as typing after their last typing signal
+	// clients also stop showing it as soon as that person's next message arrives
+	TypingTimeout = time.Second * 5
+)
+
+// tells everyone else in the room that the calling client is typing
+// typing signals are not chat messages: they get no id and are not remembered
+func typing(r *Room, c *Client, args Args) *CommandError {
+	now := time.Now()
+	if now.Sub(c.lastTyping) < typingRateLimit {
+		// the others already know
+		return nil
+	}
+	c.lastTyping = now
+	r.sendToAllExcept(c, Message{
+		Kind:       KindTyping,
+		Uuid:       c.Uuid,
+		FromNick:   c.Nickname,
+		Content:    fmt.Sprintf("%s is typing…", c.Nickname),
+		SentTime:   now,
+		ServerName: r.RoomName,
+	})
+	return nil
+}
@@ -0,0 +1,238 @@
+package chatroom
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// a user's unread messages in one room
+type RoomUnread struct {
+	Room     string `json:"Room"`     // the name of the room
+	Unread   int    `json:"Unread"`   // how many messages came in since the user's read marker
+	Mentions int    `json:"Mentions"` // how many of those mention the user
+}
+
+// how far a user has read in a room, and how much came in after that
+type readMarker struct {
+	id       uint64 // the id of the last read message
+	unread   int    // how many chat messages came in after it, not sent by the user
+	mentions int    // how many of those mention the user
+	counted  uint64 // the id of the newest message looked at for the counts
+}
+
+// how far each user has read in each room
+// rooms a user was never in have no marker, and don't count as unread
+// the counts are kept up to date as messages come in, so they don't have to be counted from the history
+type readMarkerStore struct {
+	lock    sync.Mutex
+	markers map[string]map[string]*readMarker // room name -> nickname -> marker
+}
+
+var readMarkers = readMarkerStore{markers: make(map[string]map[string]*readMarker)}
+
+// gets a user's read marker in a room
+func (s *readMarkerStore) get(nickname string, roomName string) (readMarker, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	marker, ok := s.markers[roomName][nickname]
+	if !ok {
+		return readMarker{}, false
+	}
+	return *marker, true
+}
+
+// moves a user's read marker in a room forward to the given message id
+// markers never move backwards
+// what's left unread after it is counted from the room's history, unless it's the newest message
+func (s *readMarkerStore) advance(nickname string, roomName string, id uint64, h *roomHistory) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	room, ok := s.markers[roomName]
+	if !ok {
+		room = make(map[string]*readMarker)
+		s.markers[roomName] = room
+	}
+	marker, ok := room[nickname]
+	if ok && id <= marker.id {
+		return
+	}
+	if !ok {
+		marker = &readMarker{}
+		room[nickname] = marker
+	}
+	marker.id = id
+	marker.unread, marker.mentions, marker.counted = 0, 0, id
+	if latest := h.latestId(); id < latest {
+		marker.unread, marker.mentions = h.unreadSince(id, nickname)
+		marker.counted = latest
+	}
+}
+
+// counts a new chat message in a room as unread for the users who haven't read it
+// returns their nicknames
+func (s *readMarkerStore) count(roomName string, message Message) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var counted []string
+	for nickname, marker := range s.markers[roomName] {
+		if message.Id <= marker.id || message.Id <= marker.counted {
+			continue
+		}
+		marker.counted = message.Id
+		if message.FromNick == nickname || ignores.has(nickname, message.FromNick) {
+			continue
+		}
+		marker.unread++
+		if highlights.matches(nickname, message.Content) {
+			marker.mentions++
+		}
+		counted = append(counted, nickname)
+	}
+	return counted
+}
+
+// forgets what was unread in a room that was torn down, along with its history
+// the markers stay, so what is posted once it's made again is unread
+func (s *readMarkerStore) clear(roomName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, marker := range s.markers[roomName] {
+		marker.unread, marker.mentions = 0, 0
+	}
+}
+
+// the names of the rooms a user has a marker in
+func (s *readMarkerStore) rooms(nickname string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var names []string
+	for name, room := range s.markers {
+		if _, ok := room[nickname]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// the id of the newest remembered message, 0 if there are none
+func (h *roomHistory) latestId() uint64 {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if len(h.messages) == 0 {
+		return 0
+	}
+	return h.messages[len(h.messages)-1].Id
+}
+
+// counts the chat messages after a marker that weren't sent by the user, and how many of those mention them
+func (h *roomHistory) unreadSince(marker uint64, nickname string) (int, int) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	unread, mentions := 0, 0
+	for _, m := range h.messages {
+		if m.Id <= marker || !m.IsChat() || m.FromNick == nickname || ignores.has(nickname, m.FromNick) {
+			continue
+		}
+		unread++
+		if highlights.matches(nickname, m.Content) {
+			mentions++
+		}
+	}
+	return unread, mentions
+}
+
+// a user's unread messages in this room
+// returns false if the user was never in this room
+func (r *Room) unreadFor(nickname string) (RoomUnread, bool) {
+	marker, ok := readMarkers.get(nickname, r.RoomName)
+	if !ok {
+		return RoomUnread{}, false
+	}
+	return RoomUnread{Room: r.RoomName, Unread: marker.unread, Mentions: marker.mentions}, true
+}
+
+// a user's unread messages in every room they were in, sorted by room name
+func unreadSummary(nickname string) []RoomUnread {
+	var summary []RoomUnread
+	for _, name := range readMarkers.rooms(nickname) {
+		room, ok := FindRoom(name)
+		if !ok {
+			continue
+		}
+		if unread, ok := room.unreadFor(nickname); ok {
+			summary = append(summary, unread)
+		}
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].Room < summary[j].Room })
+	return summary
+}
+
+// formats unread counts as `3 unread, 1 mention`
+func (u RoomUnread) String() string {
+	s := fmt.Sprintf("%d unread", u.Unread)
+	switch u.Mentions {
+	case 0:
+	case 1:
+		s += ", 1 mention"
+	default:
+		s += fmt.Sprintf(", %d mentions", u.Mentions)
+	}
+	return s
+}
+
+// the message telling a client about their unread messages, for showing badges
+func (r *Room) unreadMessage(unread []RoomUnread) Message {
+	lines := make([]string, 0, len(unread))
+	for _, u := range unread {
+		lines = append(lines, fmt.Sprintf("%s: %s", u.Room, u))
+	}
+	m := r.serverMessage(strings.Join(lines, "\n"))
+	m.Kind = KindUnread
+	m.Unread = unread
+	return m
+}
+
+// tells the users who were in this room before, but aren't anymore, about a new message
+// they are told by the room they are in now, which is the only one that writes to them
+func (r *Room) notifyUnread(message Message) {
+	if !message.IsChat() {
+		return
+	}
+	for _, nickname := range readMarkers.count(r.RoomName, message) {
+		client, ok := users.find(nickname)
+		if !ok {
+			continue
+		}
+		room := client.CurrentRoom()
+		if room == nil || room == r {
+			continue
+		}
+		if unread, ok := r.unreadFor(nickname); ok {
+			room.deliver(client, r.unreadMessage([]RoomUnread{unread}))
+		}
+	}
+}
+
+// moves the calling client's read marker forward
+func markRead(r *Room, c *Client, args Args) *CommandError {
+	room := r
+	if args.Has("roomName") {
+		room = args.Room("roomName")
+	}
+	id := room.history.latestId()
+	if args.Has("messageId") {
+		id = args.MessageId("messageId")
+	}
+	readMarkers.advance(c.Nickname, room.RoomName, id, room.history)
+	c.ServerDirectMessage(r.unreadMessage(unreadSummary(c.Nickname)))
+	r.Logf("%s marked %s read up to #%d\n", c.Nickname, room.RoomName, id)
+	return nil
+}
+
+// sends the calling client their unread counts in every room
+func listUnread(r *Room, c *Client, args Args) *CommandError {
+	c.ServerDirectMessage(r.unreadMessage(unreadSummary(c.Nickname)))
+	return nil
+}
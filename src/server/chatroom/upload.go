@@ -0,0 +1,206 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"irc-final-project/logging"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// largest file that can be uploaded, in bytes
+var MaxUploadSize int64 = 10 << 20
+
+// directory uploaded files are stored in
+var UploadDir = "uploads"
+
+var errUploadTooLarge = errors.New("upload too large")
+
+// what is remembered about an uploaded file, stored next to it
+type uploadInfo struct {
+	Attachment
+	ContentType string    `json:"ContentType"`
+	Uploader    string    `json:"Uploader"`
+	Room        string    `json:"Room"`
+	Time        time.Time `json:"Time"`
+}
+
+// where an uploaded file and its info are stored
+func uploadPaths(id string) (string, string) {
+	return filepath.Join(UploadDir, id), filepath.Join(UploadDir, id+".json")
+}
+
+// formats a size in bytes for people, eg `1.5 KiB`
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// the file in an upload request, and its name
+// uploads are either a multipart form with a `file` field, or the raw file with its name in the `name` parameter
+func uploadedFile(r *http.Request) (io.ReadCloser, string, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			return nil, "", err
+		}
+		return file, header.Filename, nil
+	}
+	return r.Body, r.URL.Query().Get("name"), nil
+}
+
+// the log lines of the http endpoints
+var httpLog = logging.New("http")
+
+// http endpoint for sharing a file to the room of a connected client
+// POST /upload?session=...[&name=...]
+// the file is stored, and a message with a link to download it is posted to the client's current room
+func ServeUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client, ok := sessions.get(r.URL.Query().Get("session"))
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusUnauthorized)
+		return
+	}
+	room := client.CurrentRoom()
+	if room == nil {
+		http.Error(w, "Not in a room", http.StatusConflict)
+		return
+	}
+
+	// leave some room for the multipart form around the file, the file itself is checked when stored
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize+1<<20)
+	file, name, err := uploadedFile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	// only keep the name, never the path the client sent
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" {
+		name = "file"
+	}
+
+	if err := os.MkdirAll(UploadDir, 0o755); err != nil {
+		httpLog.Error("upload", logging.Fields{"error": err, "path": r.URL.Path})
+		http.Error(w, "Cannot store uploads", http.StatusInternalServerError)
+		return
+	}
+	info := uploadInfo{
+		Attachment: Attachment{Id: newToken(), Name: name},
+		Uploader:   client.Nickname,
+		Room:       room.RoomName,
+		Time:       time.Now(),
+	}
+	dataPath, infoPath := uploadPaths(info.Id)
+	out, err := os.Create(dataPath)
+	if err != nil {
+		httpLog.Error("upload", logging.Fields{"error": err, "path": r.URL.Path})
+		http.Error(w, "Cannot store uploads", http.StatusInternalServerError)
+		return
+	}
+	info.Size, err = io.Copy(out, io.LimitReader(file, MaxUploadSize+1))
+	out.Close()
+	if err == nil && info.Size > MaxUploadSize {
+		err = errUploadTooLarge
+	}
+	if err != nil {
+		os.Remove(dataPath)
+		if errors.Is(err, errUploadTooLarge) || strings.Contains(err.Error(), "request body too large") {
+			http.Error(w, fmt.Sprintf("File is larger than %s", formatSize(MaxUploadSize)), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	info.ContentType = mimeTypeOf(dataPath)
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	info.Url = fmt.Sprintf("%s://%s/files/%s", scheme, r.Host, info.Id)
+	infoJson, _ := json.Marshal(info)
+	if err := os.WriteFile(infoPath, infoJson, 0o644); err != nil {
+		os.Remove(dataPath)
+		httpLog.Error("upload", logging.Fields{"error": err, "path": r.URL.Path})
+		http.Error(w, "Cannot store uploads", http.StatusInternalServerError)
+		return
+	}
+
+	attachment := info.Attachment
+	room.Broadcast <- Message{
+		Kind:       KindFile,
+		Uuid:       client.Uuid,
+		FromNick:   client.Nickname,
+		Content:    fmt.Sprintf("shared %s (%s): %s", attachment.Name, formatSize(attachment.Size), attachment.Url),
+		SentTime:   time.Now(),
+		ServerName: room.RoomName,
+		Attachment: &attachment,
+	}
+	room.Logf("%s uploaded %s as %s\n", client.Nickname, attachment.Name, attachment.Id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// guesses a file's content type from its first bytes
+func mimeTypeOf(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	return http.DetectContentType(head[:n])
+}
+
+// http endpoint for downloading a shared file
+// GET /files/{id}
+func ServeFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	// ids are hex, so they can't point outside of the upload directory
+	if id == "" || strings.Trim(id, "0123456789abcdef") != "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	dataPath, infoPath := uploadPaths(id)
+	infoJson, err := os.ReadFile(infoPath)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	var info uploadInfo
+	if err := json.Unmarshal(infoJson, &info); err != nil {
+		httpLog.Error("file", logging.Fields{"error": err, "path": r.URL.Path})
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", info.Name))
+	http.ServeFile(w, r, dataPath)
+}
@@ -0,0 +1,70 @@
+package chatroom
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// everyone on the server, people and bots, by nickname
+// clients that lost their connection stay until they resume or their grace runs out
+// every room and http handler looks at it, so it has its own lock
+type userRegistry struct {
+	lock       sync.RWMutex
+	byNickname map[string]*Client
+}
+
+var users = userRegistry{byNickname: make(map[string]*Client)}
+
+// adds a client to the server under its nickname
+// if someone already has that nickname, the client is renamed to the first free `nickname_2`, `nickname_3`...
+func (u *userRegistry) add(c *Client) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	nickname := c.Nickname
+	for i := 2; u.byNickname[nickname] != nil; i++ {
+		nickname = fmt.Sprintf("%s_%d", c.Nickname, i)
+	}
+	c.Nickname = nickname
+	u.byNickname[nickname] = c
+}
+
+// takes a client off the server, its nickname is free again
+// so are its ignore list, unless it was saved, and its highlight keywords and mentions
+func (u *userRegistry) remove(c *Client) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.byNickname[c.Nickname] == c {
+		delete(u.byNickname, c.Nickname)
+		ignores.forget(c.Nickname)
+		highlights.forget(c)
+		mentions.forget(c.Nickname)
+	}
+}
+
+// finds a client by its nickname
+func (u *userRegistry) find(nickname string) (*Client, bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	c, ok := u.byNickname[nickname]
+	return c, ok
+}
+
+// everyone on the server, sorted by nickname
+func (u *userRegistry) all() []*Client {
+	u.lock.RLock()
+	all := make([]*Client, 0, len(u.byNickname))
+	for _, c := range u.byNickname {
+		all = append(all, c)
+	}
+	u.lock.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].Nickname < all[j].Nickname })
+	return all
+}
+
+// how many people and bots are on the server
+func (u *userRegistry) count() int {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return len(u.byNickname)
+}
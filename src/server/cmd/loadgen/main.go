@@ -0,0 +1,211 @@
+// simulates many chat clients against a local server, and reports how it held up
+//
+//	go run ./cmd/loadgen --clients 200 --rooms 10 --rate 2 --duration 1m
+package main
+
+import (
+	"flag"
+	"fmt"
+	"irc-final-project/chatroom"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var addr = flag.String("addr", "localhost:8080", "address of the server")
+var clients = flag.Int("clients", 50, "how many clients to simulate")
+var rooms = flag.Int("rooms", 5, "how many rooms to spread the clients across")
+var rate = flag.Float64("rate", 1, "messages each client sends per second")
+var duration = flag.Duration("duration", 30*time.Second, "how long to send messages for")
+var ramp = flag.Duration("ramp", 2*time.Second, "how long to take connecting every client")
+var commandShare = flag.Float64("commands", 0.05, "share of the messages that are commands, from 0 to 1")
+var size = flag.Int("size", 64, "size of each chat message, in bytes")
+var prefix = flag.String("prefix", "loadgen", "what the rooms' and clients' names start with")
+var protocol = flag.String("protocol", chatroom.ProtocolV2, "websocket subprotocol to ask for: chat.v2, or chat.v2.cbor for binary frames")
+
+// commands clients run now and then, %s is another client's nickname
+var commands = []string{
+	"/listusers",
+	"/listrooms",
+	"/listallusers",
+	"/help",
+	"/unread",
+	"/whisper %s hello",
+}
+
+// every chat message a client sends starts with this, then its nickname and its number
+const marker = "lg"
+
+func main() {
+	flag.Parse()
+	if *clients < 1 || *rooms < 1 || *rate <= 0 || *size < 1 {
+		log.Fatal("--clients, --rooms, --rate and --size have to be more than 0")
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	log.Printf("Simulating %d clients in %d rooms on %s, %.2g messages/s each, for %s\n", *clients, *rooms, *addr, *rate, *duration)
+	stop := make(chan struct{})
+	var all totals
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// spread the connections over the ramp, so the server isn't hit by all of them at once
+			time.Sleep(*ramp * time.Duration(i) / time.Duration(*clients))
+			all.add(runClient(i, stop))
+		}(i)
+	}
+
+	select {
+	case <-time.After(*ramp + *duration):
+	case <-interrupt:
+		log.Println("interrupt")
+	}
+	close(stop)
+	wg.Wait()
+	all.report(os.Stdout, time.Since(start))
+}
+
+// one simulated client: connects, sends until stopped, and counts what it gets back
+func runClient(id int, stop chan struct{}) stats {
+	nickname := fmt.Sprintf("%s-%d", *prefix, id)
+	serverUrl := url.URL{
+		Scheme:   "ws",
+		Host:     *addr,
+		Path:     fmt.Sprintf("/ws/%s-%d", *prefix, id%*rooms),
+		RawQuery: url.Values{"nickname": {nickname}}.Encode(),
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{*protocol}
+	conn, _, err := dialer.Dial(serverUrl.String(), nil)
+	if err != nil {
+		log.Printf("%s: %v\n", nickname, err)
+		return stats{failed: 1}
+	}
+	defer conn.Close()
+
+	received := make(chan stats)
+	go func() {
+		received <- readMessages(conn, stop)
+	}()
+
+	sent := stats{connected: 1}
+	random := rand.New(rand.NewSource(int64(id)))
+	padding := strings.Repeat("x", *size)
+	interval := time.Duration(float64(time.Second) / *rate)
+	// start at a random point of the interval, so clients don't all send at once
+	select {
+	case <-time.After(time.Duration(random.Int63n(int64(interval)))):
+	case <-stop:
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for sending := true; sending; {
+		select {
+		case <-stop:
+			sending = false
+			continue
+		case <-ticker.C:
+		}
+		var content string
+		if random.Float64() < *commandShare {
+			content = commands[random.Intn(len(commands))]
+			if strings.Contains(content, "%s") {
+				content = fmt.Sprintf(content, fmt.Sprintf("%s-%d", *prefix, random.Intn(*clients)))
+			}
+			sent.commands++
+		} else {
+			sent.sent++
+			content = fmt.Sprintf("%s %s %d ", marker, nickname, sent.sent)
+			if len(content) < *size {
+				content += padding[:*size-len(content)]
+			}
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(content)); err != nil {
+			// the reader sees the connection is gone too
+			break
+		}
+	}
+
+	// leave like a client would, and wait for the server to close its side
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	var got stats
+	select {
+	case got = <-received:
+	case <-time.After(2 * time.Second):
+		conn.Close()
+		got = <-received
+	}
+	sent.add(got)
+	return sent
+}
+
+// reads everything the server sends until the connection closes
+func readMessages(conn *websocket.Conn, stop chan struct{}) stats {
+	var s stats
+	lastSeen := make(map[string]int) // sender -> the number of their latest message
+	for {
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-stop:
+			default:
+				// the server closed the connection before we were done
+				log.Printf("disconnected: %v\n", err)
+				s.disconnected++
+			}
+			return s
+		}
+		now := time.Now()
+		batch, err := chatroom.DecodeFrame(conn.Subprotocol(), frame)
+		if err != nil {
+			log.Printf("unreadable frame: %v\n", err)
+			continue
+		}
+		for _, envelope := range batch {
+			if envelope.Type == chatroom.EnvelopeMessage {
+				s.count(*envelope.Message, now, lastSeen)
+			}
+		}
+	}
+}
+
+// counts a message from the server
+func (s *stats) count(m chatroom.Message, now time.Time, lastSeen map[string]int) {
+	if strings.Contains(m.Content, "falling behind") && m.IsDirectMessage {
+		s.warnings++
+		return
+	}
+	if m.Kind != chatroom.KindChat || m.IsDirectMessage {
+		return
+	}
+	fields := strings.Fields(m.Content)
+	if len(fields) < 3 || fields[0] != marker {
+		return
+	}
+	number, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return
+	}
+	s.received++
+	s.latencies = append(s.latencies, now.Sub(m.SentTime))
+	// messages from one sender come in order, so a skipped number was dropped
+	// the first message seen from a sender can't tell, they may have talked before we joined
+	if last, ok := lastSeen[m.FromNick]; ok && number > last+1 {
+		s.dropped += number - last - 1
+	}
+	if number > lastSeen[m.FromNick] {
+		lastSeen[m.FromNick] = number
+	}
+}
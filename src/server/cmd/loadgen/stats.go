@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// what one simulated client saw, merged into the totals when it is done
+type stats struct {
+	connected    int             // clients that got a websocket
+	failed       int             // clients that couldn't connect
+	disconnected int             // clients the server disconnected before the end
+	sent         int             // chat messages sent
+	commands     int             // commands sent
+	received     int             // chat messages from simulated clients that came back
+	dropped      int             // chat messages from simulated clients that never came, found by gaps in their numbers
+	warnings     int             // times the server said a client was falling behind
+	latencies    []time.Duration // from the server stamping a message to a client reading it
+}
+
+// adds what another client saw
+func (s *stats) add(other stats) {
+	s.connected += other.connected
+	s.failed += other.failed
+	s.disconnected += other.disconnected
+	s.sent += other.sent
+	s.commands += other.commands
+	s.received += other.received
+	s.dropped += other.dropped
+	s.warnings += other.warnings
+	s.latencies = append(s.latencies, other.latencies...)
+}
+
+// the totals of every client, added to as clients finish
+type totals struct {
+	lock sync.Mutex
+	stats
+}
+
+func (t *totals) add(s stats) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.stats.add(s)
+}
+
+// the latency below which a fraction of the samples are, the samples must be sorted
+func percentile(sorted []time.Duration, fraction float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(fraction * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+// writes the summary of a run
+func (s stats) report(w io.Writer, elapsed time.Duration) {
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	var sum time.Duration
+	for _, l := range s.latencies {
+		sum += l
+	}
+	fmt.Fprintf(w, "\nLoad test summary (%s):\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintln(w, "---------")
+	fmt.Fprintf(w, "Clients:      %d connected, %d failed to connect, %d disconnected by the server\n", s.connected, s.failed, s.disconnected)
+	fmt.Fprintf(w, "Sent:         %d messages, %d commands (%.1f/s)\n", s.sent, s.commands, float64(s.sent+s.commands)/elapsed.Seconds())
+	fmt.Fprintf(w, "Received:     %d messages (%.1f/s)\n", s.received, float64(s.received)/elapsed.Seconds())
+	fmt.Fprintf(w, "Dropped:      %d messages, %d slow client warnings\n", s.dropped, s.warnings)
+	if len(s.latencies) == 0 {
+		fmt.Fprintln(w, "Latency:      no messages received")
+		return
+	}
+	fmt.Fprintf(w, "Latency:      min %s, mean %s, max %s\n",
+		s.latencies[0].Round(time.Microsecond),
+		(sum / time.Duration(len(s.latencies))).Round(time.Microsecond),
+		s.latencies[len(s.latencies)-1].Round(time.Microsecond))
+	fmt.Fprintf(w, "Percentiles:  p50 %s, p90 %s, p99 %s\n",
+		percentile(s.latencies, 0.50).Round(time.Microsecond),
+		percentile(s.latencies, 0.90).Round(time.Microsecond),
+		percentile(s.latencies, 0.99).Round(time.Microsecond))
+}
@@ -0,0 +1,302 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"irc-final-project/logging"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// the server's settings, read from a JSON file
+// anything the file leaves out keeps its value from Default
+type Config struct {
+	ServerName      string     `json:"ServerName"`      // the server's name, for the message of the day
+	Listen          []string   `json:"Listen"`          // addresses to serve on, like ":8080"
+	HomePage        string     `json:"HomePage"`        // the web client's page, served at `/`
+	DefaultRoom     string     `json:"DefaultRoom"`     // the room that always exists, where bots start
+	PersistentRooms []Room     `json:"PersistentRooms"` // more rooms to make when the server starts
+	EchoBot         string     `json:"EchoBot"`         // nickname of the sample echo bot, empty for no bot
+	MotdFile        string     `json:"MotdFile"`        // file with the message of the day template, empty for none
+	Operators       []Operator `json:"Operators"`       // who can become an operator with `/oper`
+	Bridges         []Bridge   `json:"Bridges"`         // rooms relayed to channels on IRC networks
+	Limits          Limits     `json:"Limits"`
+	Timeouts        Timeouts   `json:"Timeouts"`
+	Storage         Storage    `json:"Storage"`
+	Logging         Logging    `json:"Logging"`
+}
+
+// a room made when the server starts, which is never torn down
+type Room struct {
+	Name        string `json:"Name"`
+	Owner       string `json:"Owner"`       // the operator name that owns the room, operators can change the topic and talk despite the modes
+	Topic       string `json:"Topic"`       // what is being talked about, until someone changes it
+	Modes       string `json:"Modes"`       // room modes, see chatroom.ValidModes
+	Description string `json:"Description"` // what the room is for
+}
+
+// credentials for `/oper name password`
+// the password is kept as written, so the config file should only be readable by the server
+type Operator struct {
+	Name     string `json:"Name"`
+	Password string `json:"Password"`
+}
+
+// a room relayed to a channel on an IRC network, both ways
+type Bridge struct {
+	Room     string `json:"Room"`     // the room, the default room or one of the persistent rooms
+	Server   string `json:"Server"`   // host:port of the IRC server
+	TLS      bool   `json:"TLS"`      // whether to connect with TLS
+	Password string `json:"Password"` // the IRC server's password, empty for none
+	Nick     string `json:"Nick"`     // the bridge's nickname, on IRC and in the room
+	Channel  string `json:"Channel"`  // the channel, like "#team"
+}
+
+// how big things can get
+type Limits struct {
+	MaxMessageSize          int64 `json:"MaxMessageSize"`          // largest message a client can send, in bytes
+	MaxUploadSize           int64 `json:"MaxUploadSize"`           // largest file that can be shared, in bytes
+	ReadBufferSize          int   `json:"ReadBufferSize"`          // websocket read buffer, in bytes
+	WriteBufferSize         int   `json:"WriteBufferSize"`         // websocket write buffer, in bytes
+	HistorySize             int   `json:"HistorySize"`             // how many messages each room remembers
+	SendQueueSize           int   `json:"SendQueueSize"`           // how many messages can wait to be written to each client
+	DroppedBeforeWarning    int   `json:"DroppedBeforeWarning"`    // when a client's queue is full its oldest message is dropped, after this many drops in a row it is warned
+	DroppedBeforeDisconnect int   `json:"DroppedBeforeDisconnect"` // after this many drops in a row, the client is disconnected
+}
+
+// how long to wait on clients
+type Timeouts struct {
+	WriteWait   Duration `json:"WriteWait"`   // time allowed to write a message to a client
+	PongWait    Duration `json:"PongWait"`    // time allowed to read the next pong from a client, pings are sent a bit more often
+	RoomIdle    Duration `json:"RoomIdle"`    // how long a room nobody is in is kept, 0 to keep every room
+	ResumeGrace Duration `json:"ResumeGrace"` // how long a client that lost its connection can come back as itself, 0 to not let clients resume
+}
+
+// where things are saved
+type Storage struct {
+	UploadDir  string `json:"UploadDir"`  // directory to store shared files in
+	IgnoreFile string `json:"IgnoreFile"` // file to save operators' ignore lists in, empty to not save them
+	RoomsFile  string `json:"RoomsFile"`  // file to save rooms made with `/make --persist` in, empty to not save them
+	BansFile   string `json:"BansFile"`   // file to save bans in, empty to not save them
+	AuditFile  string `json:"AuditFile"`  // file to append kicks, bans and other privileged actions to, empty to not save them
+}
+
+// what the server logs, and how
+type Logging struct {
+	Format string            `json:"Format"` // "logfmt" or "json"
+	Level  string            `json:"Level"`  // "debug", "info", "warn" or "error"
+	Levels map[string]string `json:"Levels"` // levels for some subsystems, like {"room": "debug"}, the others use Level
+}
+
+// a time.Duration written like "1s" or "500ms" in the file
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations are written like \"1s\" or \"500ms\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// the settings the server uses without a config file
+func Default() Config {
+	return Config{
+		ServerName:  "irc-final-project",
+		Listen:      []string{":8080"},
+		HomePage:    "home.html",
+		DefaultRoom: "main",
+		EchoBot:     "echobot",
+		Limits: Limits{
+			MaxMessageSize:          1024,
+			MaxUploadSize:           10 << 20,
+			ReadBufferSize:          1024,
+			WriteBufferSize:         1024,
+			HistorySize:             1000,
+			SendQueueSize:           256,
+			DroppedBeforeWarning:    16,
+			DroppedBeforeDisconnect: 128,
+		},
+		Timeouts: Timeouts{
+			WriteWait:   Duration(time.Second),
+			PongWait:    Duration(time.Second),
+			RoomIdle:    Duration(10 * time.Minute),
+			ResumeGrace: Duration(30 * time.Second),
+		},
+		Storage: Storage{
+			UploadDir:  "uploads",
+			IgnoreFile: "ignores.json",
+			RoomsFile:  "rooms.json",
+			BansFile:   "bans.json",
+			AuditFile:  "audit.jsonl",
+		},
+		Logging: Logging{
+			Format: logging.FormatLogfmt,
+			Level:  "info",
+		},
+	}
+}
+
+// reads a config file on top of the defaults
+// unknown settings are an error, so typos don't go unnoticed
+func Load(path string) (Config, error) {
+	config := Default()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return config, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// checks that the settings make sense, listing everything that's wrong
+func (c Config) Validate() error {
+	var problems []string
+	problem := func(format string, a ...any) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if c.ServerName == "" {
+		problem("ServerName: can't be empty")
+	}
+	if len(c.Listen) == 0 {
+		problem("Listen: needs at least one address")
+	}
+	for _, addr := range c.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			problem("Listen: `%s` is not a host:port address", addr)
+		}
+	}
+	if c.HomePage != "" {
+		if _, err := os.Stat(c.HomePage); err != nil {
+			problem("HomePage: %v", err)
+		}
+	}
+	if c.MotdFile != "" {
+		if _, err := os.Stat(c.MotdFile); err != nil {
+			problem("MotdFile: %v", err)
+		}
+	}
+
+	if c.DefaultRoom == "" {
+		problem("DefaultRoom: can't be empty")
+	}
+	rooms := map[string]bool{c.DefaultRoom: true}
+	for _, room := range c.PersistentRooms {
+		switch {
+		case room.Name == "":
+			problem("PersistentRooms: a room has no name")
+		case rooms[room.Name]:
+			problem("PersistentRooms: `%s` is given twice, or is the default room", room.Name)
+		}
+		rooms[room.Name] = true
+	}
+
+	operators := make(map[string]bool)
+	for _, operator := range c.Operators {
+		switch {
+		case operator.Name == "" || operator.Password == "":
+			problem("Operators: every operator needs a name and a password")
+		case operators[operator.Name]:
+			problem("Operators: `%s` is given twice", operator.Name)
+		}
+		operators[operator.Name] = true
+	}
+	// anyone can connect with any nickname, so rooms are owned by operators, who log in with /oper
+	for _, room := range c.PersistentRooms {
+		if room.Owner != "" && !operators[room.Owner] {
+			problem("PersistentRooms: the owner of `%s`, `%s`, is not one of the Operators", room.Name, room.Owner)
+		}
+	}
+
+	channels := make(map[string]bool)
+	for _, bridge := range c.Bridges {
+		if !rooms[bridge.Room] {
+			problem("Bridges: `%s` is not the default room or a persistent room", bridge.Room)
+		}
+		if _, _, err := net.SplitHostPort(bridge.Server); err != nil {
+			problem("Bridges: `%s` is not a host:port address", bridge.Server)
+		}
+		if bridge.Nick == "" || strings.ContainsAny(bridge.Nick, " ,*?!@.:#&") {
+			problem("Bridges: `%s` can't be a nickname on IRC", bridge.Nick)
+		}
+		switch {
+		case !strings.HasPrefix(bridge.Channel, "#") && !strings.HasPrefix(bridge.Channel, "&"):
+			problem("Bridges: `%s` is not a channel, they start with # or &", bridge.Channel)
+		case strings.ContainsAny(bridge.Channel, " ,\x07"):
+			problem("Bridges: `%s` can't have spaces, commas or bells", bridge.Channel)
+		case channels[bridge.Server+" "+strings.ToLower(bridge.Channel)]:
+			problem("Bridges: `%s` on `%s` is bridged twice", bridge.Channel, bridge.Server)
+		}
+		channels[bridge.Server+" "+strings.ToLower(bridge.Channel)] = true
+	}
+
+	if c.Limits.MaxMessageSize <= 0 {
+		problem("Limits.MaxMessageSize: has to be more than 0")
+	}
+	if c.Limits.MaxUploadSize <= 0 {
+		problem("Limits.MaxUploadSize: has to be more than 0")
+	}
+	if c.Limits.ReadBufferSize <= 0 || c.Limits.WriteBufferSize <= 0 {
+		problem("Limits.ReadBufferSize, Limits.WriteBufferSize: have to be more than 0")
+	}
+	if c.Limits.HistorySize <= 0 {
+		problem("Limits.HistorySize: has to be more than 0")
+	}
+	if c.Limits.SendQueueSize <= 0 {
+		problem("Limits.SendQueueSize: has to be more than 0")
+	}
+	if c.Limits.DroppedBeforeWarning <= 0 || c.Limits.DroppedBeforeDisconnect <= c.Limits.DroppedBeforeWarning {
+		problem("Limits.DroppedBeforeWarning, Limits.DroppedBeforeDisconnect: have to be more than 0, and clients have to be warned before being disconnected")
+	}
+	if c.Timeouts.WriteWait <= 0 {
+		problem("Timeouts.WriteWait: has to be more than 0")
+	}
+	if c.Timeouts.PongWait < Duration(10*time.Millisecond) {
+		problem("Timeouts.PongWait: has to be at least 10ms")
+	}
+	if c.Timeouts.RoomIdle != 0 && c.Timeouts.RoomIdle < Duration(time.Second) {
+		problem("Timeouts.RoomIdle: has to be 0, or at least 1s")
+	}
+	if c.Timeouts.ResumeGrace < 0 {
+		problem("Timeouts.ResumeGrace: can't be negative")
+	}
+
+	if c.Storage.UploadDir == "" {
+		problem("Storage.UploadDir: can't be empty")
+	}
+
+	if c.Logging.Format != logging.FormatLogfmt && c.Logging.Format != logging.FormatJSON {
+		problem("Logging.Format: `%s` is not a log format, the formats are %s and %s", c.Logging.Format, logging.FormatLogfmt, logging.FormatJSON)
+	}
+	if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		problem("Logging.Level: %v", err)
+	}
+	for subsystem, level := range c.Logging.Levels {
+		if _, err := logging.ParseLevel(level); err != nil {
+			problem("Logging.Levels.%s: %v", subsystem, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		check   func(Config) bool
+		wantErr string
+	}{
+		{"empty object keeps defaults", `{}`, func(c Config) bool { return c.DefaultRoom == "main" && c.Listen[0] == ":8080" }, ""},
+		{"overrides", `{"DefaultRoom": "lobby", "Limits": {"HistorySize": 5}}`, func(c Config) bool {
+			return c.DefaultRoom == "lobby" && c.Limits.HistorySize == 5 && c.Limits.MaxMessageSize == 1024
+		}, ""},
+		{"durations", `{"Timeouts": {"PongWait": "1m30s"}}`, func(c Config) bool { return c.Timeouts.PongWait == Duration(90*time.Second) }, ""},
+		{"bad duration", `{"Timeouts": {"PongWait": 5}}`, nil, "durations are written like"},
+		{"unknown setting", `{"Lisen": [":80"]}`, nil, "unknown field"},
+		{"not json", `Listen = ":80"`, nil, "invalid character"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			config, err := Load(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if !tt.check(config) {
+				t.Errorf("Load() = %+v", config)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"no listen address", func(c *Config) { c.Listen = nil }, "Listen"},
+		{"bad listen address", func(c *Config) { c.Listen = []string{"8080"} }, "`8080` is not a host:port"},
+		{"missing home page", func(c *Config) { c.HomePage = "nowhere.html" }, "HomePage"},
+		{"no default room", func(c *Config) { c.DefaultRoom = "" }, "DefaultRoom"},
+		{"same room twice", func(c *Config) { c.PersistentRooms = []Room{{Name: "dev"}, {Name: "dev"}} }, "`dev` is given twice"},
+		{"default room again", func(c *Config) { c.PersistentRooms = []Room{{Name: "main"}} }, "`main` is given twice"},
+		{"operator without password", func(c *Config) { c.Operators = []Operator{{Name: "admin"}} }, "Operators"},
+		{"room owned by an operator", func(c *Config) {
+			c.Operators = []Operator{{Name: "admin", Password: "secret"}}
+			c.PersistentRooms = []Room{{Name: "dev", Owner: "admin"}}
+		}, ""},
+		{"room owned by a nickname", func(c *Config) { c.PersistentRooms = []Room{{Name: "dev", Owner: "bob"}} }, "`bob`, is not one of the Operators"},
+		{"bridge", func(c *Config) {
+			c.Bridges = []Bridge{{Room: "main", Server: "irc.example.org:6697", Nick: "bridge", Channel: "#team"}}
+		}, ""},
+		{"bridge to an unknown room", func(c *Config) {
+			c.Bridges = []Bridge{{Room: "dev", Server: "irc:6667", Nick: "bridge", Channel: "#team"}}
+		}, "`dev` is not the default room"},
+		{"bridge without a channel", func(c *Config) {
+			c.Bridges = []Bridge{{Room: "main", Server: "irc:6667", Nick: "bridge", Channel: "team"}}
+		}, "`team` is not a channel"},
+		{"channel bridged twice", func(c *Config) {
+			c.Bridges = []Bridge{{Room: "main", Server: "irc:6667", Nick: "a", Channel: "#team"}, {Room: "main", Server: "irc:6667", Nick: "b", Channel: "#Team"}}
+		}, "bridged twice"},
+		{"zero history", func(c *Config) { c.Limits.HistorySize = 0 }, "HistorySize"},
+		{"unknown log format", func(c *Config) { c.Logging.Format = "xml" }, "Logging.Format"},
+		{"unknown subsystem level", func(c *Config) { c.Logging.Levels = map[string]string{"room": "loud"} }, "Logging.Levels.room: `loud` is not a log level"},
+		{"negative resume grace", func(c *Config) { c.Timeouts.ResumeGrace = Duration(-time.Second) }, "ResumeGrace"},
+		{"disconnect before warning", func(c *Config) { c.Limits.DroppedBeforeWarning, c.Limits.DroppedBeforeDisconnect = 10, 5 }, "warned before being disconnected"},
+		{"tiny pong wait", func(c *Config) { c.Timeouts.PongWait = Duration(time.Millisecond) }, "PongWait"},
+		{"several problems", func(c *Config) { c.Listen, c.DefaultRoom = nil, "" }, "Listen: needs at least one address\n  DefaultRoom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Default()
+			// the home page is looked for next to the server
+			config.HomePage = ""
+			tt.change(&config)
+			err := config.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
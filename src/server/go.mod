@@ -7,4 +7,9 @@ require (
 	github.com/gorilla/websocket v1.5.0
 )
 
-require github.com/google/uuid v1.3.0
+require (
+	github.com/fxamacker/cbor/v2 v2.7.0
+	github.com/google/uuid v1.3.0
+)
+
+require github.com/x448/float16 v0.8.4 // indirect
@@ -0,0 +1,183 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how important a log line is
+type Level int
+
+const (
+	LevelDebug Level = iota // details for finding bugs
+	LevelInfo               // things happening as they should
+	LevelWarn               // something went wrong, but the server carries on
+	LevelError              // something went wrong, and something didn't get done
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// reads a level written like "debug" or "warn"
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("`%s` is not a log level, the levels are debug, info, warn and error", s)
+}
+
+// how log lines are written
+const (
+	FormatJSON   = "json"   // one JSON object per line
+	FormatLogfmt = "logfmt" // key=value pairs, easier to read in a terminal
+)
+
+// extra information about an event, like the room or the client it happened to
+type Fields map[string]any
+
+// where log lines go, and which ones are written
+type settings struct {
+	lock   sync.Mutex
+	out    io.Writer
+	format string
+	level  Level            // for subsystems without their own level
+	levels map[string]Level // subsystem -> level
+}
+
+var current = settings{out: os.Stderr, format: FormatLogfmt, level: LevelInfo}
+
+// changes where and how log lines are written
+// levels sets the level of some subsystems, the others use level
+func Configure(out io.Writer, format string, level Level, levels map[string]Level) error {
+	if format != FormatJSON && format != FormatLogfmt {
+		return fmt.Errorf("`%s` is not a log format, the formats are %s and %s", format, FormatJSON, FormatLogfmt)
+	}
+	current.lock.Lock()
+	defer current.lock.Unlock()
+	current.out = out
+	current.format = format
+	current.level = level
+	current.levels = levels
+	return nil
+}
+
+// writes the log lines of one part of the server, like "room" or "http"
+type Logger struct {
+	subsystem string
+}
+
+func New(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// checks if lines of a level would be written
+func (l *Logger) Enabled(level Level) bool {
+	current.lock.Lock()
+	defer current.lock.Unlock()
+	return l.enabled(level)
+}
+
+// same as Enabled, the caller must hold the lock
+func (l *Logger) enabled(level Level) bool {
+	min, ok := current.levels[l.subsystem]
+	if !ok {
+		min = current.level
+	}
+	return level >= min
+}
+
+// writes an event, if its level is enabled
+// event is a short name for what happened, like "join"; fields say where and to whom
+func (l *Logger) Log(level Level, event string, fields Fields) {
+	current.lock.Lock()
+	defer current.lock.Unlock()
+	if !l.enabled(level) {
+		return
+	}
+	line := make(Fields, len(fields)+4)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			// errors would be written as {} otherwise
+			v = err.Error()
+		}
+		line[k] = v
+	}
+	line["time"] = time.Now().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["subsystem"] = l.subsystem
+	line["event"] = event
+	var text []byte
+	if current.format == FormatJSON {
+		var err error
+		text, err = json.Marshal(line)
+		if err != nil {
+			text, _ = json.Marshal(Fields{"time": line["time"], "level": "error", "subsystem": "logging", "event": "marshal", "error": err.Error()})
+		}
+	} else {
+		text = logfmt(line)
+	}
+	current.out.Write(append(text, '\n'))
+}
+
+func (l *Logger) Debug(event string, fields Fields) { l.Log(LevelDebug, event, fields) }
+func (l *Logger) Info(event string, fields Fields)  { l.Log(LevelInfo, event, fields) }
+func (l *Logger) Warn(event string, fields Fields)  { l.Log(LevelWarn, event, fields) }
+func (l *Logger) Error(event string, fields Fields) { l.Log(LevelError, event, fields) }
+
+// the keys that go first in logfmt lines, in this order, the others follow sorted
+var leadingKeys = []string{"time", "level", "subsystem", "event"}
+
+// writes fields as `key=value` pairs, quoting values that need it
+func logfmt(fields Fields) []byte {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if !isLeadingKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for i, k := range append(append([]string{}, leadingKeys...), keys...) {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		value := fmt.Sprint(fields[k])
+		if value == "" || strings.ContainsAny(value, " =\"\t\n\\") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(value)
+	}
+	return []byte(b.String())
+}
+
+func isLeadingKey(k string) bool {
+	for _, leading := range leadingKeys {
+		if k == leading {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		levels map[string]Level
+		level  Level
+		want   string // empty if nothing should be written
+	}{
+		{"logfmt", FormatLogfmt, nil, LevelInfo, `level=info subsystem=room event=join nick=alice room="my room"`},
+		{"below the level", FormatLogfmt, nil, LevelDebug, ""},
+		{"subsystem level", FormatLogfmt, map[string]Level{"room": LevelDebug}, LevelDebug, "level=debug subsystem=room"},
+		{"quieter subsystem", FormatLogfmt, map[string]Level{"room": LevelError}, LevelWarn, ""},
+		{"json", FormatJSON, nil, LevelWarn, `"event":"join","level":"warn","nick":"alice","room":"my room","subsystem":"room"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := Configure(&out, tt.format, LevelInfo, tt.levels); err != nil {
+				t.Fatal(err)
+			}
+			New("room").Log(tt.level, "join", Fields{"room": "my room", "nick": "alice"})
+			line := out.String()
+			if tt.want == "" {
+				if line != "" {
+					t.Errorf("Log() wrote %q, want nothing", line)
+				}
+				return
+			}
+			if !strings.Contains(line, tt.want) {
+				t.Errorf("Log() wrote %q, want it to contain %q", line, tt.want)
+			}
+			if tt.format == FormatJSON && !json.Valid(out.Bytes()) {
+				t.Errorf("Log() wrote %q, which is not JSON", line)
+			}
+		})
+	}
+}
@@ -1,102 +1,183 @@
-package main
-
-import (
-	"flag"
-	"irc-final-project/chatroom"
-	"log"
-	"net/http"
-
-	"github.com/gorilla/mux"
-)
-
-var addr = flag.String("addr", ":8080", "http service address")
-
-func serveHome(w http.ResponseWriter, r *http.Request) {
-	log.Println("serveHome", r.URL)
-	if r.URL.Path != "/" {
-		http.Error(w, "Not found", http.StatusNotFound)
-		return
-	}
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	http.ServeFile(w, r, "home.html")
-}
-
-func main() {
-	flag.Parse()
-	r := mux.NewRouter()
-	main := chatroom.NewRoom("main")
-	go main.Run()
-	// serve the web page for the web client
-	r.HandleFunc("/", serveHome)
-	// r.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-	// 	log.Println("/ws", r.URL)
-	// 	chatroom.ServeWebSocket(main, w, r)
-	// })
-
-	// for private messaging people
-	// sourcename is you
-	// targetname is the person you're sending the dms to
-	r.HandleFunc("/ws/{sourcename}/{targetname}", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("/ws/{servername}", r.URL)
-		vars := mux.Vars(r)
-		log.Println(vars)
-		// check if a room for this pair exists
-		// this room is called `targetname-sourcename` and `sourcename-targetname`
-		// both names point to the same room
-		srctar := vars["sourcename"] + "-" + vars["targetname"]
-		tarsrc := vars["targetname"] + "-" + vars["sourcename"]
-		srctar_uuid, srctar_ok := chatroom.StringToRoomUUID[srctar]
-		tarsrc_uuid, tarsrc_ok := chatroom.StringToRoomUUID[tarsrc]
-
-		switch {
-		case tarsrc_ok && srctar_ok:
-			// both exist, send the client to the tarsrc room
-			tarsrc_room := chatroom.ActiveRooms[tarsrc_uuid]
-			go tarsrc_room.Run()
-			chatroom.ServeWebSocket(tarsrc_room, w, r)
-		case tarsrc_ok && !srctar_ok:
-			// only tarsrc exists, set the keys appropiately
-			tarsrc_room := chatroom.ActiveRooms[tarsrc_uuid]
-			chatroom.StringToRoomUUID[srctar] = tarsrc_room.Uuid
-			go tarsrc_room.Run()
-			chatroom.ServeWebSocket(tarsrc_room, w, r)
-		case !tarsrc_ok && srctar_ok:
-			// only srctar exists, set the keys appropiately
-			srctar_room := chatroom.ActiveRooms[srctar_uuid]
-			chatroom.StringToRoomUUID[tarsrc] = srctar_room.Uuid
-			go srctar_room.Run()
-			chatroom.ServeWebSocket(srctar_room, w, r)
-		default:
-			// neither key exists, create a new room
-			room := chatroom.NewRoom(tarsrc)
-			chatroom.ActiveRooms[room.Uuid] = room
-			chatroom.StringToRoomUUID[tarsrc] = room.Uuid
-			chatroom.StringToRoomUUID[srctar] = room.Uuid
-			go room.Run()
-			chatroom.ServeWebSocket(room, w, r)
-		}
-	})
-
-	// actual websocket connection for the client to communicate with the server
-	r.HandleFunc("/ws/{servername}", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("/ws/{servername}", r.URL)
-		vars := mux.Vars(r)
-		log.Println(vars)
-		var room *chatroom.Room
-		if ro, ok := chatroom.ActiveRooms[chatroom.StringToRoomUUID[vars["servername"]]]; !ok {
-			log.Println("main(): making new room", vars["servername"])
-			room = chatroom.NewRoom(vars["servername"])
-		} else {
-			room = ro
-		}
-		go room.Run()
-		chatroom.ServeWebSocket(room, w, r)
-	})
-	err := http.ListenAndServe(*addr, r)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
-	}
-}
+package main
+
+import (
+	"errors"
+	"flag"
+	"irc-final-project/bots"
+	"irc-final-project/chatroom"
+	"irc-final-project/config"
+	"irc-final-project/logging"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// the config file, flags given on the command line override what it says
+var configFile = flag.String("config", "config.json", "config file, the defaults are used if it doesn't exist")
+var addr = flag.String("addr", ":8080", "http service address")
+var uploadDir = flag.String("upload-dir", "uploads", "directory to store shared files in")
+var maxUpload = flag.Int64("max-upload", 10<<20, "largest file that can be shared, in bytes")
+var echoBot = flag.String("echo-bot", "echobot", "nickname of the sample echo bot in the default room, empty for no bot")
+var ignoreFile = flag.String("ignore-file", "ignores.json", "file to save operators' ignore lists in, empty to not save them")
+
+// the web client's page
+var homePage = "home.html"
+
+// the log lines of the http handlers in this file
+var httpLog = logging.New("http")
+
+func serveHome(w http.ResponseWriter, r *http.Request) {
+	httpLog.Debug("request", logging.Fields{"path": r.URL.Path})
+	if r.URL.Path != "/" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.ServeFile(w, r, homePage)
+}
+
+// reads the config file and applies the flags that were given on top of it
+func loadConfig() (config.Config, error) {
+	cfg, err := config.Load(*configFile)
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "config":
+			explicit = true
+		case "addr":
+			cfg.Listen = []string{*addr}
+		case "upload-dir":
+			cfg.Storage.UploadDir = *uploadDir
+		case "max-upload":
+			cfg.Limits.MaxUploadSize = *maxUpload
+		case "echo-bot":
+			cfg.EchoBot = *echoBot
+		case "ignore-file":
+			cfg.Storage.IgnoreFile = *ignoreFile
+		}
+	})
+	// a missing config file is fine, unless it was asked for
+	if err != nil && (explicit || !errors.Is(err, os.ErrNotExist)) {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// hands the settings to the chatroom package
+func applyConfig(cfg config.Config) {
+	homePage = cfg.HomePage
+	chatroom.ServerName = cfg.ServerName
+	chatroom.MotdFile = cfg.MotdFile
+	chatroom.UploadDir = cfg.Storage.UploadDir
+	chatroom.IgnoreFile = cfg.Storage.IgnoreFile
+	chatroom.MaxUploadSize = cfg.Limits.MaxUploadSize
+	chatroom.MaxMessageSize = cfg.Limits.MaxMessageSize
+	chatroom.ReadBufferSize = cfg.Limits.ReadBufferSize
+	chatroom.WriteBufferSize = cfg.Limits.WriteBufferSize
+	chatroom.HistorySize = cfg.Limits.HistorySize
+	chatroom.SendQueueSize = cfg.Limits.SendQueueSize
+	chatroom.DroppedBeforeWarning = cfg.Limits.DroppedBeforeWarning
+	chatroom.DroppedBeforeDisconnect = cfg.Limits.DroppedBeforeDisconnect
+	chatroom.WriteWait = time.Duration(cfg.Timeouts.WriteWait)
+	chatroom.PongWait = time.Duration(cfg.Timeouts.PongWait)
+	chatroom.RoomIdleTimeout = time.Duration(cfg.Timeouts.RoomIdle)
+	chatroom.ResumeGrace = time.Duration(cfg.Timeouts.ResumeGrace)
+	chatroom.RoomsFile = cfg.Storage.RoomsFile
+	chatroom.BansFile = cfg.Storage.BansFile
+	chatroom.AuditFile = cfg.Storage.AuditFile
+	for _, operator := range cfg.Operators {
+		chatroom.Operators[operator.Name] = operator.Password
+	}
+}
+
+// sets up logging as the config says, the config was validated so the levels are known
+func configureLogging(cfg config.Logging) error {
+	level, err := logging.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	levels := make(map[string]logging.Level, len(cfg.Levels))
+	for subsystem, name := range cfg.Levels {
+		if levels[subsystem], err = logging.ParseLevel(name); err != nil {
+			return err
+		}
+	}
+	return logging.Configure(os.Stderr, cfg.Format, level, levels)
+}
+
+func main() {
+	flag.Parse()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal("loadConfig: ", err)
+	}
+	applyConfig(cfg)
+	if err := configureLogging(cfg.Logging); err != nil {
+		log.Fatal("configureLogging: ", err)
+	}
+	if err := chatroom.OpenAudit(); err != nil {
+		log.Fatal("OpenAudit: ", err)
+	}
+	if err := chatroom.LoadBans(); err != nil {
+		log.Fatal("LoadBans: ", err)
+	}
+	if err := chatroom.LoadIgnores(); err != nil {
+		log.Fatal("LoadIgnores: ", err)
+	}
+	if err := chatroom.LoadMotd(); err != nil {
+		log.Fatal("LoadMotd: ", err)
+	}
+	// the websockets, search and file sharing
+	r := chatroom.NewRouter()
+	// the default room and the rooms from the config file are never torn down
+	main, err := chatroom.NewPersistentRoom(chatroom.RoomInfo{Name: cfg.DefaultRoom})
+	if err != nil {
+		log.Fatal("NewPersistentRoom: ", err)
+	}
+	for _, room := range cfg.PersistentRooms {
+		_, err := chatroom.NewPersistentRoom(chatroom.RoomInfo{
+			Name:        room.Name,
+			Topic:       room.Topic,
+			Modes:       room.Modes,
+			Description: room.Description,
+			Owner:       room.Owner,
+		})
+		if err != nil {
+			log.Fatal("NewPersistentRoom: ", err)
+		}
+	}
+	// then the ones made with `/make --persist`
+	if err := chatroom.LoadRooms(); err != nil {
+		log.Fatal("LoadRooms: ", err)
+	}
+	// bots sit in the default room like users
+	if cfg.EchoBot != "" {
+		chatroom.AddBot(main, cfg.EchoBot, bots.Echo{})
+	}
+	// and bridges sit in the rooms they relay to IRC
+	for _, bridge := range cfg.Bridges {
+		room, _ := chatroom.FindRoom(bridge.Room)
+		bots.StartIRCBridge(room, &bots.IRCBridge{
+			Server:   bridge.Server,
+			TLS:      bridge.TLS,
+			Password: bridge.Password,
+			Nick:     bridge.Nick,
+			Channel:  bridge.Channel,
+		})
+	}
+	// serve the web page for the web client
+	r.HandleFunc("/", serveHome)
+	// serve on every address, and stop if any of them fails
+	errs := make(chan error)
+	for _, listen := range cfg.Listen {
+		go func(listen string) {
+			httpLog.Info("listen", logging.Fields{"addr": listen})
+			errs <- http.ListenAndServe(listen, r)
+		}(listen)
+	}
+	log.Fatal("ListenAndServe: ", <-errs)
+}
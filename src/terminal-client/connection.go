@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// how many times to try getting a lost connection back, and how long to wait before each try
+const (
+	resumeAttempts = 5
+	resumeDelay    = time.Second
+)
+
+// the websocket connection to the server
+// when it is lost, it is replaced by one that resumes our session, so we keep our nickname and room
+type connection struct {
+	lock   sync.Mutex
+	conn   *websocket.Conn
+	resume string // the token to resume our session with, the server sends it right after connecting
+}
+
+var server connection
+
+// connects to the server, asking for the protocols we speak
+func dial(serverUrl url.URL) (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = subprotocols()
+	conn, _, err := dialer.Dial(serverUrl.String(), nil)
+	return conn, err
+}
+
+func (c *connection) get() *websocket.Conn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn
+}
+
+// sends a line of text to the server
+func (c *connection) write(content string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, []byte(content))
+}
+
+func (c *connection) setResumeToken(token string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.resume = token
+}
+
+// tries to get a lost connection back, as the same user in the same room
+// returns false if the server doesn't let us, or can't be reached
+func (c *connection) reconnect(serverUrl url.URL) bool {
+	c.lock.Lock()
+	token := c.resume
+	c.lock.Unlock()
+	if token == "" {
+		// the server doesn't let clients resume
+		return false
+	}
+	serverUrl.RawQuery = url.Values{"resume": {token}}.Encode()
+	for attempt := 1; attempt <= resumeAttempts; attempt++ {
+		time.Sleep(resumeDelay)
+		log.Printf("Reconnecting (%d/%d)...\n", attempt, resumeAttempts)
+		// the server may not have noticed the connection is gone yet, and turns us away until it does
+		conn, err := dial(serverUrl)
+		if err != nil {
+			continue
+		}
+		c.lock.Lock()
+		c.conn.Close()
+		c.conn = conn
+		c.lock.Unlock()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// our session token, for http requests to the server on behalf of our connection
+// the server sends it right after connecting
+var session struct {
+	lock  sync.Mutex
+	token string
+}
+
+func setSessionToken(token string) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.token = token
+}
+
+func sessionToken() string {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.token
+}
+
+// a file shared to a room
+type Attachment struct {
+	Id   string `json:"Id"`
+	Name string `json:"Name"`
+	Size int64  `json:"Size"`
+	Url  string `json:"Url"`
+}
+
+// the http address of the server
+func serverHttpUrl(path string, query url.Values) string {
+	u := url.URL{Scheme: "http", Host: *address, Path: path, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// reads the error the server sent back
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// shares a local file to the current room
+func sendFile(path string) error {
+	token := sessionToken()
+	if token == "" {
+		return fmt.Errorf("not connected yet")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	query := url.Values{"session": {token}, "name": {filepath.Base(path)}}
+	resp, err := http.Post(serverHttpUrl("/upload", query), "application/octet-stream", f)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	var attachment Attachment
+	return json.NewDecoder(resp.Body).Decode(&attachment)
+}
+
+// downloads a shared file into the current directory, returning where it was saved
+func getFile(id string) (string, error) {
+	resp, err := http.Get(serverHttpUrl("/files/"+url.PathEscape(id), nil))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+	name := id
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = filepath.Base(params["filename"])
+	}
+	// don't overwrite anything
+	path := name
+	ext := filepath.Ext(name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// runs commands that the terminal client handles itself instead of the server
+// returns false if the line isn't one of them
+func runLocalCommand(line string) bool {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case "/send":
+		if arg == "" {
+			status.printInfo("Usage: /send path")
+			return true
+		}
+		go func() {
+			if err := sendFile(arg); err != nil {
+				status.printInfo(fmt.Sprintf("Cannot send %s: %v", arg, err))
+			}
+		}()
+		return true
+	case "/get":
+		if arg == "" {
+			status.printInfo("Usage: /get fileId")
+			return true
+		}
+		go func() {
+			path, err := getFile(arg)
+			if err != nil {
+				status.printInfo(fmt.Sprintf("Cannot get %s: %v", arg, err))
+				return
+			}
+			status.printInfo(fmt.Sprintf("Saved %s", path))
+		}()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// commands that take a room name as their first argument, for completion
+var roomCommands = map[string]bool{"join": true, "j": true, "markread": true}
+
+// commands the terminal client runs itself, see runLocalCommand
+var localCommands = []string{"send", "get"}
+
+// how often completion data is asked for while the user keeps pressing tab
+const completionRefresh = time.Second * 2
+
+// the names the server says we can complete, mirrors the server's completion data
+type Completion struct {
+	Commands     []string `json:"Commands"`
+	Nicknames    []string `json:"Nicknames"`
+	AllNicknames []string `json:"AllNicknames"`
+	Rooms        []string `json:"Rooms"`
+}
+
+// the latest completion data, and a way to ask the server for newer data
+type completer struct {
+	lock      sync.Mutex
+	data      Completion
+	requested time.Time
+	refresh   chan struct{} // the main loop sends `/complete` when this gets something
+}
+
+var completions = completer{refresh: make(chan struct{}, 1)}
+
+// replaces the completion data with what the server sent
+func (c *completer) update(data *Completion) {
+	if data == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.data = *data
+}
+
+// asks the main loop to get fresh completion data, unless it was asked lately
+func (c *completer) requestRefresh() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Since(c.requested) < completionRefresh {
+		return
+	}
+	c.requested = time.Now()
+	select {
+	case c.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// what the word being completed could be, given the words before it
+// the caller must hold the lock
+func (c *completer) candidates(words []string, word string) []string {
+	switch {
+	case len(words) == 0 && strings.HasPrefix(word, "/"):
+		var commands []string
+		for _, name := range append(append([]string{}, localCommands...), c.data.Commands...) {
+			commands = append(commands, "/"+name)
+		}
+		return commands
+	case len(words) == 1 && roomCommands[strings.TrimPrefix(words[0], "/")]:
+		return c.data.Rooms
+	case strings.HasPrefix(word, "@"):
+		var nicks []string
+		for _, nick := range uniqueNicknames(c.data.Nicknames, c.data.AllNicknames) {
+			nicks = append(nicks, "@"+nick)
+		}
+		return nicks
+	default:
+		return uniqueNicknames(c.data.Nicknames, c.data.AllNicknames)
+	}
+}
+
+// nicknames in the current room first, then everyone else on the server
+func uniqueNicknames(room []string, all []string) []string {
+	seen := make(map[string]bool)
+	var nicks []string
+	for _, nick := range append(append([]string{}, room...), all...) {
+		if !seen[nick] && nick != *nickname {
+			seen[nick] = true
+			nicks = append(nicks, nick)
+		}
+	}
+	return nicks
+}
+
+// the longest start that all the words share, ignoring case, taken from the first word
+func commonPrefix(words []string) string {
+	prefix := []rune(words[0])
+	for _, word := range words[1:] {
+		w := []rune(word)
+		n := 0
+		for n < len(prefix) && n < len(w) && strings.EqualFold(string(prefix[n]), string(w[n])) {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return string(prefix)
+}
+
+// completes the word before the cursor when tab is pressed, for the terminal's AutoCompleteCallback
+// one match is filled in, several are filled in as far as they agree and then listed
+func (c *completer) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	c.requestRefresh()
+	before := line[:pos]
+	start := strings.LastIndexAny(before, " \t") + 1
+	word := before[start:]
+	words := strings.Fields(before[:start])
+
+	c.lock.Lock()
+	var matches []string
+	for _, candidate := range c.candidates(words, word) {
+		if strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(word)) {
+			matches = append(matches, candidate)
+		}
+	}
+	c.lock.Unlock()
+	sort.Strings(matches)
+
+	switch len(matches) {
+	case 0:
+		return "", 0, false
+	case 1:
+		completed := matches[0] + " "
+		return before[:start] + completed + line[pos:], start + len(completed), true
+	}
+	prefix := commonPrefix(matches)
+	if len(prefix) <= len(word) {
+		status.printInfo(strings.Join(matches, "  "))
+		return "", 0, false
+	}
+	return before[:start] + prefix + line[pos:], start + len(prefix), true
+}
+
+// the interactive terminal, nil if stdin isn't a terminal
+var terminal *term.Terminal
+
+// where messages are printed, the interactive terminal if there is one
+var screen io.Writer = os.Stdout
+
+// puts stdin in raw mode and sets up line editing with tab completion
+// returns a function that puts the terminal back the way it was
+// does nothing if stdin isn't a terminal, eg when input is piped in
+func startTerminal() func() {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return func() {}
+	}
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return func() {}
+	}
+	terminal = term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "> ")
+	if width, height, err := term.GetSize(fd); err == nil {
+		terminal.SetSize(width, height)
+	}
+	terminal.AutoCompleteCallback = completions.complete
+	screen = terminal
+	return func() {
+		term.Restore(fd, oldState)
+		fmt.Println()
+	}
+}
+
+// reads lines the user types, until they quit
+// the channel is closed on end of input, or when ctrl-c is pressed in the interactive terminal
+func readInput(ch chan string) {
+	defer close(ch)
+	if terminal != nil {
+		for {
+			s, err := terminal.ReadLine()
+			if err != nil {
+				return
+			}
+			ch <- s
+		}
+	}
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		s, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fmt.Fprint(os.Stdin, "\r")
+		ch <- s
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// the websocket subprotocols the server speaks, mirrors the server's
+const (
+	// each frame has one JSON message, or several separated by newlines, and the room name after `/join` is sent as plain text
+	protocolLegacy = "chat.v1"
+	// each frame has one JSON envelope, or a JSON array of them
+	protocolV2 = "chat.v2"
+	// the same as chat.v2 in CBOR, in binary frames
+	protocolV2Cbor = "chat.v2.cbor"
+)
+
+// what we ask the server for, the newest first, given the --encoding flag
+func subprotocols() []string {
+	if *encoding == "cbor" {
+		return []string{protocolV2Cbor, protocolV2, protocolLegacy}
+	}
+	return []string{protocolV2, protocolLegacy}
+}
+
+// what a chat.v2 frame holds
+type Envelope struct {
+	Type    EnvelopeType `json:"Type"`
+	Message *Message     `json:"Message,omitempty"` // for envelopeMessage
+	Room    string       `json:"Room,omitempty"`    // the room we are now in, for envelopeSwitch
+}
+
+type EnvelopeType string
+
+const (
+	envelopeMessage EnvelopeType = "message" // a message from a room, or a direct message
+	envelopeSwitch  EnvelopeType = "switch"  // we were moved to another room, after `/join`
+)
+
+// reads the envelopes in a frame, in the protocol the server agreed to
+// servers that don't know about subprotocols speak the legacy one
+func readFrame(protocol string, frame []byte) ([]Envelope, error) {
+	switch protocol {
+	case protocolV2:
+	case protocolV2Cbor:
+		return readCborFrame(frame)
+	default:
+		return readLegacyFrame(frame), nil
+	}
+	if bytes.HasPrefix(frame, []byte("[")) {
+		var batch []Envelope
+		err := json.Unmarshal(frame, &batch)
+		return batch, err
+	}
+	var envelope Envelope
+	err := json.Unmarshal(frame, &envelope)
+	return []Envelope{envelope}, err
+}
+
+// one CBOR envelope, or an array of them
+func readCborFrame(frame []byte) ([]Envelope, error) {
+	// the major type in the top 3 bits of the first byte, 4 is an array
+	if len(frame) > 0 && frame[0]>>5 == 4 {
+		var batch []Envelope
+		err := cbor.Unmarshal(frame, &batch)
+		return batch, err
+	}
+	var envelope Envelope
+	err := cbor.Unmarshal(frame, &envelope)
+	return []Envelope{envelope}, err
+}
+
+// messages separated by newlines, or the name of the room we were moved to
+func readLegacyFrame(frame []byte) []Envelope {
+	var batch []Envelope
+	decoder := json.NewDecoder(bytes.NewReader(frame))
+	for {
+		var m Message
+		if err := decoder.Decode(&m); err != nil {
+			break
+		}
+		batch = append(batch, Envelope{Type: envelopeMessage, Message: &m})
+	}
+	if len(batch) == 0 {
+		return []Envelope{{Type: envelopeSwitch, Room: string(frame)}}
+	}
+	return batch
+}
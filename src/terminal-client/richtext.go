@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// a run of text that is all formatted the same way, mirrors the server's spans
+type Span struct {
+	Text      string `json:"Text"`
+	Bold      bool   `json:"Bold,omitempty"`
+	Italic    bool   `json:"Italic,omitempty"`
+	Underline bool   `json:"Underline,omitempty"`
+	Strike    bool   `json:"Strike,omitempty"`
+	Code      bool   `json:"Code,omitempty"`
+	CodeBlock bool   `json:"CodeBlock,omitempty"`
+	Fg        *int   `json:"Fg,omitempty"`
+	Bg        *int   `json:"Bg,omitempty"`
+}
+
+// the closest terminal colors to the 16 standard mIRC colors
+// the extended mIRC colors (16 to 98) are shown in the default color
+var ircColors = []color.Attribute{
+	color.FgHiWhite,   // 0 white
+	color.FgBlack,     // 1 black
+	color.FgBlue,      // 2 blue
+	color.FgGreen,     // 3 green
+	color.FgHiRed,     // 4 red
+	color.FgRed,       // 5 brown
+	color.FgMagenta,   // 6 purple
+	color.FgYellow,    // 7 orange
+	color.FgHiYellow,  // 8 yellow
+	color.FgHiGreen,   // 9 light green
+	color.FgCyan,      // 10 cyan
+	color.FgHiCyan,    // 11 light cyan
+	color.FgHiBlue,    // 12 light blue
+	color.FgHiMagenta, // 13 pink
+	color.FgHiBlack,   // 14 grey
+	color.FgWhite,     // 15 light grey
+}
+
+// background colors are 10 after their foreground colors
+const fgToBg = color.BgBlack - color.FgBlack
+
+// formats a span for the terminal
+func (s Span) String() string {
+	var attributes []color.Attribute
+	if s.Bold {
+		attributes = append(attributes, color.Bold)
+	}
+	if s.Italic {
+		attributes = append(attributes, color.Italic)
+	}
+	if s.Underline {
+		attributes = append(attributes, color.Underline)
+	}
+	if s.Strike {
+		attributes = append(attributes, color.CrossedOut)
+	}
+	if s.Code || s.CodeBlock {
+		attributes = append(attributes, color.FgHiGreen, color.BgBlack)
+	}
+	if s.Fg != nil && *s.Fg < len(ircColors) {
+		attributes = append(attributes, ircColors[*s.Fg])
+	}
+	if s.Bg != nil && *s.Bg < len(ircColors) {
+		attributes = append(attributes, ircColors[*s.Bg]+fgToBg)
+	}
+	text := s.Text
+	if s.CodeBlock {
+		text = " " + text + " "
+	}
+	if len(attributes) == 0 {
+		return text
+	}
+	return color.New(attributes...).Sprint(text)
+}
+
+// formats all the spans of a message
+func renderRichText(spans []Span) string {
+	var builder strings.Builder
+	for _, span := range spans {
+		builder.WriteString(span.String())
+	}
+	return builder.String()
+}
@@ -1,164 +1,445 @@
-package main
-
-import (
-	"bufio"
-	"encoding/json"
-	"flag"
-	"fmt"
-	"log"
-	"net/url"
-	"os"
-	"os/signal"
-	"strings"
-	"time"
-
-	"github.com/fatih/color"
-	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
-)
-
-// coloring
-var ITALICS = color.New(color.Italic).SprintFunc()
-var USERNAME_COLOR = color.New(color.FgYellow).Add(color.Bold).SprintFunc()
-var TIME_COLOR = color.New(color.BgBlue).SprintFunc()
-
-// a representation of a message, containing a source and its contents
-type Message struct {
-	Uuid            uuid.UUID `json:"Uuid"`            // the UUID of the user this message is from
-	FromNick        string    `json:"FromNick"`        // the nickname of the user this message is from
-	Content         string    `json:"Content"`         // the actual message
-	SentTime        time.Time `json:"SentTime"`        // when this message was sent
-	ServerName      string    `json:"ServerName"`      // the name of the server this message is being broadcasted to
-	IsDirectMessage bool      `json:"IsDirectMessage"` // whether this is a direct message or not
-}
-
-func (m Message) String() string {
-	content := m.Content
-	if m.IsDirectMessage {
-		content = ITALICS(content)
-	}
-	return TIME_COLOR("["+m.SentTime.Local().Format("15:04:05")+"]") + " " + USERNAME_COLOR("<"+m.FromNick+">") + " " + content
-}
-
-// location of the server
-var address = flag.String("host", "localhost:8080", "address of the server")
-
-// starting room name
-var roomName = flag.String("room", "main", "starting room")
-
-// nickname
-var nickname = flag.String("nick", "anonymous", "nickname")
-
-// https://github.com/gorilla/websocket/blob/master/examples/echo/client.go
-
-func main() {
-	flag.Parse()
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-
-	reader := bufio.NewReader(os.Stdin)
-	if *nickname == "anonymous" {
-		// enter a nickname
-		fmt.Print("Enter nickname: ")
-		*nickname, _ = reader.ReadString('\n')
-		*nickname = strings.TrimSpace(*nickname)
-		*nickname = url.QueryEscape(*nickname)
-	}
-
-	// create url for request
-	serverUrl := url.URL{
-		Scheme:   "ws", // websockets uses `ws` scheme
-		Host:     *address,
-		Path:     "/ws/" + *roomName,
-		RawQuery: "nickname=" + *nickname, // send nickname to the server (as a query)
-	}
-	log.Printf("Connecting to `%s` as `%s`\n", serverUrl.String(), *nickname)
-
-	// create a websocket connection to the server
-	conn, _, err := websocket.DefaultDialer.Dial(serverUrl.String(), nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer conn.Close()
-
-	done := make(chan struct{})
-
-	// start sending-receiving messages
-	// receiving messages
-	go func() {
-		defer close(done) // notify the outside world that we're done getting messages
-		for {
-			_, message, err := conn.ReadMessage() // leech off of the broadcast channel
-			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Println("read: ", err)
-					return
-				} else {
-					return
-				}
-			}
-			var m Message
-			json.Unmarshal(message, &m)
-			fmt.Println(m.String())
-		}
-	}()
-
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-
-	messageInput := make(chan string) // so the user can async input messages
-
-	// handle reading from stdin
-	go func(ch chan string) {
-		defer close(ch)
-		reader := bufio.NewReader(os.Stdin)
-		for {
-			s, err := reader.ReadString('\n')
-			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					return
-				} else {
-					log.Fatal(err)
-					return
-				}
-			}
-			fmt.Fprint(os.Stdin, "\r")
-			ch <- s
-		}
-	}(messageInput)
-
-stdinloop:
-	for {
-		select {
-		case <-done:
-			// finish when no more messages
-			return
-		case <-interrupt:
-			log.Println("interrupt")
-			// close connection
-			err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			if err != nil {
-				log.Println("write close:", err)
-				return
-			}
-			select {
-			case <-done:
-				// nop
-			case <-time.After(time.Second):
-				// nop
-			}
-			return
-		case content, ok := <-messageInput:
-			// get the message content from the user
-			if !ok {
-				break stdinloop
-			} else {
-				content = strings.TrimSpace(content)
-				conn.WriteMessage(websocket.TextMessage, []byte(content))
-			}
-		case <-ticker.C:
-			// nop so we can wait for input
-		}
-	}
-
-}
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// coloring
+var ITALICS = color.New(color.Italic).SprintFunc()
+var USERNAME_COLOR = color.New(color.FgYellow).Add(color.Bold).SprintFunc()
+var TIME_COLOR = color.New(color.BgBlue).SprintFunc()
+var ID_COLOR = color.New(color.Faint).SprintFunc()
+var QUOTE_COLOR = color.New(color.Faint, color.Italic).SprintFunc()
+var BADGE_COLOR = color.New(color.FgCyan).Add(color.Bold).SprintFunc()
+var HIGHLIGHT_COLOR = color.New(color.BgRed, color.FgHiWhite).Add(color.Bold).SprintFunc()
+var HIGHLIGHT_TEXT_COLOR = color.New(color.FgHiRed).SprintFunc()
+var ACTION_COLOR = color.New(color.FgMagenta).SprintFunc()
+var NOTICE_COLOR = color.New(color.FgGreen).SprintFunc()
+
+// what kind of message this is, mirrors the server's message kinds
+type MessageKind string
+
+const (
+	KindChat           MessageKind = "chat"
+	KindAction         MessageKind = "action"
+	KindNotice         MessageKind = "notice"
+	KindReactionAdd    MessageKind = "reaction-add"
+	KindReactionRemove MessageKind = "reaction-remove"
+	KindTyping         MessageKind = "typing"
+	KindUnread         MessageKind = "unread"
+	KindSession        MessageKind = "session"
+	KindFile           MessageKind = "file"
+	KindCompletion     MessageKind = "completion"
+)
+
+// a representation of a message, containing a source and its contents
+type Message struct {
+	Id              uint64         `json:"Id"`                     // server-wide unique id of this message, 0 if it was never posted to a room
+	Kind            MessageKind    `json:"Kind,omitempty"`         // what kind of message this is
+	Uuid            uuid.UUID      `json:"Uuid"`                   // the UUID of the user this message is from
+	FromNick        string         `json:"FromNick"`               // the nickname of the user this message is from
+	Content         string         `json:"Content"`                // the actual message
+	SentTime        time.Time      `json:"SentTime"`               // when this message was sent
+	ServerName      string         `json:"ServerName"`             // the name of the server this message is being broadcasted to
+	IsDirectMessage bool           `json:"IsDirectMessage"`        // whether this is a direct message or not
+	TargetId        uint64         `json:"TargetId,omitempty"`     // for reactions, the id of the message being reacted to
+	Emoji           string         `json:"Emoji,omitempty"`        // for reactions, the reaction being added or removed
+	Reactions       map[string]int `json:"Reactions,omitempty"`    // reaction counts of the message, or of the target message for reactions
+	ReplyTo         uint64         `json:"ReplyTo,omitempty"`      // the id of the message this is a reply to, 0 if it isn't a reply
+	Quote           *Quote         `json:"Quote,omitempty"`        // a preview of the message this is a reply to
+	Unread          []RoomUnread   `json:"Unread,omitempty"`       // for unread messages, our unread counts per room
+	SessionToken    string         `json:"SessionToken,omitempty"` // for session messages, the token to authenticate http requests with
+	ResumeToken     string         `json:"ResumeToken,omitempty"`  // for session messages, the token to reconnect as the same client with
+	Attachment      *Attachment    `json:"Attachment,omitempty"`   // for file messages, the shared file
+	Rich            []Span         `json:"Rich,omitempty"`         // the formatted content, if it has any formatting
+	Highlight       bool           `json:"Highlight,omitempty"`    // whether the message mentions us or one of our keywords
+	Completion      *Completion    `json:"Completion,omitempty"`   // for completion messages, the names we can tab-complete
+}
+
+// our unread messages in one room
+type RoomUnread struct {
+	Room     string `json:"Room"`
+	Unread   int    `json:"Unread"`
+	Mentions int    `json:"Mentions"`
+}
+
+// a short preview of a message, shown above replies to it
+type Quote struct {
+	Id       uint64 `json:"Id"`
+	FromNick string `json:"FromNick"`
+	Content  string `json:"Content"`
+}
+
+func (m Message) String() string {
+	timestamp := TIME_COLOR("[" + m.SentTime.Local().Format("15:04:05") + "]")
+	switch m.Kind {
+	case KindReactionAdd, KindReactionRemove:
+		// show the new reaction totals under the message they belong to
+		return timestamp + " " + ID_COLOR(fmt.Sprintf("  ↳ #%d", m.TargetId)) + " " + reactionSummary(m.Reactions) + " " + ITALICS("("+m.Content+")")
+	}
+	content := m.Content
+	if m.Rich != nil {
+		content = renderRichText(m.Rich)
+	}
+	if m.Attachment != nil {
+		content = fmt.Sprintf("📎 %s (%d bytes) %s", m.Attachment.Name, m.Attachment.Size, ID_COLOR("/get "+m.Attachment.Id))
+	}
+	if m.IsDirectMessage {
+		content = ITALICS(content)
+	}
+	id := ""
+	if m.Id != 0 {
+		// ids are needed to react to a message
+		id = ID_COLOR(fmt.Sprintf("#%d", m.Id)) + " "
+	}
+	// `<alice> hi`, or `* alice waves` for actions and `-alice- hi` for notices, like irc clients
+	nick := "<" + m.FromNick + ">"
+	nickColor := USERNAME_COLOR
+	switch m.Kind {
+	case KindAction:
+		nick = "* " + m.FromNick
+		nickColor = ACTION_COLOR
+		if m.Rich == nil && !m.Highlight {
+			content = ACTION_COLOR(content)
+		}
+	case KindNotice:
+		nick = "-" + m.FromNick + "-"
+		nickColor = NOTICE_COLOR
+	}
+	if m.Highlight {
+		nickColor = HIGHLIGHT_COLOR
+		if m.Rich == nil {
+			content = HIGHLIGHT_TEXT_COLOR(content)
+		}
+	}
+	nick = nickColor(nick)
+	line := timestamp + " " + id + nick + " " + content
+	if m.Quote != nil {
+		// indented quote of the parent above the reply
+		quote := fmt.Sprintf("           ┌ #%d <%s> %s", m.Quote.Id, m.Quote.FromNick, m.Quote.Content)
+		line = QUOTE_COLOR(quote) + "\n" + line
+	}
+	return line
+}
+
+// formats reaction counts as `👍 2  🎉 1`, in a stable order
+func reactionSummary(reactions map[string]int) string {
+	if len(reactions) == 0 {
+		return "no reactions"
+	}
+	emojis := make([]string, 0, len(reactions))
+	for emoji := range reactions {
+		emojis = append(emojis, emoji)
+	}
+	sort.Strings(emojis)
+	summary := make([]string, 0, len(emojis))
+	for _, emoji := range emojis {
+		summary = append(summary, fmt.Sprintf("%s %d", emoji, reactions[emoji]))
+	}
+	return strings.Join(summary, "  ")
+}
+
+// how long someone is shown as typing after their last typing signal, matches the server
+const typingTimeout = time.Second * 5
+
+// the bottom line of the terminal, showing unread badges and who is typing
+// messages are printed above it
+// in the interactive terminal, it is the prompt in front of what the user is typing
+type statusLine struct {
+	lock   sync.Mutex
+	shown  string                // what is currently on the status line
+	typing map[string]time.Time  // nickname -> when to stop showing them as typing
+	unread map[string]RoomUnread // room name -> our unread messages there
+}
+
+var status = statusLine{typing: make(map[string]time.Time), unread: make(map[string]RoomUnread)}
+
+// prints a message above the status line
+func (s *statusLine) printMessage(m Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch m.Kind {
+	case KindTyping:
+		s.typing[m.FromNick] = time.Now().Add(typingTimeout)
+		s.redraw()
+		return
+	case KindSession:
+		setSessionToken(m.SessionToken)
+		server.setResumeToken(m.ResumeToken)
+		return
+	case KindCompletion:
+		completions.update(m.Completion)
+		return
+	case KindUnread:
+		for _, u := range m.Unread {
+			s.unread[u.Room] = u
+		}
+		s.redraw()
+		return
+	case KindChat, KindAction, KindNotice:
+		// they sent what they were typing
+		delete(s.typing, m.FromNick)
+	}
+	s.clear()
+	fmt.Fprintln(screen, m.String())
+	if m.Highlight && *bell {
+		fmt.Fprint(screen, "\a")
+	}
+	s.redraw()
+}
+
+// prints a note from the terminal client itself above the status line
+func (s *statusLine) printInfo(text string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.clear()
+	fmt.Fprintln(screen, ITALICS(text))
+	s.redraw()
+}
+
+// forgets people who stopped typing
+func (s *statusLine) expire() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for nick, until := range s.typing {
+		if now.After(until) {
+			delete(s.typing, nick)
+		}
+	}
+	s.redraw()
+}
+
+// wipes the status line, the caller must hold the lock
+func (s *statusLine) clear() {
+	if terminal != nil {
+		// the terminal moves its prompt out of the way by itself
+		return
+	}
+	if s.shown != "" {
+		fmt.Print("\r\033[K")
+		s.shown = ""
+	}
+}
+
+// redraws the status line if it changed, the caller must hold the lock
+func (s *statusLine) redraw() {
+	nicks := make([]string, 0, len(s.typing))
+	for nick := range s.typing {
+		nicks = append(nicks, nick)
+	}
+	sort.Strings(nicks)
+	typing := ""
+	switch len(nicks) {
+	case 0:
+	case 1:
+		typing = nicks[0] + " is typing…"
+	default:
+		typing = strings.Join(nicks, ", ") + " are typing…"
+	}
+	text := strings.TrimSpace(s.badges() + " " + typing)
+	if text == s.shown {
+		return
+	}
+	if terminal != nil {
+		prompt := "> "
+		if text != "" {
+			prompt = ITALICS(text) + " > "
+		}
+		terminal.SetPrompt(prompt)
+		// writing nothing repaints the prompt
+		terminal.Write(nil)
+		s.shown = text
+		return
+	}
+	s.clear()
+	if text != "" {
+		fmt.Print(ITALICS(text))
+	}
+	s.shown = text
+}
+
+// unread badges like `[dev 3 (1@)]`, for rooms with unread messages
+// the caller must hold the lock
+func (s *statusLine) badges() string {
+	rooms := make([]string, 0, len(s.unread))
+	for room, u := range s.unread {
+		if u.Unread > 0 {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Strings(rooms)
+	badges := make([]string, 0, len(rooms))
+	for _, room := range rooms {
+		u := s.unread[room]
+		badge := fmt.Sprintf("%s %d", room, u.Unread)
+		if u.Mentions > 0 {
+			badge += fmt.Sprintf(" (%d@)", u.Mentions)
+		}
+		badges = append(badges, BADGE_COLOR("["+badge+"]"))
+	}
+	return strings.Join(badges, " ")
+}
+
+// location of the server
+var address = flag.String("host", "localhost:8080", "address of the server")
+
+// starting room name
+var roomName = flag.String("room", "main", "starting room")
+
+// nickname
+var nickname = flag.String("nick", "anonymous", "nickname")
+
+// ring the terminal bell when a message mentions us
+var bell = flag.Bool("bell", false, "ring the terminal bell on mentions")
+
+// how the server should send us messages
+var encoding = flag.String("encoding", "json", "how messages are sent to us: json, or cbor for smaller binary frames")
+
+// https://github.com/gorilla/websocket/blob/master/examples/echo/client.go
+
+func main() {
+	flag.Parse()
+	if *encoding != "json" && *encoding != "cbor" {
+		log.Fatalf("--encoding has to be json or cbor, not %s", *encoding)
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	reader := bufio.NewReader(os.Stdin)
+	if *nickname == "anonymous" {
+		// enter a nickname
+		fmt.Print("Enter nickname: ")
+		*nickname, _ = reader.ReadString('\n')
+		*nickname = strings.TrimSpace(*nickname)
+		*nickname = url.QueryEscape(*nickname)
+	}
+
+	// create url for request
+	serverUrl := url.URL{
+		Scheme:   "ws", // websockets uses `ws` scheme
+		Host:     *address,
+		Path:     "/ws/" + *roomName,
+		RawQuery: "nickname=" + *nickname, // send nickname to the server (as a query)
+	}
+	log.Printf("Connecting to `%s` as `%s`\n", serverUrl.String(), *nickname)
+
+	// create a websocket connection to the server
+	conn, err := dial(serverUrl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.conn = conn
+	defer func() { server.get().Close() }()
+
+	done := make(chan struct{})
+
+	// line editing and tab completion, once the nickname is entered
+	restoreTerminal := startTerminal()
+	defer restoreTerminal()
+	log.SetOutput(screen)
+
+	// start sending-receiving messages
+	// receiving messages
+	go func() {
+		defer close(done) // notify the outside world that we're done getting messages
+		for {
+			_, message, err := server.get().ReadMessage() // leech off of the broadcast channel
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return
+				}
+				// lost the connection, try to get it back without anyone noticing
+				log.Println("read: ", err)
+				if !server.reconnect(serverUrl) {
+					return
+				}
+				log.Println("Reconnected")
+				continue
+			}
+			envelopes, err := readFrame(server.get().Subprotocol(), message)
+			if err != nil {
+				log.Println("read: ", err)
+				continue
+			}
+			for _, envelope := range envelopes {
+				switch envelope.Type {
+				case envelopeMessage:
+					status.printMessage(*envelope.Message)
+				case envelopeSwitch:
+					status.printInfo(fmt.Sprintf("Now in %s", envelope.Room))
+				}
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// get the names to tab-complete right away
+	server.write("/complete")
+
+	messageInput := make(chan string) // so the user can async input messages
+
+	// handle reading from stdin
+	go readInput(messageInput)
+
+	// close the connection, and wait a bit for the server to close its side
+	closeConnection := func() {
+		err := server.get().WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		if err != nil {
+			log.Println("write close:", err)
+			return
+		}
+		select {
+		case <-done:
+			// nop
+		case <-time.After(time.Second):
+			// nop
+		}
+	}
+
+	for {
+		select {
+		case <-done:
+			// finish when no more messages
+			return
+		case <-interrupt:
+			log.Println("interrupt")
+			closeConnection()
+			return
+		case content, ok := <-messageInput:
+			// get the message content from the user
+			if !ok {
+				// end of input, or ctrl-c in the interactive terminal
+				closeConnection()
+				return
+			} else {
+				content = strings.TrimSpace(content)
+				if runLocalCommand(content) {
+					continue
+				}
+				server.write(content)
+			}
+		case <-completions.refresh:
+			server.write("/complete")
+		case <-ticker.C:
+			// stop showing people who stopped typing
+			status.expire()
+		}
+	}
+}